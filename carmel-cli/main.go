@@ -0,0 +1,818 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"Carmel/connector/frame"
+	"Carmel/connector/session"
+	"Carmel/rsakeys"
+	"Carmel/secret"
+	"Carmel/secret/enigma"
+	"Carmel/shared"
+	"Carmel/shared/tr"
+	"Carmel/shared/vtc"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const (
+	defaultPort      = 40404
+	invitationFormat = "IP: %s\nPort: %d\nName: %s\nPIN: %s\n"
+	canConnectFormat = "Would you like to chat with %s? [y/N] "
+	connectionClosed = "Connection with %s is closed\n"
+	connectionLost   = "Connection with %s is lost, reconnecting...\n"
+	connectionBack   = "Connection with %s is restored\n"
+	messageFormat    = "%s: %s\n"
+
+	firstContactFormat  = "First contact with %s: the key will be remembered if you chat\n"
+	keyChangedFormat    = "WARNING: THE KEY OF %s HAS CHANGED!\nSomebody may be impersonating your partner, ask them if they created new keys.\n"
+	rememberedKeyFormat = "Remembered key: %s (first seen %s)\n"
+	currentKeyFormat    = "Current key:    %s\n"
+	acceptKeyFormat     = "Type 'yes' to accept the new key of %s: "
+
+	fingerprintFormat  = "Key fingerprint of %s (%s): %s\n"
+	safetyNumberFormat = "Safety number: %s\n"
+	verifiedFormat     = "The key of %s is verified\n"
+	notVerifiedFormat  = "The key of %s is NOT verified: compare the safety number with your partner (-verify)\n"
+	sameNumberFormat   = "Does %s see the same safety number? [y/N] "
+
+	receivedKeyFormat  = "%s sent their public key during the login\n"
+	saveKeyFormat      = "Save the key of %s (if you chat)? [y/N] "
+	differentKeyFormat = "WARNING: THE KEY SENT BY %s DIFFERS FROM THE SAVED ONE!\n"
+
+	keyRotatedFormat = "%s replaced their key, the new key is signed with the old one\nNew key: %s\n"
+
+	cardFormat       = "Contact card of %s (%s), created %s\n"
+	importCardFormat = "Import the key of %s? [y/N] "
+	cardSavedFormat  = "The contact card is saved in %s\n"
+
+	revocationSavedFormat = "Revocation certificate: %s\nStore it offline and remove it from this computer. Send it to your partners only if the private key is lost or stolen.\n"
+	revocationFormat      = "The key of %s was revoked by its owner (%s)\nRevoked key: %s\n"
+	revokedKeyFormat      = "The key of %s is REVOKED: its owner reported it as lost or stolen (%s).\nAsk your partner for the new key (contact card or -bootstrap).\n"
+	myKeyRevoked          = "Your own key is revoked, create new keys."
+
+	passphraseVariable     = "CARMEL_PASSPHRASE"
+	backupVariable         = "CARMEL_BACKUP_PASSPHRASE"
+	backupPassphrasePrompt = "Passphrase of the backup: "
+	passphrasePrompt       = "Passphrase of the %s private key: "
+	newPassphrasePrompt    = "New passphrase (empty - no protection): "
+	repeatPassphrasePrompt = "Repeat the passphrase: "
+
+	connectionTimeout  = "Timeout"
+	connectionCanceled = "Canceled"
+	connectionError    = "Unknown error"
+	connectionSecurity = "Security breach"
+	connectionRejected = "Connection rejected"
+)
+
+var (
+	waitFlag     = flag.Bool("wait", false, "wait for a connection from your partner")
+	connectFlag  = flag.String("connect", "", "IP address of the partner to connect to")
+	portFlag     = flag.Int("port", defaultPort, "port number on which the server listens")
+	nameFlag     = flag.String("name", "", "user name of the partner to connect to")
+	pinFlag      = flag.String("pin", "", "PIN needed to establish the connection (generated when waiting, if empty)")
+	internetFlag = flag.Bool("internet", false, "show the Internet IP address in the invitation instead of the local one")
+	maxFrameFlag = flag.Int("max-frame", frame.DefaultMaxSize, "maximum size of a single frame in bytes")
+	pingFlag     = flag.Duration("heartbeat", session.DefaultHeartbeatInterval, "interval between heartbeats (0 - no heartbeats)")
+	rekeyFlag    = flag.Duration("rekey", session.DefaultRekeyInterval, "interval between exchanges of the symmetric keys (server only, 0 - never)")
+	missedFlag   = flag.Int("missed", session.DefaultMaxMissedHeartbeats, "number of missed heartbeats after which the session is closed")
+	legacyFlag   = flag.Bool("legacy-rsa", false, "compatibility mode: accept PKCS#1 v1.5 RSA padding (older programs)")
+	cipherFlag   = flag.String("cipher", suiteNames(enigma.DefaultSuites), "accepted cipher suites in the order of preference (comma separated)")
+	createFlag   = flag.String("create-keys", "", "create identity keys for the given user name and exit")
+	keyTypeFlag  = flag.String("key-type", string(rsakeys.DefaultKeyType), "type of the created keys: "+keyTypeNames())
+	changeFlag   = flag.Bool("change-passphrase", false, "change the passphrase of your private key (or protect a plain one) and exit")
+	verifyFlag   = flag.String("verify", "", "show the safety number for the given partner, mark the key as verified and exit")
+	rotateFlag   = flag.Bool("rotate-keys", false, "replace your keys with new ones (-key-type) signed with the old key and exit")
+	exportFlag   = flag.String("export-card", "", "save your signed contact card to the given file ('-' - print it) and exit")
+	displayFlag  = flag.String("display-name", "", "display name written in the exported contact card")
+	importFlag   = flag.String("import-card", "", "check the signature of the contact card in the given file, install the partner's public key and exit")
+	bootFlag     = flag.Bool("bootstrap", false, "exchange the public keys during the login if the partner's key is missing (first contact)")
+	revCertFlag  = flag.Bool("create-revocation", false, "create the revocation certificate of your keys (created by older versions without one) and exit")
+	backupFlag   = flag.String("backup", "", "save your keys, known peers and contact data to the given encrypted file and exit")
+	restoreFlag  = flag.String("restore", "", "restore your keys, known peers and contact data from the given backup and exit")
+	replaceFlag  = flag.Bool("replace", false, "with -restore: move the existing identity aside instead of refusing to restore")
+	revokeFlag   = flag.String("import-revocation", "", "import the revocation certificates from the given file (the revoked keys are refused) and exit")
+)
+
+func main() {
+	flag.Parse()
+
+	tr.Init()
+	defer tr.Cancel()
+
+	input := bufio.NewScanner(os.Stdin)
+	if *createFlag != "" {
+		if !createKeys(input, *createFlag, rsakeys.KeyType(*keyTypeFlag)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *restoreFlag != "" {
+		if !restoreBackup(input, *restoreFlag, *replaceFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil || rsaManager.MyUserName() == "" {
+		fmt.Fprintln(os.Stderr, "You are an undefined user: no private key was found in the program directory.")
+		os.Exit(1)
+	}
+	if *importFlag != "" {
+		if !importCard(input, rsaManager, *importFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *backupFlag != "" {
+		if !saveBackup(input, rsaManager, *backupFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *revokeFlag != "" {
+		if !importRevocations(rsaManager, *revokeFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *changeFlag {
+		if !changePassphrase(input, rsaManager) {
+			os.Exit(1)
+		}
+		return
+	}
+	if !unlock(input, rsaManager) {
+		os.Exit(1)
+	}
+	if *rotateFlag {
+		if !rotateKeys(input, rsaManager, rsakeys.KeyType(*keyTypeFlag)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *revCertFlag {
+		if !rsaManager.CreateRevocationForUser(shared.MyUserName) {
+			fmt.Fprintln(os.Stderr, "The revocation certificate could not be created")
+			os.Exit(1)
+		}
+		fmt.Printf(revocationSavedFormat, rsaManager.RevocationPathFor(shared.MyUserName))
+		return
+	}
+	if *exportFlag != "" {
+		if !exportCard(rsaManager, *exportFlag, *displayFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *verifyFlag != "" {
+		if !verify(input, rsaManager, *verifyFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	suites, ok := parseSuites(*cipherFlag)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Invalid cipher suites:", *cipherFlag)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	var ssn *session.Session
+	var buddyName string
+
+	switch {
+	case *waitFlag:
+		ssn, buddyName = waitForConnection(ctx, *portFlag, *pinFlag, suites)
+	case *connectFlag != "":
+		ssn, buddyName = connectTo(ctx, *connectFlag, *portFlag, *nameFlag, *pinFlag, suites)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if ssn == nil {
+		os.Exit(1)
+	}
+
+	ssn.HeartbeatInterval = *pingFlag
+	ssn.MaxMissedHeartbeats = *missedFlag
+	ssn.RekeyInterval = *rekeyFlag
+
+	if !finalInit(input, ssn, buddyName) {
+		ssn.Close()
+		os.Exit(1)
+	}
+	chat(ctx, input, ssn, buddyName)
+}
+
+// Creates the identity keys of the user (the private one is never sent).
+func createKeys(input *bufio.Scanner, userName string, keyType rsakeys.KeyType) bool {
+	switch {
+	case !shared.IsValidName(userName):
+		fmt.Fprintln(os.Stderr, "Invalid user name:", userName)
+		return false
+	case !keyType.IsValid():
+		fmt.Fprintln(os.Stderr, "Invalid key type:", keyType)
+		return false
+	}
+	if rsaManager := rsakeys.New(); rsaManager != nil {
+		if rsaManager.ExistPrivateKeyFor(userName) {
+			fmt.Fprintf(os.Stderr, "Keys for user %s already exist\n", userName)
+			return false
+		}
+		passphrase, ok := newPassphrase(input)
+		if !ok {
+			return false
+		}
+		if passphrase == "" {
+			fmt.Fprintln(os.Stderr, "Warning: the private key is not protected by a passphrase")
+		}
+		if rsaManager.CreateKeysOfTypeForUser(userName, keyType, passphrase) {
+			fmt.Printf("Keys %s for user %s were created, send %s_public.pem to your partners\n", keyType, userName, userName)
+			fmt.Printf(revocationSavedFormat, rsaManager.RevocationPathFor(userName))
+			return true
+		}
+	}
+	fmt.Fprintln(os.Stderr, "The keys could not be created")
+	return false
+}
+
+// The old private key signs the new public key, the partners
+// replace your key automatically the next time you connect.
+func rotateKeys(input *bufio.Scanner, rsaManager *rsakeys.Manager, keyType rsakeys.KeyType) bool {
+	if !keyType.IsValid() {
+		fmt.Fprintln(os.Stderr, "Invalid key type:", keyType)
+		return false
+	}
+	passphrase, ok := newPassphrase(input)
+	if !ok {
+		return false
+	}
+	if passphrase == "" {
+		fmt.Fprintln(os.Stderr, "Warning: the private key is not protected by a passphrase")
+	}
+	if rsaManager.RotateKeysForUser(shared.MyUserName, keyType, passphrase) {
+		publicKey := rsaManager.PublicKeyFromFileForUser(shared.MyUserName)
+		fmt.Printf("New keys %s for user %s were created\n", keyType, shared.MyUserName)
+		fmt.Printf(fingerprintFormat, shared.MyUserName, publicKey.Type, publicKey.Fingerprint())
+		fmt.Printf(revocationSavedFormat, rsaManager.RevocationPathFor(shared.MyUserName))
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "The keys could not be replaced")
+	return false
+}
+
+// Decrypts the private key with the passphrase
+// (from the CARMEL_PASSPHRASE variable or typed by the user).
+func unlock(input *bufio.Scanner, rsaManager *rsakeys.Manager) bool {
+	if !rsaManager.IsPrivateKeyEncryptedFor(shared.MyUserName) {
+		return true
+	}
+	passphrase, ok := os.LookupEnv(passphraseVariable)
+	if !ok {
+		if passphrase, ok = readLine(input, fmt.Sprintf(passphrasePrompt, shared.MyUserName)); !ok {
+			return false
+		}
+	}
+	if rsaManager.Unlock(shared.MyUserName, passphrase) {
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "Invalid passphrase")
+	return false
+}
+
+// A plain private key (saved by older programs) is protected at once.
+func changePassphrase(input *bufio.Scanner, rsaManager *rsakeys.Manager) bool {
+	userName := shared.MyUserName
+	oldPassphrase := ""
+	encrypted := rsaManager.IsPrivateKeyEncryptedFor(userName)
+	if encrypted {
+		var ok bool
+		if oldPassphrase, ok = readLine(input, fmt.Sprintf(passphrasePrompt, userName)); !ok {
+			return false
+		}
+	}
+	passphrase, ok := newPassphrase(input)
+	if !ok {
+		return false
+	}
+	if passphrase == "" {
+		fmt.Fprintln(os.Stderr, "The passphrase can't be empty")
+		return false
+	}
+	if encrypted && rsaManager.ChangePassphrase(userName, oldPassphrase, passphrase) ||
+		!encrypted && rsaManager.ProtectPrivateKey(userName, passphrase) {
+		fmt.Println("The passphrase was changed")
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "The passphrase could not be changed")
+	return false
+}
+
+func newPassphrase(input *bufio.Scanner) (string, bool) {
+	if passphrase, ok := os.LookupEnv(passphraseVariable); ok {
+		return passphrase, true
+	}
+	if passphrase, ok := readLine(input, newPassphrasePrompt); ok {
+		if repeated, ok := readLine(input, repeatPassphrasePrompt); ok {
+			if repeated == passphrase {
+				return passphrase, true
+			}
+			fmt.Fprintln(os.Stderr, "The passphrases are different")
+		}
+	}
+	return "", false
+}
+
+// The backup has its own passphrase (from the CARMEL_BACKUP_PASSPHRASE
+// variable or typed twice by the user), it can't be empty.
+func backupPassphrase(input *bufio.Scanner, repeat bool) (string, bool) {
+	passphrase, ok := os.LookupEnv(backupVariable)
+	if !ok {
+		if passphrase, ok = readLine(input, backupPassphrasePrompt); !ok {
+			return "", false
+		}
+		if repeat {
+			if repeated, ok := readLine(input, repeatPassphrasePrompt); !ok || repeated != passphrase {
+				fmt.Fprintln(os.Stderr, "The passphrases are different")
+				return "", false
+			}
+		}
+	}
+	if passphrase == "" {
+		fmt.Fprintln(os.Stderr, "The passphrase can't be empty")
+		return "", false
+	}
+	return passphrase, true
+}
+
+// All files of the keys directory are saved (the private key
+// stays encrypted with its own passphrase, if it has one).
+func saveBackup(input *bufio.Scanner, rsaManager *rsakeys.Manager, filePath string) bool {
+	passphrase, ok := backupPassphrase(input, true)
+	if !ok {
+		return false
+	}
+	if !strings.HasSuffix(filePath, rsakeys.BackupExtension) {
+		filePath += rsakeys.BackupExtension
+	}
+	if rsaManager.SaveBackup(filePath, passphrase) {
+		fmt.Println("The backup is saved in", filePath)
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "The backup could not be saved")
+	return false
+}
+
+// An existing identity is replaced only with -replace (it's moved aside).
+func restoreBackup(input *bufio.Scanner, filePath string, replace bool) bool {
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return false
+	}
+	passphrase, ok := backupPassphrase(input, false)
+	if !ok {
+		return false
+	}
+	switch rsaManager.RestoreBackupFromFile(filePath, passphrase, replace) {
+	case rsakeys.BackupRestored:
+		shared.MyUserName = ""
+		fmt.Println("The identity of", rsaManager.MyUserName(), "is restored")
+		return true
+	case rsakeys.BackupConflict:
+		fmt.Fprintln(os.Stderr, "Your keys (or other files) would be overwritten, nothing was restored (see -replace)")
+	case rsakeys.BackupUnsupported:
+		fmt.Fprintln(os.Stderr, "The backup was made by a newer version of the program")
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid passphrase or damaged backup:", filePath)
+	}
+	return false
+}
+
+func readLine(input *bufio.Scanner, prompt string) (string, bool) {
+	fmt.Print(prompt)
+	if input.Scan() {
+		return input.Text(), true
+	}
+	return "", false
+}
+
+// The card is signed with your private key (it must be unlocked).
+func exportCard(rsaManager *rsakeys.Manager, filePath, displayName string) bool {
+	card := rsaManager.ContactCardForUser(shared.MyUserName, displayName)
+	if card == nil {
+		fmt.Fprintln(os.Stderr, "The contact card can't be created.")
+		return false
+	}
+	if filePath == "-" {
+		os.Stdout.Write(card.Armor())
+		return true
+	}
+	if !strings.HasSuffix(filePath, rsakeys.ContactCardExtension) {
+		filePath += rsakeys.ContactCardExtension
+	}
+	if card.Save(filePath) {
+		fmt.Printf(cardSavedFormat, filePath)
+		return true
+	}
+	return false
+}
+
+// The signature proves that the card comes from the owner of the key,
+// the user still compares the fingerprint with the partner.
+func importCard(input *bufio.Scanner, rsaManager *rsakeys.Manager, filePath string) bool {
+	card := rsakeys.ContactCardFromFile(filePath)
+	if card == nil {
+		fmt.Fprintln(os.Stderr, "Invalid contact card (or its signature):", filePath)
+		return false
+	}
+	fmt.Printf(cardFormat, card.Name, card.DisplayName, card.Created.Local().Format("2006-01-02 15:04"))
+	fmt.Printf(fingerprintFormat, card.Name, card.PublicKey.Type, card.Fingerprint)
+	answer, ok := readLine(input, fmt.Sprintf(importCardFormat, card.Name))
+	if !ok || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+		return false
+	}
+	switch rsaManager.ImportContactCard(card) {
+	case rsakeys.CardImported:
+		fmt.Println("The key of", card.Name, "is installed")
+		return true
+	case rsakeys.CardKnown:
+		fmt.Println("The key of", card.Name, "is already installed")
+		return true
+	case rsakeys.CardKeyConflict:
+		fmt.Fprintf(os.Stderr, differentKeyFormat, card.Name)
+	case rsakeys.CardRevoked:
+		fmt.Fprintf(os.Stderr, revokedKeyFormat, card.Name, rsaManager.RevocationOf(card.PublicKey).Created.Local().Format("2006-01-02 15:04"))
+	}
+	return false
+}
+
+// The certificate is signed with the revoked key, so it can't be forged
+// and needs no confirmation.
+func importRevocations(rsaManager *rsakeys.Manager, filePath string) bool {
+	revocations := rsakeys.RevocationsFromFile(filePath)
+	if revocations == nil {
+		fmt.Fprintln(os.Stderr, "No valid revocation certificate in", filePath)
+		return false
+	}
+	for _, r := range rsaManager.ImportRevocations(revocations) {
+		printRevocation(rsaManager, r)
+	}
+	fmt.Printf("%d revocation certificate(s) read from %s\n", len(revocations), filePath)
+	return true
+}
+
+func printRevocation(rsaManager *rsakeys.Manager, r *rsakeys.Revocation) {
+	fmt.Printf(revocationFormat, r.Name, r.Created.Local().Format("2006-01-02 15:04"), r.Fingerprint)
+	if myKey := rsaManager.PublicKeyFromFileForUser(shared.MyUserName); myKey != nil && myKey.Fingerprint() == r.Fingerprint {
+		fmt.Fprintln(os.Stderr, myKeyRevoked)
+	}
+}
+
+// Both partners compare the safety number (e.g. over the phone).
+func verify(input *bufio.Scanner, rsaManager *rsakeys.Manager, buddyName string) bool {
+	publicKey := rsaManager.PublicKeyFromFileForUser(shared.MyUserName)
+	buddyPublicKey := rsaManager.PublicKeyFromFileForUser(buddyName)
+	if publicKey == nil || buddyPublicKey == nil {
+		fmt.Fprintln(os.Stderr, "No public key of", buddyName)
+		return false
+	}
+	fmt.Printf(fingerprintFormat, shared.MyUserName, publicKey.Type, publicKey.Fingerprint())
+	printVerification(rsaManager, buddyName, publicKey, buddyPublicKey)
+
+	answer, ok := readLine(input, fmt.Sprintf(sameNumberFormat, buddyName))
+	if !ok {
+		return false
+	}
+	verified := strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+	if rsaManager.SetVerified(buddyName, buddyPublicKey, verified) {
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "The verification could not be saved")
+	return false
+}
+
+func printVerification(rsaManager *rsakeys.Manager, buddyName string, publicKey, buddyPublicKey *rsakeys.PublicKey) {
+	fmt.Printf(fingerprintFormat, buddyName, buddyPublicKey.Type, buddyPublicKey.Fingerprint())
+	fmt.Printf(safetyNumberFormat, rsakeys.SafetyNumber(shared.MyUserName, publicKey, buddyName, buddyPublicKey))
+	if rsaManager != nil && rsaManager.IsVerified(buddyName, buddyPublicKey) {
+		fmt.Printf(verifiedFormat, buddyName)
+		return
+	}
+	fmt.Printf(notVerifiedFormat, buddyName)
+}
+
+// Server: prints the invitation data and waits for the client.
+func waitForConnection(ctx context.Context, port int, pin string, suites []enigma.SuiteId) (*session.Session, string) {
+	if pin == "" {
+		pin = secret.SliceToHex(secret.RandomBytes(5))
+	}
+	if !shared.OnlyHexDigits(pin) {
+		fmt.Fprintln(os.Stderr, "Invalid PIN:", pin)
+		return nil, ""
+	}
+
+	ip := shared.MyLocalIP
+	if *internetFlag && shared.MyInternetIP != "" {
+		ip = shared.MyInternetIP
+	}
+	fmt.Printf(invitationFormat, ip, port, shared.MyUserName, pin)
+
+	if ssn := session.ServerNew(port); ssn != nil {
+		ssn.Link.MaxFrameSize = *maxFrameFlag
+		ssn.CipherSuites = suites
+		ssn.LegacyRSA = *legacyFlag
+		ssn.Bootstrap = *bootFlag
+		state, failedPort := ssn.Connect(ctx)
+		if state == vtc.Ok {
+			buddyName, loginState := ssn.ReadLogin(pin)
+			if loginState == vtc.Accepted {
+				return ssn, buddyName
+			}
+			state = loginState
+		}
+		ssn.Close()
+		if state == vtc.Rejected {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", connectionRejected, ssn.Reason())
+			return nil, ""
+		}
+		fmt.Fprintf(os.Stderr, "%s (port: %d)\n", failureReason(state), failedPort)
+	}
+	return nil, ""
+}
+
+// Client: connects to the server and sends the login data.
+func connectTo(ctx context.Context, ip string, port int, buddyName, pin string, suites []enigma.SuiteId) (*session.Session, string) {
+	switch {
+	case !shared.IsValidIPAddress(ip):
+		fmt.Fprintln(os.Stderr, "Invalid IP address:", ip)
+		return nil, ""
+	case !shared.IsValidName(buddyName):
+		fmt.Fprintln(os.Stderr, "Invalid user name:", buddyName)
+		return nil, ""
+	case !shared.OnlyHexDigits(pin) || pin == "":
+		fmt.Fprintln(os.Stderr, "Invalid PIN:", pin)
+		return nil, ""
+	}
+
+	newSession := session.ClientNew
+	if *bootFlag && !rsakeys.New().ExistPublicKeyFor(buddyName) {
+		newSession = session.BootstrapClientNew
+	}
+	if ssn := newSession(ip, port, buddyName, shared.ConnectionTimeout); ssn != nil {
+		ssn.Link.MaxFrameSize = *maxFrameFlag
+		ssn.CipherSuites = suites
+		ssn.LegacyRSA = *legacyFlag
+		state, currentPort := ssn.Connect(ctx)
+		if state == vtc.Ok {
+			state = ssn.SendLogin(buddyName, pin)
+			if state == vtc.Accepted {
+				return ssn, buddyName
+			}
+		}
+		ssn.Close()
+		if state == vtc.Rejected {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", connectionRejected, ssn.Reason())
+			return nil, ""
+		}
+		fmt.Fprintf(os.Stderr, "%s (%s:%d)\n", failureReason(state), ip, currentPort)
+	}
+	return nil, ""
+}
+
+// Shows the verdict about the partner's key (see rsakeys/partner.go),
+// asks if we want to talk and completes the key exchange.
+// The received or changed key is saved only if the user agrees to talk.
+func finalInit(input *bufio.Scanner, ssn *session.Session, buddyName string) bool {
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		ssn.Decline()
+		return false
+	}
+	verdict := ssn.CheckPeer(rsaManager)
+	if !showVerdict(input, rsaManager, buddyName, verdict) {
+		ssn.Decline()
+		return false
+	}
+	printVerification(rsaManager, buddyName, ssn.Enigma.PublicKey(), ssn.Enigma.BuddyPublicKey())
+	if answer, ok := readLine(input, fmt.Sprintf(canConnectFormat, buddyName)); ok && strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+		if err := ssn.AcceptPeer(rsaManager, verdict); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't remember the key:", err)
+			ssn.Decline()
+			return false
+		}
+		return ssn.Establish()
+	}
+	ssn.Decline()
+	return false
+}
+
+// Returns false if the key is refused (by the verdict or by the user).
+func showVerdict(input *bufio.Scanner, rsaManager *rsakeys.Manager, buddyName string, v *rsakeys.Verdict) bool {
+	for _, r := range v.Revocations {
+		printRevocation(rsaManager, r)
+	}
+	if v.RotatedKey != nil {
+		fmt.Printf(keyRotatedFormat, buddyName, v.RotatedKey.Fingerprint())
+	}
+	switch {
+	case v.Key == nil:
+		fmt.Fprintln(os.Stderr, "No public key of", buddyName)
+	case v.DifferentKey:
+		fmt.Fprintf(os.Stderr, differentKeyFormat, buddyName)
+	case v.Revoked != nil:
+		fmt.Fprintf(os.Stderr, revokedKeyFormat, buddyName, v.Revoked.Created.Local().Format("2006-01-02 15:04"))
+	case v.Err != nil:
+		fmt.Fprintln(os.Stderr, "Can't read known peers:", v.Err)
+	}
+	if v.IsRefused() {
+		return false
+	}
+
+	if v.SaveKey {
+		fmt.Printf(receivedKeyFormat, buddyName)
+		fmt.Printf(fingerprintFormat, buddyName, v.Key.Type, v.Key.Fingerprint())
+		if answer, ok := readLine(input, fmt.Sprintf(saveKeyFormat, buddyName)); !ok || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+			return false
+		}
+	}
+	if v.NewPeer {
+		fmt.Printf(firstContactFormat, buddyName)
+	}
+	if v.ChangedKey != nil {
+		fmt.Fprintf(os.Stderr, keyChangedFormat, buddyName)
+		fmt.Fprintf(os.Stderr, rememberedKeyFormat, v.ChangedKey.Fingerprint, v.ChangedKey.FirstSeen.Local().Format("2006-01-02 15:04"))
+		fmt.Fprintf(os.Stderr, currentKeyFormat, v.Key.Fingerprint())
+		if answer, ok := readLine(input, fmt.Sprintf(acceptKeyFormat, buddyName)); !ok || strings.TrimSpace(answer) != "yes" {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends every line read from stdin to the partner
+// until EOF, interruption or closing the connection by the partner.
+func chat(ctx context.Context, input *bufio.Scanner, ssn *session.Session, buddyName string) {
+	closed := make(chan struct{})
+	go netLoop(ssn, buddyName, closed)
+	go eventLoop(ssn, buddyName, closed)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for input.Scan() {
+			lines <- input.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			fmt.Printf(connectionClosed, buddyName)
+			if reason := ssn.Reason(); reason != "" {
+				fmt.Fprintln(os.Stderr, reason)
+			}
+			ssn.Close()
+			return
+		case <-ctx.Done():
+			ssn.Logout()
+			ssn.Close()
+			return
+		case line, ok := <-lines:
+			if !ok {
+				ssn.Logout()
+				ssn.Close()
+				return
+			}
+			if text := strings.TrimSpace(line); text != "" {
+				if request := ssn.Out.Requester.Send(vtc.Message, []byte(text), nil); request != nil {
+					if answer := ssn.Out.Responder.Read(request); answer != nil {
+						continue
+					}
+				}
+				fmt.Fprintln(os.Stderr, "The message was not delivered.")
+			}
+		}
+	}
+}
+
+func netLoop(ssn *session.Session, buddyName string, closed chan<- struct{}) {
+	defer close(closed)
+
+	for {
+		request := ssn.ReadRequest()
+		if request == nil {
+			return
+		}
+		switch request.Id {
+		case vtc.Message:
+			if answer := ssn.In.Responder.Send(vtc.Ok, request, nil, nil); answer == nil {
+				return
+			}
+			fmt.Printf(messageFormat, buddyName, string(request.Data))
+		case vtc.Logout:
+			ssn.In.Responder.Send(vtc.Ok, request, nil, nil)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func eventLoop(ssn *session.Session, buddyName string, closed <-chan struct{}) {
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-ssn.Events():
+			switch event.Type {
+			case session.LinkLost:
+				fmt.Printf(connectionLost, buddyName)
+			case session.LinkRestored:
+				fmt.Printf(connectionBack, buddyName)
+			case session.SecurityBreach:
+				fmt.Fprintf(os.Stderr, "%s: %s\n", connectionSecurity, event.Reason)
+			}
+		}
+	}
+}
+
+func parseSuites(text string) ([]enigma.SuiteId, bool) {
+	var suites []enigma.SuiteId
+	for _, name := range strings.Split(text, ",") {
+		id, ok := enigma.SuiteByName(name)
+		if !ok {
+			return nil, false
+		}
+		suites = append(suites, id)
+	}
+	return suites, true
+}
+
+func suiteNames(suites []enigma.SuiteId) string {
+	names := make([]string, 0, len(suites))
+	for _, id := range suites {
+		names = append(names, id.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func keyTypeNames() string {
+	names := make([]string, 0, len(rsakeys.KeyTypes))
+	for _, keyType := range rsakeys.KeyTypes {
+		names = append(names, string(keyType))
+	}
+	return strings.Join(names, ", ")
+}
+
+func failureReason(state vtc.OperationStatusType) string {
+	switch state {
+	case vtc.Timeout:
+		return connectionTimeout
+	case vtc.Cancel:
+		return connectionCanceled
+	case vtc.SecurityBreach:
+		return connectionSecurity
+	}
+	return connectionError
+}
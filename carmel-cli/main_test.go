@@ -0,0 +1,224 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The test binary runs as the program itself when this variable is set.
+const runMainVariable = "CARMEL_CLI_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainVariable) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Output of the program, read while it's running.
+type output struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (o *output) Write(data []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buffer.Write(data)
+}
+
+func (o *output) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buffer.String()
+}
+
+type program struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output *output
+	done   chan error
+}
+
+func start(t *testing.T, home string, args ...string) *program {
+	p := &program{output: &output{}, done: make(chan error, 1)}
+	p.cmd = exec.Command(os.Args[0], args...)
+	p.cmd.Env = append(os.Environ(), runMainVariable+"=1", "HOME="+home, passphraseVariable+"=kot")
+	p.cmd.Stdout, p.cmd.Stderr = p.output, p.output
+	stdin, err := p.cmd.StdinPipe()
+	if !assert.NoError(t, err) || !assert.NoError(t, p.cmd.Start()) {
+		t.FailNow()
+	}
+	p.stdin = stdin
+	go func() {
+		p.done <- p.cmd.Wait()
+	}()
+	return p
+}
+
+func run(t *testing.T, home string, args ...string) string {
+	p := start(t, home, args...)
+	p.stdin.Close()
+	p.wait(t)
+	return p.output.String()
+}
+
+func (p *program) send(line string) {
+	fmt.Fprintln(p.stdin, line)
+}
+
+// Waits until the output matches the pattern, returns the submatches.
+func (p *program) expect(t *testing.T, pattern string) []string {
+	re := regexp.MustCompile(pattern)
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if match := re.FindStringSubmatch(p.output.String()); match != nil {
+			return match
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%q not found in the output:\n%s", pattern, p.output.String())
+	return nil
+}
+
+// A data race found in the program (go test -race) fails the test.
+func (p *program) wait(t *testing.T) error {
+	select {
+	case err := <-p.done:
+		if strings.Contains(p.output.String(), "WARNING: DATA RACE") {
+			t.Fatalf("data race in the program:\n%s", p.output.String())
+		}
+		return err
+	case <-time.After(30 * time.Second):
+		p.cmd.Process.Kill()
+		t.Fatalf("the program didn't exit:\n%s", p.output.String())
+	}
+	return nil
+}
+
+// Homes of two users who have each other's public keys.
+func users(t *testing.T) (string, string) {
+	alice, bob := t.TempDir(), t.TempDir()
+	assert.Contains(t, run(t, alice, "-create-keys", "alice", "-key-type", "ed25519"), "were created")
+	assert.Contains(t, run(t, bob, "-create-keys", "bob", "-key-type", "ed25519"), "were created")
+	exchange := func(from, to, name string) {
+		data, err := ioutil.ReadFile(filepath.Join(from, ".carmel", "rsa_keys", name+"_public.pem"))
+		if assert.NoError(t, err) {
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(to, ".carmel", "rsa_keys", name+"_public.pem"), data, 0600))
+		}
+	}
+	exchange(alice, bob, "alice")
+	exchange(bob, alice, "bob")
+	return alice, bob
+}
+
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// The server prints the address it listens on.
+func connect(t *testing.T, alice, bob, pin string) (*program, *program) {
+	port := freePort(t)
+	server := start(t, alice, "-wait", "-port", port, "-pin", "0a1b")
+	addr := server.expect(t, `Server: (\S+):`+port)[1]
+	client := start(t, bob, "-connect", addr, "-port", port, "-name", "alice", "-pin", pin)
+	return server, client
+}
+
+func Test_Chat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the program")
+	}
+	alice, bob := users(t)
+	server, client := connect(t, alice, bob, "0a1b")
+
+	// The client learns that it's accepted after the server's user agrees.
+	server.expect(t, `Would you like to chat with bob\?`)
+	assert.Contains(t, server.output.String(), fmt.Sprintf(firstContactFormat, "bob"))
+	server.send("y")
+	client.expect(t, `Would you like to chat with alice\?`)
+	client.send("y")
+
+	client.send("hello from bob")
+	server.expect(t, `bob: hello from bob`)
+	server.send("hello from alice")
+	client.expect(t, `alice: hello from alice`)
+
+	// EOF ends the session on both sides.
+	client.stdin.Close()
+	assert.NoError(t, client.wait(t))
+	server.expect(t, strings.TrimSpace(fmt.Sprintf(connectionClosed, "bob")))
+	server.stdin.Close()
+	assert.NoError(t, server.wait(t))
+}
+
+func Test_WrongPin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the program")
+	}
+	alice, bob := users(t)
+	server, client := connect(t, alice, bob, "0a1c")
+	defer server.stdin.Close()
+	defer client.stdin.Close()
+
+	assert.Error(t, client.wait(t))
+	assert.Error(t, server.wait(t))
+	assert.Contains(t, client.output.String(), connectionSecurity)
+	assert.Contains(t, server.output.String(), connectionSecurity)
+	assert.NotContains(t, server.output.String(), "Would you like to chat")
+}
+
+func Test_ParseSuites(t *testing.T) {
+	suites, ok := parseSuites(*cipherFlag)
+	assert.True(t, ok)
+	assert.Equal(t, *cipherFlag, suiteNames(suites))
+
+	_, ok = parseSuites("aes-gcm,rot13")
+	assert.False(t, ok)
+}
@@ -1,88 +1,159 @@
 package chat
 
 import (
-	"Carmel/connector/message"
+	"Carmel/chat/news"
 	"Carmel/connector/session"
-	"Carmel/shared"
-	"Carmel/shared/vtc"
+	"Carmel/rsakeys"
+	"Carmel/shared/tr"
 	"fmt"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 )
 
-func finalInit(app *gtk.Application, role vtc.RoleType, buddyName string, ssn *session.Session) bool {
-	// Wszystko do tej pory poszło dobrze, ale może się okazać że
-	// nie mamy publicznego klucza RSA dla wskazanej osoby.
-	// Jeśli tak by było to dupa.
-	if ssn.In.Enigma.SetBuddyRSAPublicKey(buddyName) {
-		// Możemy kontynuuować komunikację, ale czy na pewno chcemy?
-		if dialogCanConnectWith(app, buddyName) {
-			switch role {
-			case vtc.Server:
-				if !sendAcceptance(ssn) {
-					return false
-				}
-				if !ssn.SendKeys() {
-					return false
-				}
-				if !ssn.ExchangeBlockIdentifiersAsServer() {
-					return false
-				}
-			case vtc.Client:
-				if !ssn.ReadKeys() {
-					return false
-				}
-				if !ssn.ExchangeBlockIdentifiersAsClient() {
-					return false
-				}
+// Pokazuje werdykt o kluczu rozmówcy (patrz rsakeys/partner.go).
+// Otrzymany lub zmieniony klucz zapisujemy dopiero wtedy,
+// gdy użytkownik zgodzi się na rozmowę.
+func finalInit(app *gtk.Application, buddyName string, ssn *session.Session) bool {
+	if rsaManager := rsakeys.New(); rsaManager != nil {
+		verdict := ssn.CheckPeer(rsaManager)
+		if showVerdict(app, buddyName, verdict) && dialogCanConnectWith(app, buddyName, ssn) {
+			if err := ssn.AcceptPeer(rsaManager, verdict); err != nil {
+				dialogKnownPeersError(app, buddyName, err)
+			} else {
+				return ssn.Establish()
 			}
-			return true
 		}
 	}
+	ssn.Decline()
 	return false
 }
 
-func sendAcceptance(ssn *session.Session) bool {
-	msg := message.NewWithType(vtc.Answer)
-	msg.Id = vtc.Login
-	msg.Status = vtc.Accepted
-	msg.Tstamp = shared.Now()
-	if data := msg.ToJsonSnapped(); data != nil {
-		if cipher := ssn.In.Enigma.EncryptRSA(data); cipher != nil {
-			return ssn.In.Requester.SendRawMessage(cipher)
-		}
+// Zwraca false, jeśli klucz został odrzucony (w werdykcie lub przez użytkownika).
+func showVerdict(app *gtk.Application, buddyName string, v *rsakeys.Verdict) bool {
+	if v.RotatedKey != nil {
+		dialogKeyRotated(app, buddyName, v.RotatedKey)
+	}
+	switch {
+	case v.Key == nil:
+		// Nie mamy publicznego klucza wskazanej osoby.
+	case v.DifferentKey:
+		dialogWarning(app, fmt.Sprintf(keyChangedHeadline, buddyName), fmt.Sprintf(differentKeyFormat, buddyName))
+	case v.Revoked != nil:
+		text := fmt.Sprintf(keyRevokedFormat, v.Revoked.Created.Local().Format("2006-01-02 15:04"), buddyName)
+		dialogWarning(app, fmt.Sprintf(keyRevokedHeadline, buddyName), text+fmt.Sprintf(fingerprintFormat, buddyName, v.Key.Type, inLines(v.Key.Fingerprint(), 8)))
+	case v.Err != nil:
+		dialogKnownPeersError(app, buddyName, v.Err)
+	}
+	if v.IsRefused() {
+		return false
+	}
+	if v.SaveKey && !dialogSaveKey(app, buddyName, v.Key) {
+		return false
+	}
+	if v.ChangedKey != nil && !dialogAcceptChangedKey(app, buddyName, v.ChangedKey, v.Key) {
+		return false
+	}
+	return true
+}
+
+func dialogKeyRotated(app *gtk.Application, buddyName string, newKey *rsakeys.PublicKey) {
+	headline := fmt.Sprintf(keyRotatedHeadline, buddyName)
+	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_INFO, gtk.BUTTONS_OK, headline); dialog != nil {
+		defer dialog.Destroy()
+		dialog.FormatSecondaryText(keyRotatedText + fmt.Sprintf(fingerprintFormat, buddyName, newKey.Type, inLines(newKey.Fingerprint(), 8)))
+		dialog.Run()
 	}
-	return false
 }
 
-func dialogCanConnectWith(app *gtk.Application, buddyName string) bool {
-	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO, ""); dialog != nil {
+func dialogWarning(app *gtk.Application, headline, text string) {
+	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_CLOSE, headline); dialog != nil {
 		defer dialog.Destroy()
-		dialog.FormatSecondaryText(fmt.Sprintf(canConnectFormat, buddyName))
-		if dialog.Run() == gtk.RESPONSE_YES {
-			return true
+		dialog.FormatSecondaryText(text)
+		dialog.Run()
+	}
+}
+
+// Użytkownik sprawdza odcisk klucza otrzymanego przy logowaniu.
+func dialogSaveKey(app *gtk.Application, buddyName string, key *rsakeys.PublicKey) bool {
+	headline := fmt.Sprintf(receivedKeyHeadline, buddyName)
+	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_CANCEL, headline); dialog != nil {
+		defer dialog.Destroy()
+		dialog.FormatSecondaryText(receivedKeyText + fmt.Sprintf(fingerprintFormat, buddyName, key.Type, inLines(key.Fingerprint(), 8)))
+		if _, err := dialog.AddButton(saveKeyButton, gtk.RESPONSE_ACCEPT); tr.IsOK(err) {
+			dialog.SetDefaultResponse(gtk.RESPONSE_CANCEL)
+			return dialog.Run() == gtk.RESPONSE_ACCEPT
 		}
 	}
 	return false
 }
 
-// Wysyła informację o zakończeniu sesji.
-func (w *Window) sendDisconnectRequest() bool {
-	if request := w.ssn.Out.Requester.Send(vtc.Logout, nil, nil); request != nil {
-		if answer := w.ssn.Out.Responder.Read(request); answer != nil {
-			if answer.Status == vtc.Ok {
-				return true
-			}
+// Klucz rozmówcy różni się od zapamiętanego przy pierwszym kontakcie.
+// Zmieniony klucz użytkownik musi świadomie zaakceptować.
+func dialogAcceptChangedKey(app *gtk.Application, buddyName string, peer *rsakeys.Peer, key *rsakeys.PublicKey) bool {
+	text := fmt.Sprintf(keyChangedFormat, buddyName)
+	text += fmt.Sprintf(rememberedKeyFormat, inLines(peer.Fingerprint, 8), peer.FirstSeen.Local().Format("2006-01-02 15:04"))
+	text += fmt.Sprintf(currentKeyFormat, inLines(key.Fingerprint(), 8))
+
+	headline := fmt.Sprintf(keyChangedHeadline, buddyName)
+	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_CANCEL, headline); dialog != nil {
+		defer dialog.Destroy()
+		dialog.FormatSecondaryText(text)
+		if _, err := dialog.AddButton(acceptKeyButton, gtk.RESPONSE_ACCEPT); tr.IsOK(err) {
+			dialog.SetDefaultResponse(gtk.RESPONSE_CANCEL)
+			return dialog.Run() == gtk.RESPONSE_ACCEPT
 		}
 	}
 	return false
 }
 
+func dialogKnownPeersError(app *gtk.Application, buddyName string, err error) {
+	headline := fmt.Sprintf(knownPeersHeadline, buddyName)
+	if dialog := gtk.MessageDialogNew(app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE, headline); dialog != nil {
+		defer dialog.Destroy()
+		dialog.FormatSecondaryText(fmt.Sprintf(knownPeersFormat, err))
+		dialog.Run()
+	}
+}
+
+// Użytkownik widzi odcisk klucza, który odpowiedział, i numer bezpieczeństwa.
+func dialogCanConnectWith(app *gtk.Application, buddyName string, ssn *session.Session) bool {
+	headline := fmt.Sprintf(canConnectFormat, buddyName)
+	return dialogVerification(app.GetActiveWindow(), buddyName, ssn.Enigma.PublicKey(), ssn.Enigma.BuddyPublicKey(), gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO, headline) == gtk.RESPONSE_YES
+}
+
 func (w *Window) dialogConnectionClosed() {
 	glib.IdleAdd(func() {
 		if dialog := gtk.MessageDialogNew(w.win, gtk.DIALOG_MODAL, gtk.MESSAGE_INFO, gtk.BUTTONS_CLOSE, ""); dialog != nil {
 			defer dialog.Destroy()
-			dialog.FormatSecondaryText(fmt.Sprintf(connectionClosed, w.buddyName))
+			text := fmt.Sprintf(connectionClosed, w.buddyName)
+			if reason := w.ssn.Reason(); reason != "" {
+				text += "\n" + reason
+			}
+			dialog.FormatSecondaryText(text)
+			dialog.Run()
+		}
+	})
+}
+
+// Ktoś próbował podsunąć nam powtórzoną (przechwyconą) wiadomość.
+// Wiadomość została odrzucona, ale użytkownik powinien o tym wiedzieć.
+func (w *Window) dialogSecurityBreach(reason string) {
+	glib.IdleAdd(func() {
+		if dialog := gtk.MessageDialogNew(w.win, gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_CLOSE, securityBreach); dialog != nil {
+			defer dialog.Destroy()
+			dialog.FormatSecondaryText(reason)
+			dialog.Run()
+		}
+	})
+}
+
+// Wiadomość nie została wysłana (lub rozmówca jej nie potwierdził).
+// Dialog może być pokazany z dowolnego wątku.
+func (w *Window) dialogNotSent(msg news.News, reason string) {
+	glib.IdleAdd(func() {
+		if dialog := gtk.MessageDialogNew(w.win, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE, messageNotSent); dialog != nil {
+			defer dialog.Destroy()
+			dialog.FormatSecondaryText("%s\n\n%s", reason, msg.Text)
 			dialog.Run()
 		}
 	})
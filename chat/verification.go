@@ -0,0 +1,135 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package chat
+
+import (
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"Carmel/shared/tr"
+	"fmt"
+	"github.com/gotk3/gotk3/gtk"
+	"strings"
+)
+
+const (
+	fingerprintFormat  = "Key fingerprint of %s (%s):\n%s"
+	safetyNumberFormat = "Safety number:\n%s"
+	verifiedText       = "Verified: you compared the safety number with %s."
+	notVerifiedText    = "Not verified: compare the safety number with %s (e.g. over the phone)."
+	verifyLabelFormat  = "%s sees the same safety number"
+	verifiedMarkup     = "<span font_desc='8' foreground='#99FF99'>verified</span>"
+	notVerifiedMarkup  = "<span font_desc='8' foreground='#FF9966'>not verified</span>"
+
+	keyChangedHeadline  = "The key of %s has changed!"
+	keyChangedFormat    = "Somebody may be impersonating %s. Ask your partner (e.g. over the phone) if new keys were created.\n\n"
+	rememberedKeyFormat = "Remembered key (first seen %[2]s):\n%[1]s\n\n"
+	currentKeyFormat    = "Current key:\n%s"
+	acceptKeyButton     = "Accept the new key"
+
+	receivedKeyHeadline = "%s sent their public key"
+	receivedKeyText     = "Compare the fingerprint with your partner (e.g. over the phone). The key is saved if you agree to chat.\n\n"
+	differentKeyFormat  = "The key sent by %s differs from the saved one.\nThe connection is refused."
+	saveKeyButton       = "Save the key"
+
+	keyRotatedHeadline = "%s replaced their key"
+	keyRotatedText     = "The new key is signed with the old one, it replaces the saved key.\n\n"
+
+	keyRevokedHeadline = "The key of %s is revoked!"
+	keyRevokedFormat   = "The owner reported the key as lost or stolen (%s).\nThe connection is refused, ask %s for the new key (contact card or exchange of keys).\n\n"
+
+	knownPeersHeadline = "The key of %s can't be checked or saved"
+	knownPeersFormat   = "Remembered keys of partners can't be read or saved (%v).\nThe connection is refused."
+)
+
+// Pokazuje odcisk klucza rozmówcy i numer bezpieczeństwa.
+// Po porównaniu numeru z rozmówcą użytkownik może oznaczyć klucz jako zweryfikowany.
+func dialogVerification(parent gtk.IWindow, buddyName string, publicKey, buddyPublicKey *rsakeys.PublicKey,
+	msgType gtk.MessageType, buttons gtk.ButtonsType, headline string) gtk.ResponseType {
+
+	rsaManager := rsakeys.New()
+	if rsaManager == nil || publicKey == nil || buddyPublicKey == nil {
+		return gtk.RESPONSE_NONE
+	}
+	verified := rsaManager.IsVerified(buddyName, buddyPublicKey)
+
+	if dialog := gtk.MessageDialogNew(parent, gtk.DIALOG_MODAL, msgType, buttons, headline); dialog != nil {
+		defer dialog.Destroy()
+
+		dialog.FormatSecondaryText(verificationText(buddyName, publicKey, buddyPublicKey, verified))
+		if checkButton, err := gtk.CheckButtonNewWithLabel(fmt.Sprintf(verifyLabelFormat, buddyName)); tr.IsOK(err) {
+			if box, err := dialog.GetMessageArea(); tr.IsOK(err) {
+				checkButton.SetActive(verified)
+				box.PackEnd(checkButton, false, false, 4)
+				checkButton.Show()
+
+				response := dialog.Run()
+				if checkButton.GetActive() != verified {
+					rsaManager.SetVerified(buddyName, buddyPublicKey, checkButton.GetActive())
+				}
+				return response
+			}
+		}
+	}
+	return gtk.RESPONSE_NONE
+}
+
+func verificationText(buddyName string, publicKey, buddyPublicKey *rsakeys.PublicKey, verified bool) string {
+	number := rsakeys.SafetyNumber(shared.MyUserName, publicKey, buddyName, buddyPublicKey)
+
+	status := fmt.Sprintf(notVerifiedText, buddyName)
+	if verified {
+		status = fmt.Sprintf(verifiedText, buddyName)
+	}
+	return strings.Join([]string{
+		fmt.Sprintf(fingerprintFormat, buddyName, buddyPublicKey.Type, inLines(buddyPublicKey.Fingerprint(), 8)),
+		fmt.Sprintf(safetyNumberFormat, inLines(number, 4)),
+		status,
+	}, "\n\n")
+}
+
+// Markup of the verification state shown in the header bar.
+func verificationMarkup(buddyName string, buddyPublicKey *rsakeys.PublicKey) string {
+	if rsaManager := rsakeys.New(); rsaManager != nil && buddyPublicKey != nil {
+		if rsaManager.IsVerified(buddyName, buddyPublicKey) {
+			return verifiedMarkup
+		}
+	}
+	return notVerifiedMarkup
+}
+
+// Groups of digits (separated by spaces), n groups in a line.
+func inLines(text string, n int) string {
+	groups := strings.Fields(text)
+	var lines []string
+	for len(groups) > n {
+		lines = append(lines, strings.Join(groups[:n], " "))
+		groups = groups[n:]
+	}
+	return strings.Join(append(lines, strings.Join(groups, " ")), "\n")
+}
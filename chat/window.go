@@ -31,6 +31,7 @@ package chat
 import (
 	"Carmel/chat/news"
 	"Carmel/connector/session"
+	"Carmel/rsakeys"
 	"Carmel/shared"
 	"Carmel/shared/tr"
 	"Carmel/shared/vtc"
@@ -50,8 +51,15 @@ const (
 	OtherNameTag     = "other_name"
 	OtherMessageTag  = "other_message"
 	subtitleFormat   = "IP: %s"
+	rttFormat        = "%s   RTT: %d ms"
+	reconnecting     = "reconnecting..."
+	outboxSize       = 32
 	canConnectFormat = "Would you like to chat with %s?"
 	connectionClosed = "Connection with %s is closed"
+	securityBreach   = "Security breach: a message was rejected"
+	messageNotSent   = "The message was not sent"
+	outboxFull       = "Too many messages are waiting to be sent, try again later."
+	notDelivered     = "%s did not confirm the message, the connection may be lost."
 )
 
 var (
@@ -82,6 +90,7 @@ type Window struct {
 	app             *gtk.Application
 	win             *gtk.ApplicationWindow
 	headerBar       *gtk.HeaderBar
+	verification    *gtk.Label
 	buddyName       string
 	ssn             *session.Session
 	browser         *gtk.TextView
@@ -97,14 +106,21 @@ type Window struct {
 	cancel          context.CancelFunc
 	wg              sync.WaitGroup
 	buddyNewsChan   chan news.News
+	outbox          chan news.News
 	connectionInUse bool
 	mutex           sync.Mutex
+
+	// Klucze z chwili nawiązania połączenia (numer bezpieczeństwa
+	// jest dostępny także po zamknięciu sesji).
+	publicKey      *rsakeys.PublicKey
+	buddyPublicKey *rsakeys.PublicKey
 }
 
-func New(app *gtk.Application, role vtc.RoleType, buddyName string, ssn *session.Session) *Window {
-	if finalInit(app, role, buddyName, ssn) {
+func New(app *gtk.Application, buddyName string, ssn *session.Session) *Window {
+	if finalInit(app, buddyName, ssn) {
 		if win, err := gtk.ApplicationWindowNew(app); tr.IsOK(err) {
-			w := &Window{app: app, win: win, buddyName: buddyName, ssn: ssn, connectionInUse: true}
+			w := &Window{app: app, win: win, buddyName: buddyName, ssn: ssn, connectionInUse: true,
+				publicKey: ssn.Enigma.PublicKey(), buddyPublicKey: ssn.Enigma.BuddyPublicKey()}
 			if w.headerBar = w.createHeaderBar(); w.headerBar != nil {
 				if menuButton := w.createMenu(); menuButton != nil {
 					w.headerBar.PackEnd(menuButton)
@@ -125,10 +141,13 @@ func New(app *gtk.Application, role vtc.RoleType, buddyName string, ssn *session
 
 func (w *Window) ShowAll() {
 	w.buddyNewsChan = make(chan news.News)
+	w.outbox = make(chan news.News, outboxSize)
 	w.wg.Add(1)
 
 	go w.browserLoop(w.buddyNewsChan, &w.wg)
 	go w.netLoop(w.buddyNewsChan, &w.wg)
+	go w.sendLoop()
+	go w.eventLoop()
 
 	w.win.ShowAll()
 	w.entry.GrabFocus()
@@ -142,20 +161,37 @@ func (w *Window) closeWindowAction() {
 	w.win.Close()
 }
 
+// Akcja wywołana ponieważ użytkownik wybrał 'Safety number...' w menu okna.
+func (w *Window) safetyNumberAction() {
+	dialogVerification(w.win, w.buddyName, w.publicKey, w.buddyPublicKey, gtk.MESSAGE_INFO, gtk.BUTTONS_CLOSE, w.buddyName)
+	w.updateVerification()
+}
+
+// Stan weryfikacji klucza rozmówcy (w pasku tytułowym),
+// numer bezpieczeństwa jest widoczny w podpowiedzi.
+func (w *Window) updateVerification() {
+	w.verification.SetMarkup(verificationMarkup(w.buddyName, w.buddyPublicKey))
+	number := rsakeys.SafetyNumber(shared.MyUserName, w.publicKey, w.buddyName, w.buddyPublicKey)
+	w.verification.SetTooltipText(fmt.Sprintf(safetyNumberFormat, inLines(number, 4)))
+}
+
 // Akcja wywołana ponieważ użytkownik wybrał 'Stop' w menu okna.
 func (w *Window) stopConnectionAction() {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
 	if w.connectionInUse {
-		w.sendDisconnectRequest()
-		w.dialogConnectionClosed()
-		w.cancel()
-		w.ssn.Close()
-		close(w.buddyNewsChan)
-		w.disableWidget()
 		w.connectionInUse = false
 		w.stopAction.SetEnabled(false)
+		w.disableWidget()
+		// W czasie wznawiania połączenia odpowiedź na wylogowanie może
+		// nadejść dopiero po ConnectionTimeout, główny wątek GTK nie czeka.
+		go func() {
+			w.ssn.Logout()
+			w.dialogConnectionClosed()
+			w.cancel()
+			w.ssn.Close()
+		}()
 	}
 }
 
@@ -168,7 +204,6 @@ func (w *Window) buddyClosedConnection() {
 		w.dialogConnectionClosed()
 		w.cancel()
 		w.ssn.Close()
-		close(w.buddyNewsChan)
 		w.disableWidget()
 		w.connectionInUse = false
 		w.stopAction.SetEnabled(false)
@@ -189,19 +224,37 @@ func (w *Window) createHeaderBar() *gtk.HeaderBar {
 	if bar, err := gtk.HeaderBarNew(); tr.IsOK(err) {
 		bar.SetShowCloseButton(false)
 		bar.SetTitle(w.buddyName)
-		address := strings.Split(w.ssn.In.RemoteAddr, ":")
-		bar.SetSubtitle(fmt.Sprintf(subtitleFormat, address[0]))
+		bar.SetSubtitle(w.subtitle())
+		if label, err := gtk.LabelNew(""); tr.IsOK(err) {
+			w.verification = label
+			w.updateVerification()
+			bar.PackStart(label)
+		}
 		return bar
 	}
 	return nil
 }
 
+func (w *Window) subtitle() string {
+	address := strings.Split(w.ssn.Link.RemoteAddr, ":")
+	subtitle := fmt.Sprintf(subtitleFormat, address[0])
+	if rtt := w.ssn.RTT(); rtt > 0 {
+		subtitle = fmt.Sprintf(rttFormat, subtitle, rtt.Milliseconds())
+	}
+	return subtitle
+}
+
 func (w *Window) createMenu() *gtk.MenuButton {
 	if btn, err := gtk.MenuButtonNew(); tr.IsOK(err) {
 		if menu := glib.MenuNew(); menu != nil {
+			menu.Append("Safety number...", "win.safety_number")
 			menu.Append("Stop", "win.stop")
 			menu.Append("Quit", "win.close")
 
+			safetyNumberAction := glib.SimpleActionNew("safety_number", nil)
+			safetyNumberAction.Connect("activate", w.safetyNumberAction)
+			w.win.AddAction(safetyNumberAction)
+
 			stopAction := glib.SimpleActionNew("stop", nil)
 			stopAction.Connect("activate", w.stopConnectionAction)
 			w.win.AddAction(stopAction)
@@ -268,16 +321,17 @@ func (w *Window) entryHandler(_, e interface{}) {
 				endIter := w.entryBuffer.GetEndIter()
 
 				if text, err := w.entryBuffer.GetText(startIter, endIter, true); tr.IsOK(err) {
-					w.entryBuffer.Delete(w.entryBuffer.GetStartIter(), w.entryBuffer.GetEndIter())
-					w.entryBuffer.PlaceCursor(w.entryBuffer.GetIterAtLine(0))
-
 					if msg := news.New(shared.MyUserName, text, true); msg.Valid() {
-						if request := w.ssn.Out.Requester.Send(vtc.Message, []byte(text), nil); request != nil {
-							if answer := w.ssn.Out.Responder.Read(request); answer != nil {
-								w.buddyNewsChan <- msg
-							}
+						// Tekst zostaje w polu edycji, jeśli kolejka jest pełna.
+						select {
+						case w.outbox <- msg:
+						default:
+							w.dialogNotSent(msg, outboxFull)
+							return
 						}
 					}
+					w.entryBuffer.Delete(w.entryBuffer.GetStartIter(), w.entryBuffer.GetEndIter())
+					w.entryBuffer.PlaceCursor(w.entryBuffer.GetIterAtLine(0))
 				}
 			}
 		}
@@ -337,14 +391,71 @@ func (w *Window) browserLoop(inChan <-chan news.News, wg *sync.WaitGroup) {
 		case <-w.ctx.Done():
 			tr.Info("%v", w.ctx.Err())
 			return
-		case msg := <-inChan:
+		case msg, ok := <-inChan:
+			if !ok {
+				return
+			}
 			w.appendTextToBrowser(msg)
 		}
 	}
 }
 
+// Wysyłanie wiadomości odbywa się poza głównym wątkiem GTK,
+// po zerwaniu połączenia odpowiedź może nadejść dopiero po jego wznowieniu.
+func (w *Window) sendLoop() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case msg := <-w.outbox:
+			if w.ctx.Err() != nil {
+				return
+			}
+			if request := w.ssn.Out.Requester.Send(vtc.Message, []byte(msg.Text), nil); request != nil {
+				if answer := w.ssn.Out.Responder.Read(request); answer != nil {
+					glib.IdleAdd(func() {
+						w.appendTextToBrowser(msg)
+					})
+					continue
+				}
+			}
+			if w.ctx.Err() == nil {
+				w.dialogNotSent(msg, fmt.Sprintf(notDelivered, w.buddyName))
+			}
+		}
+	}
+}
+
+// Informuje użytkownika o zerwaniu i wznowieniu połączenia,
+// odrzuconych (powtórzonych) wiadomościach
+// oraz pokazuje czas odpowiedzi rozmówcy (RTT).
+func (w *Window) eventLoop() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case event := <-w.ssn.Events():
+			switch event.Type {
+			case session.LinkLost:
+				glib.IdleAdd(func() {
+					w.headerBar.SetSubtitle(reconnecting)
+				})
+			case session.LinkRestored, session.Heartbeat:
+				glib.IdleAdd(func() {
+					w.headerBar.SetSubtitle(w.subtitle())
+				})
+			case session.SecurityBreach:
+				w.dialogSecurityBreach(event.Reason)
+			}
+		}
+	}
+}
+
+// Kanał inChan należy do tej pętli, jest zamykany gdy odczyt
+// z zamkniętej sesji zwróci nil.
 func (w *Window) netLoop(inChan chan<- news.News, wg *sync.WaitGroup) {
 	defer func() {
+		close(inChan)
 		w.ssn.Close()
 		//wg.Done()
 	}()
@@ -355,12 +466,15 @@ func (w *Window) netLoop(inChan chan<- news.News, wg *sync.WaitGroup) {
 			tr.Info("%v", w.ctx.Err())
 			return
 		default:
-			if request := w.ssn.In.Requester.Read(); request != nil {
+			if request := w.ssn.ReadRequest(); request != nil {
 				switch request.Id {
 				case vtc.Message:
 					if answer := w.ssn.In.Responder.Send(vtc.Ok, request, nil, nil); answer != nil {
 						if msg := news.New(w.buddyName, string(request.Data), false); msg.Valid() {
-							inChan <- msg
+							select {
+							case inChan <- msg:
+							case <-w.ctx.Done():
+							}
 							continue
 						}
 					}
@@ -370,6 +484,7 @@ func (w *Window) netLoop(inChan chan<- news.News, wg *sync.WaitGroup) {
 				}
 			}
 			w.buddyClosedConnection()
+			return
 		}
 	}
 }
@@ -0,0 +1,148 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wire format of a single frame:
+//
+//	magic (2) | version (1) | type (1) | channel (1) | counter (4, LE) | length (4, LE) | payload (length)
+//
+// The payload length is checked against the maximum frame size
+// before any memory is allocated for it, and all reads are full reads.
+
+type Type uint8
+
+const (
+	_       Type = iota
+	Raw          // data without request/answer semantics (handshake)
+	Request      // request
+	Answer       // answer to the request with the same counter
+)
+
+const (
+	Version        uint8 = 1
+	HeaderSize           = 13
+	DefaultMaxSize       = 1 << 20 // 1 MiB
+)
+
+var magic = [2]byte{0xCA, 0x4D}
+
+var (
+	ErrBadMagic    = errors.New("frame: invalid magic bytes")
+	ErrVersion     = errors.New("frame: unsupported version")
+	ErrUnknownType = errors.New("frame: unknown frame type")
+	ErrTooLarge    = errors.New("frame: frame too large")
+	ErrTruncated   = errors.New("frame: truncated frame")
+)
+
+type Frame struct {
+	Type    Type
+	Channel uint8
+	Counter uint32
+	Payload []byte
+}
+
+func (t Type) IsValid() bool {
+	return t == Raw || t == Request || t == Answer
+}
+
+// Writes the frame in one call to the writer.
+func Write(w io.Writer, f *Frame, maxSize int) error {
+	if !f.Type.IsValid() {
+		return ErrUnknownType
+	}
+	if len(f.Payload) > limit(maxSize) {
+		return ErrTooLarge
+	}
+
+	buffer := make([]byte, HeaderSize, HeaderSize+len(f.Payload))
+	buffer[0], buffer[1] = magic[0], magic[1]
+	buffer[2] = Version
+	buffer[3] = byte(f.Type)
+	buffer[4] = f.Channel
+	binary.LittleEndian.PutUint32(buffer[5:9], f.Counter)
+	binary.LittleEndian.PutUint32(buffer[9:13], uint32(len(f.Payload)))
+	buffer = append(buffer, f.Payload...)
+
+	_, err := w.Write(buffer)
+	return err
+}
+
+// Reads one complete frame.
+// io.EOF is returned only if the stream ended cleanly between frames.
+func Read(r io.Reader, maxSize int) (*Frame, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+
+	switch {
+	case header[0] != magic[0] || header[1] != magic[1]:
+		return nil, ErrBadMagic
+	case header[2] != Version:
+		return nil, fmt.Errorf("%w: %d", ErrVersion, header[2])
+	case !Type(header[3]).IsValid():
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, header[3])
+	}
+
+	n := binary.LittleEndian.Uint32(header[9:13])
+	if uint64(n) > uint64(limit(maxSize)) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, n)
+	}
+
+	f := &Frame{
+		Type:    Type(header[3]),
+		Channel: header[4],
+		Counter: binary.LittleEndian.Uint32(header[5:9]),
+		Payload: make([]byte, n),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func limit(maxSize int) int {
+	if maxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return maxSize
+}
@@ -0,0 +1,98 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encoded(t *testing.T, f *Frame) []byte {
+	var buffer bytes.Buffer
+	assert.Nil(t, Write(&buffer, f, 0))
+	return buffer.Bytes()
+}
+
+func Test_ReadWrite(t *testing.T) {
+	var tests = []*Frame{
+		{Type: Raw, Channel: 1, Counter: 0, Payload: []byte{}},
+		{Type: Request, Channel: 1, Counter: 7, Payload: []byte("Piotr")},
+		{Type: Answer, Channel: 2, Counter: 0xfffffffe, Payload: bytes.Repeat([]byte{0x5a}, 70000)},
+	}
+
+	for _, test := range tests {
+		f, err := Read(bytes.NewReader(encoded(t, test)), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, test, f)
+	}
+}
+
+func Test_ReadErrors(t *testing.T) {
+	valid := encoded(t, &Frame{Type: Request, Channel: 1, Counter: 3, Payload: []byte("0123456789")})
+
+	badMagic := append([]byte{}, valid...)
+	badMagic[0] = 0
+	badVersion := append([]byte{}, valid...)
+	badVersion[2] = Version + 1
+	badType := append([]byte{}, valid...)
+	badType[3] = 0x7f
+
+	var tests = []struct {
+		data    []byte
+		maxSize int
+		want    error
+	}{
+		{[]byte{}, 0, io.EOF},
+		{valid[:5], 0, ErrTruncated},
+		{valid[:HeaderSize], 0, ErrTruncated},
+		{valid[:len(valid)-1], 0, ErrTruncated},
+		{valid, 9, ErrTooLarge},
+		{badMagic, 0, ErrBadMagic},
+		{badVersion, 0, ErrVersion},
+		{badType, 0, ErrUnknownType},
+	}
+
+	for _, test := range tests {
+		f, err := Read(bytes.NewReader(test.data), test.maxSize)
+		assert.Nil(t, f)
+		assert.True(t, errors.Is(err, test.want), "%v != %v", err, test.want)
+	}
+}
+
+func Test_WriteErrors(t *testing.T) {
+	var buffer bytes.Buffer
+
+	assert.Equal(t, ErrUnknownType, Write(&buffer, &Frame{Type: 0}, 0))
+	assert.Equal(t, ErrTooLarge, Write(&buffer, &Frame{Type: Raw, Payload: make([]byte, 11)}, 10))
+	assert.Equal(t, 0, buffer.Len())
+}
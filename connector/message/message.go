@@ -46,6 +46,7 @@ type Message struct {
 	Data    []byte                  `json:"data"`            // data sent in the message
 	Extra   []byte                  `json:"extra,omitempty"` // additional data sent in the message
 	Blob    []byte                  `json:"blob,omitempty"`  // string of bytes with context dependent meaning
+	Keys    []byte                  `json:"keys,omitempty"`  // public key data (key transitions), only in login
 	Counter uint32                  `json:"counter"`         // message counter (security check)
 	Marker  float32                 `json:"marker"`          // marker (security check)
 	Tstamp  time.Time               `json:"tstamp"`          // time stamp (security check)
@@ -0,0 +1,504 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mux
+
+import (
+	"Carmel/connector/frame"
+	"Carmel/connector/tcpiface"
+	"Carmel/shared/tr"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Both directions of the session are carried by one TCP connection.
+// Every frame is tagged with the logical channel it belongs to,
+// the type of its content and the counter of the request
+// (answers are matched with requests using this counter).
+//
+// When resumption is enabled channels outlive the TCP connection:
+// when it breaks (any error other than the partner closing it)
+// the mux waits for a new one (see Attach). Requests still waiting for answers are sent again.
+//
+// Frame counters aren't authenticated, so the mux doesn't decide which
+// requests are repeated: every request is delivered together with the connection
+// it came with. After decryption the requester accepts it (see Channel.Accept)
+// or, if its counter was already accepted, asks the channel
+// whether it's a request sent again over a new connection (see Channel.Repeated).
+
+type ChannelID uint8
+
+const (
+	_          ChannelID = iota
+	Upstream             // requests from the client, answers from the server
+	Downstream           // requests from the server, answers from the client
+)
+
+const (
+	queueSize   = 16
+	answersKept = 64 // number of sent answers remembered for repeated requests
+)
+
+type Mux struct {
+	wmutex    sync.Mutex
+	mutex     sync.Mutex             // protects iface, resumable, lost and restored
+	iface     *tcpiface.TCPInterface // nil - the connection is lost
+	resumable bool
+	lost      chan struct{} // closed when the current connection is lost
+	restored  chan struct{} // closed when there is a connection
+	channels  map[ChannelID]*Channel
+	done      chan struct{}
+	once      sync.Once
+}
+
+func New(iface *tcpiface.TCPInterface) *Mux {
+	if iface == nil {
+		return nil
+	}
+	m := &Mux{
+		channels: make(map[ChannelID]*Channel),
+		restored: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, id := range []ChannelID{Upstream, Downstream} {
+		m.channels[id] = newChannel(m, id)
+	}
+	m.Attach(iface)
+	return m
+}
+
+func (m *Mux) Channel(id ChannelID) *Channel {
+	return m.channels[id]
+}
+
+func (m *Mux) Address() string {
+	if iface := m.current(); iface != nil {
+		return iface.Address()
+	}
+	return ""
+}
+
+// Attach starts using the given connection (replacing the current one
+// if there is any) and sends again all requests without answers.
+func (m *Mux) Attach(iface *tcpiface.TCPInterface) {
+	m.wmutex.Lock()
+	defer m.wmutex.Unlock()
+
+	m.mutex.Lock()
+	if m.iface != nil {
+		m.iface.Close()
+	}
+	m.iface = iface
+	m.lost = make(chan struct{})
+	select {
+	case <-m.restored:
+	default:
+		close(m.restored)
+	}
+	m.mutex.Unlock()
+
+	for _, id := range []ChannelID{Upstream, Downstream} {
+		m.channels[id].resend(iface)
+	}
+	go m.readLoop(iface)
+}
+
+// Without it a broken connection closes the mux.
+func (m *Mux) EnableResumption() {
+	m.mutex.Lock()
+	m.resumable = true
+	m.mutex.Unlock()
+}
+
+// Lost returns a channel closed when the current connection breaks.
+func (m *Mux) Lost() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lost
+}
+
+// Restored returns a channel closed when the mux has a connection.
+func (m *Mux) Restored() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.restored
+}
+
+// Done returns a channel closed when the mux is closed for good.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Mux) Close() {
+	m.once.Do(func() {
+		close(m.done)
+		m.mutex.Lock()
+		if m.iface != nil {
+			m.iface.Close()
+		}
+		m.mutex.Unlock()
+	})
+}
+
+func (m *Mux) current() *tcpiface.TCPInterface {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.iface
+}
+
+func (m *Mux) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// The connection is no longer usable.
+// Errors of connections already replaced by Attach are ignored.
+func (m *Mux) detach(iface *tcpiface.TCPInterface) {
+	m.mutex.Lock()
+	if m.iface != iface {
+		m.mutex.Unlock()
+		return
+	}
+	if !m.resumable {
+		m.mutex.Unlock()
+		m.Close()
+		return
+	}
+	iface.Close()
+	m.iface = nil
+	m.restored = make(chan struct{})
+	close(m.lost)
+	m.mutex.Unlock()
+}
+
+func (m *Mux) write(id ChannelID, kind frame.Type, counter uint32, data []byte) bool {
+	m.wmutex.Lock()
+	defer m.wmutex.Unlock()
+
+	if m.isClosed() {
+		return false
+	}
+	if iface := m.current(); iface != nil {
+		if err := iface.WriteFrame(&frame.Frame{Type: kind, Channel: uint8(id), Counter: counter, Payload: data}); tr.IsOK(err) {
+			return true
+		}
+		m.detach(iface)
+	}
+	return false
+}
+
+// Reads frames from the network and passes them to their channels.
+// The partner closing the connection closes the mux,
+// any other error only detaches the connection.
+// A frame for an unknown channel closes the mux.
+func (m *Mux) readLoop(iface *tcpiface.TCPInterface) {
+	for {
+		f, err := iface.ReadFrame()
+		if err != nil {
+			switch {
+			case m.isClosed():
+			case err == io.EOF:
+				if m.current() == iface {
+					m.Close()
+				}
+			default:
+				if m.current() == iface {
+					tr.IsOK(err)
+				}
+				m.detach(iface)
+			}
+			return
+		}
+		channel, ok := m.channels[ChannelID(f.Channel)]
+		if !ok {
+			log.Printf("unknown channel: %d\n", f.Channel)
+			m.Close()
+			return
+		}
+		if !channel.deliver(iface, f.Type, f.Counter, f.Payload) {
+			m.Close()
+			return
+		}
+	}
+}
+
+/********************************************************************
+*                                                                   *
+*                         C H A N N E L                             *
+*                                                                   *
+********************************************************************/
+
+// Request waiting for its answer.
+type pendingRequest struct {
+	data   []byte
+	answer chan []byte
+}
+
+// Request received from the partner.
+type Request struct {
+	Counter uint32 // counter of the frame (not authenticated)
+	Data    []byte
+	iface   *tcpiface.TCPInterface // connection it came with
+}
+
+type Channel struct {
+	id       ChannelID
+	mux      *Mux
+	raw      chan []byte
+	requests chan *Request
+	mutex    sync.Mutex
+	pending  map[uint32]*pendingRequest        // requests waiting for answers
+	answers  map[uint32][]byte                 // recently sent answers
+	accepted map[uint32]*tcpiface.TCPInterface // connections of recently accepted requests
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newChannel(m *Mux, id ChannelID) *Channel {
+	return &Channel{
+		id:       id,
+		mux:      m,
+		raw:      make(chan []byte, queueSize),
+		requests: make(chan *Request, queueSize),
+		pending:  make(map[uint32]*pendingRequest),
+		answers:  make(map[uint32][]byte),
+		accepted: make(map[uint32]*tcpiface.TCPInterface),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *Channel) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+}
+
+func (c *Channel) SendRaw(data []byte) bool {
+	return c.mux.write(c.id, frame.Raw, 0, data)
+}
+
+// The request is registered as pending before it is sent,
+// so its answer can't arrive before we wait for it.
+// A request which could not be sent because the connection is lost
+// will be sent again after Attach.
+func (c *Channel) SendRequest(counter uint32, data []byte) bool {
+	c.mutex.Lock()
+	c.pending[counter] = &pendingRequest{data: data, answer: make(chan []byte, 1)}
+	c.mutex.Unlock()
+
+	if c.mux.write(c.id, frame.Request, counter, data) || !c.mux.isClosed() {
+		return true
+	}
+	c.forget(counter)
+	return false
+}
+
+// The answer is remembered, the partner will ask for it again
+// if it does not reach him.
+func (c *Channel) SendAnswer(counter uint32, data []byte) bool {
+	c.mutex.Lock()
+	c.answers[counter] = data
+	delete(c.answers, counter-answersKept)
+	c.mutex.Unlock()
+
+	return c.mux.write(c.id, frame.Answer, counter, data) || !c.mux.isClosed()
+}
+
+func (c *Channel) ReadRaw() []byte {
+	return c.read(c.raw)
+}
+
+func (c *Channel) ReadRequest() *Request {
+	select {
+	case request := <-c.requests:
+		return request
+	case <-c.closed:
+	case <-c.mux.done:
+		select {
+		case request := <-c.requests:
+			return request
+		default:
+		}
+	}
+	return nil
+}
+
+// The request (already authenticated) is new, its counter is remembered
+// together with the connection it came with.
+func (c *Channel) Accept(request *Request) {
+	c.mutex.Lock()
+	c.accepted[request.Counter] = request.iface
+	delete(c.accepted, request.Counter-answersKept)
+	c.mutex.Unlock()
+}
+
+// The request (already authenticated) has the counter of an accepted one.
+// If it came with a newer connection than the original, the partner
+// sent it again after reconnection: the answer (if it's already sent)
+// is sent again. Otherwise it's a replayed request (false).
+func (c *Channel) Repeated(request *Request) bool {
+	c.mutex.Lock()
+	iface, ok := c.accepted[request.Counter]
+	answer, answered := c.answers[request.Counter]
+	c.mutex.Unlock()
+
+	if !ok || iface == request.iface {
+		return false
+	}
+	if answered {
+		c.mux.write(c.id, frame.Answer, request.Counter, answer)
+	}
+	return true
+}
+
+// Waits for the answer to the request with the given counter.
+func (c *Channel) ReadAnswer(counter uint32) []byte {
+	return c.readAnswer(counter, nil)
+}
+
+// Like ReadAnswer, but gives up after the given time.
+// The request is then forgotten (it won't be sent again after Attach).
+func (c *Channel) ReadAnswerTimeout(counter uint32, timeout time.Duration) []byte {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return c.readAnswer(counter, timer.C)
+}
+
+func (c *Channel) readAnswer(counter uint32, timeout <-chan time.Time) []byte {
+	c.mutex.Lock()
+	request, ok := c.pending[counter]
+	c.mutex.Unlock()
+
+	if !ok {
+		log.Printf("there is no request with counter: %d\n", counter)
+		return nil
+	}
+	defer c.forget(counter)
+	return c.readWithTimeout(request.answer, timeout)
+}
+
+func (c *Channel) read(queue <-chan []byte) []byte {
+	return c.readWithTimeout(queue, nil)
+}
+
+// A nil timeout channel never fires.
+func (c *Channel) readWithTimeout(queue <-chan []byte, timeout <-chan time.Time) []byte {
+	select {
+	case data := <-queue:
+		return data
+	case <-c.closed:
+	case <-c.mux.done:
+		// Data received before the partner closed the connection
+		// (e.g. the reason of a rejection) is still delivered.
+		select {
+		case data := <-queue:
+			return data
+		default:
+		}
+	case <-timeout:
+	}
+	return nil
+}
+
+func (c *Channel) forget(counter uint32) {
+	c.mutex.Lock()
+	delete(c.pending, counter)
+	c.mutex.Unlock()
+}
+
+// Sends again (in the original order) requests without answers.
+// Called by Attach with the write mutex locked.
+func (c *Channel) resend(iface *tcpiface.TCPInterface) {
+	c.mutex.Lock()
+	counters := make([]uint32, 0, len(c.pending))
+	for counter, request := range c.pending {
+		if len(request.answer) == 0 {
+			counters = append(counters, counter)
+		}
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i] < counters[j] })
+	frames := make([]*frame.Frame, 0, len(counters))
+	for _, counter := range counters {
+		frames = append(frames, &frame.Frame{Type: frame.Request, Channel: uint8(c.id), Counter: counter, Payload: c.pending[counter].data})
+	}
+	c.mutex.Unlock()
+
+	for _, f := range frames {
+		if err := iface.WriteFrame(f); !tr.IsOK(err) {
+			return
+		}
+	}
+}
+
+func (c *Channel) deliver(iface *tcpiface.TCPInterface, kind frame.Type, counter uint32, data []byte) bool {
+	var queue chan []byte
+
+	switch kind {
+	case frame.Raw:
+		queue = c.raw
+	case frame.Request:
+		select {
+		case c.requests <- &Request{Counter: counter, Data: data, iface: iface}:
+		case <-c.closed:
+		case <-c.mux.done:
+			return false
+		}
+		return true
+	case frame.Answer:
+		c.mutex.Lock()
+		request, ok := c.pending[counter]
+		c.mutex.Unlock()
+		if ok {
+			select {
+			case request.answer <- data:
+				return true
+			default:
+			}
+		}
+		log.Printf("unexpected answer (counter: %d)\n", counter)
+		return true
+	default:
+		log.Printf("unknown kind of frame: %d\n", kind)
+		return false
+	}
+
+	select {
+	case queue <- data:
+	case <-c.closed:
+	case <-c.mux.done:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mux
+
+import (
+	"Carmel/connector/tcpiface"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Two ends of a loopback TCP connection.
+func connected(t *testing.T) (*tcpiface.TCPInterface, *tcpiface.TCPInterface) {
+	a, b := dial(t)
+	return tcpiface.New(a), tcpiface.New(b)
+}
+
+func dial(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+
+	accepted := make(chan *net.TCPConn)
+	go func() {
+		conn, _ := listener.AcceptTCP()
+		accepted <- conn
+	}()
+	dialed, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return dialed, <-accepted
+}
+
+func pair(t *testing.T) (*Mux, *Mux) {
+	ia, ib := connected(t)
+	a, b := New(ia), New(ib)
+	a.EnableResumption()
+	b.EnableResumption()
+	return a, b
+}
+
+func within(t *testing.T, read func() []byte) string {
+	result := make(chan []byte, 1)
+	go func() {
+		result <- read()
+	}()
+	select {
+	case data := <-result:
+		return string(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return ""
+}
+
+// Data of the next request.
+func requestData(c *Channel) func() []byte {
+	return func() []byte {
+		if request := c.ReadRequest(); request != nil {
+			return request.Data
+		}
+		return nil
+	}
+}
+
+func readRequest(t *testing.T, c *Channel) *Request {
+	result := make(chan *Request, 1)
+	go func() {
+		result <- c.ReadRequest()
+	}()
+	select {
+	case request := <-result:
+		if !assert.NotNil(t, request) {
+			t.FailNow()
+		}
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func Test_ResendAfterAttach(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+	ca, cb := a.Channel(Upstream), b.Channel(Upstream)
+
+	assert.True(t, ca.SendRequest(1, []byte("one")))
+	first := readRequest(t, cb)
+	assert.Equal(t, "one", string(first.Data))
+	cb.Accept(first)
+
+	// New connection: the request without an answer is sent again.
+	// It's delivered, but the channel recognizes it as repeated.
+	ia, ib := connected(t)
+	a.Attach(ia)
+	b.Attach(ib)
+
+	again := readRequest(t, cb)
+	assert.Equal(t, uint32(1), again.Counter)
+	assert.True(t, cb.Repeated(again))
+
+	assert.True(t, cb.SendAnswer(1, []byte("answer")))
+	assert.Equal(t, "answer", within(t, func() []byte { return ca.ReadAnswer(1) }))
+
+	assert.True(t, ca.SendRequest(2, []byte("two")))
+	assert.Equal(t, "two", within(t, requestData(cb)))
+}
+
+func Test_RepeatedRequestAnsweredFromCache(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+	ca, cb := a.Channel(Downstream), b.Channel(Downstream)
+
+	assert.True(t, ca.SendRequest(1, []byte("one")))
+	first := readRequest(t, cb)
+	cb.Accept(first)
+	assert.True(t, cb.SendAnswer(1, []byte("answer")))
+	assert.Equal(t, "answer", within(t, func() []byte { return ca.ReadAnswer(1) }))
+
+	// The same request on the same connection is a replay.
+	assert.False(t, cb.Repeated(first))
+
+	// After reconnection the answer is sent again without bothering the application.
+	ia, ib := connected(t)
+	a.Attach(ia)
+	b.Attach(ib)
+	assert.True(t, ca.SendRequest(1, []byte("one")))
+	assert.True(t, cb.Repeated(readRequest(t, cb)))
+	assert.Equal(t, "answer", within(t, func() []byte { return ca.ReadAnswer(1) }))
+
+	assert.True(t, ca.SendRequest(2, []byte("two")))
+	assert.Equal(t, "two", within(t, requestData(cb)))
+}
+
+func Test_LostConnection(t *testing.T) {
+	conn, other := dial(t)
+	a := New(tcpiface.New(conn))
+	a.EnableResumption()
+	defer a.Close()
+
+	// Reset (not an orderly close) of the connection.
+	lost := a.Lost()
+	other.SetLinger(0)
+	other.Close()
+	select {
+	case <-lost:
+	case <-a.Done():
+		t.Fatal("closed instead of lost")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func Test_ClosedByPartner(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+
+	b.Close()
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -29,38 +29,43 @@
 package requester
 
 import (
-	"Carmel/connector/datagram"
 	"Carmel/connector/message"
-	"Carmel/connector/tcpiface"
+	"Carmel/connector/mux"
 	"Carmel/secret/enigma"
 	"Carmel/shared"
 	"Carmel/shared/tr"
 	"Carmel/shared/vtc"
 	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 type Requester struct {
-	iface   *tcpiface.TCPInterface
-	secret  *enigma.Enigma
+	channel *mux.Channel
+	secret  *enigma.Keys
+	mutex   sync.Mutex
 	counter uint32
 	marker  float32
+	window  replayWindow
+
+	// Called (if set) when a received request is rejected
+	// as replayed, too old or with a changed frame counter.
+	// Such requests are skipped by Read.
+	OnSecurityBreach func(reason string)
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func New(iface *tcpiface.TCPInterface, e *enigma.Enigma) *Requester {
-	return &Requester{iface: iface, secret: e}
+func New(channel *mux.Channel, keys *enigma.Keys) *Requester {
+	return &Requester{channel: channel, secret: keys}
 }
 
 func (r *Requester) Close() {
-	if r.iface != nil {
-		r.iface.Close()
-		r.iface = nil
-	}
+	r.channel.Close()
 }
 
 func (r *Requester) IsValid(msg *message.Message, tstamp time.Time) bool {
@@ -76,14 +81,14 @@ func (r *Requester) IsValid(msg *message.Message, tstamp time.Time) bool {
 }
 
 func (r *Requester) SendRawMessage(data []byte) bool {
-	if datagram.Send(r.iface, data) {
+	if r.channel.SendRaw(data) {
 		return true
 	}
 	return false
 }
 
 func (r *Requester) ReadRawMessage() []byte {
-	return datagram.Read(r.iface)
+	return r.channel.ReadRaw()
 }
 
 // Client side - sending a request to the server.
@@ -91,10 +96,14 @@ func (r *Requester) ReadRawMessage() []byte {
 // ----------------------------------------------
 // 1. create a message object
 // 2. Replace the message with JSON and compress it (snappy)
-// 3. encryption
-// 4. create a signature
-// 5. sending data to the network: message + signature
+// 3. encryption (the message is authenticated by the cipher suite)
+// 4. sending data to the network
 func (r *Requester) Send(id uint32, data, extra []byte) *message.Message {
+	// Requests should reach the network in the order of their counters
+	// (the other side tolerates only windowSize requests out of order).
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.counter++
 	r.marker = float32(rand.Float64() * 99.9999)
 
@@ -108,11 +117,8 @@ func (r *Requester) Send(id uint32, data, extra []byte) *message.Message {
 
 	if data := msg.ToJsonSnapped(); data != nil { // 2.
 		if cipher := r.secret.Encrypt(data); cipher != nil { // 3.
-			if sign := r.secret.Signature(cipher); sign != nil { // 4.
-				cipher = append(cipher, sign...) // 5.
-				if datagram.Send(r.iface, cipher) {
-					return msg
-				}
+			if r.channel.SendRequest(msg.Counter, cipher) { // 4.
+				return msg
 			}
 		}
 	}
@@ -121,27 +127,51 @@ func (r *Requester) Send(id uint32, data, extra []byte) *message.Message {
 
 // Server side - read request from client.
 // (The request is returned as a result)
-//----------------------------------------
-// 1. reading data from the network: message + signature
-// 2. message and signature separation
-// 3. signature verification
-// 4. data decryption
-// 5. unpacking JSON and converting it to a message object
-// 6. checking the received message in terms of security
+// ----------------------------------------
+//  1. reading data from the network
+//  2. authentication and decryption
+//  3. unpacking JSON and converting it to a message object
+//  4. checking the received message in terms of security
+//  5. rejecting replayed and out of window requests
+//     (a request sent again after reconnection is answered by the channel)
 func (r *Requester) Read() *message.Message {
-	if data := datagram.Read(r.iface); data != nil { // 1.
-		tstamp := shared.Now()
-		if bytesCount := len(data); bytesCount > vtc.SignatureSize {
-			sigIndex := bytesCount - vtc.SignatureSize
-			cipher, sign := data[:sigIndex], data[sigIndex:] // 2.
-			if r.secret.IsValidSignature(sign, cipher) {     // 3.
-				if plain := r.secret.Decrypt(cipher); plain != nil { // 4.
-					if msg := message.NewFromJson(plain); msg != nil { // 5.
-						if r.IsValid(msg, tstamp) { // 6.
-							return msg
-						}
-					}
-				}
+	for {
+		request := r.channel.ReadRequest() // 1.
+		if request == nil {
+			return nil
+		}
+		msg := r.requestFrom(request.Data)
+		if msg == nil {
+			return nil
+		}
+		if msg.Counter != request.Counter {
+			r.securityBreach(fmt.Sprintf("frame counter changed (counter: %d, frame: %d)", msg.Counter, request.Counter))
+			continue
+		}
+		if reason := r.window.check(msg.Counter); reason != "" { // 5.
+			if !r.channel.Repeated(request) {
+				r.securityBreach(reason)
+			}
+			continue
+		}
+		r.channel.Accept(request)
+		return msg
+	}
+}
+
+func (r *Requester) securityBreach(reason string) {
+	tr.IsOK(errors.New(reason))
+	if r.OnSecurityBreach != nil {
+		r.OnSecurityBreach(reason)
+	}
+}
+
+func (r *Requester) requestFrom(data []byte) *message.Message {
+	tstamp := shared.Now()
+	if plain := r.secret.Decrypt(data); plain != nil { // 2.
+		if msg := message.NewFromJson(plain); msg != nil { // 3.
+			if r.IsValid(msg, tstamp) { // 4.
+				return msg
 			}
 		}
 	}
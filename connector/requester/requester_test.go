@@ -0,0 +1,152 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package requester
+
+import (
+	"Carmel/connector/frame"
+	"Carmel/connector/message"
+	"Carmel/connector/mux"
+	"Carmel/connector/tcpiface"
+	"Carmel/secret/enigma"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Requester reading requests sent (as raw frames) by the other end of the pipe,
+// encrypted with the returned client keys.
+func receiver(t *testing.T) (*Requester, *tcpiface.TCPInterface, *enigma.Keys, chan string) {
+	a, b := net.Pipe()
+	m := mux.New(tcpiface.New(a))
+	t.Cleanup(m.Close)
+
+	server, client := enigma.NewWithKeys(nil, nil), enigma.NewWithKeys(nil, nil)
+	serverKey, clientKey := server.EphemeralKey(), client.EphemeralKey()
+	if !assert.True(t, server.AgreeKeys(vtc.Server, enigma.AESGCM, serverKey, clientKey)) ||
+		!assert.True(t, client.AgreeKeys(vtc.Client, enigma.AESGCM, serverKey, clientKey)) {
+		t.FailNow()
+	}
+
+	breaches := make(chan string, 8)
+	r := New(m.Channel(mux.Upstream), server.Keys(enigma.ClientToServer))
+	r.OnSecurityBreach = func(reason string) {
+		breaches <- reason
+	}
+	return r, tcpiface.New(b), client.Keys(enigma.ClientToServer), breaches
+}
+
+// Encrypted request with the given counter.
+func sealed(t *testing.T, keys *enigma.Keys, counter uint32) []byte {
+	msg := message.NewWithType(vtc.Request)
+	msg.Id = vtc.Message
+	msg.Counter = counter
+	msg.Tstamp = shared.Now()
+	msg.Data = []byte("text")
+
+	cipher := keys.Encrypt(msg.ToJsonSnapped())
+	if !assert.NotNil(t, cipher) {
+		t.FailNow()
+	}
+	return cipher
+}
+
+func send(t *testing.T, iface *tcpiface.TCPInterface, counter uint32, payload []byte) {
+	f := &frame.Frame{Type: frame.Request, Channel: uint8(mux.Upstream), Counter: counter, Payload: payload}
+	if !assert.NoError(t, iface.WriteFrame(f)) {
+		t.FailNow()
+	}
+}
+
+func read(t *testing.T, r *Requester) *message.Message {
+	result := make(chan *message.Message, 1)
+	go func() {
+		result <- r.Read()
+	}()
+	select {
+	case msg := <-result:
+		if !assert.NotNil(t, msg) {
+			t.FailNow()
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func breach(t *testing.T, breaches chan string) string {
+	select {
+	case reason := <-breaches:
+		return reason
+	default:
+		t.Fatal("no security breach")
+	}
+	return ""
+}
+
+func Test_ReplayedRequest(t *testing.T) {
+	r, iface, keys, breaches := receiver(t)
+
+	first := sealed(t, keys, 1)
+	send(t, iface, 1, first)
+	assert.Equal(t, uint32(1), read(t, r).Counter)
+
+	// The same frame once again on the same connection.
+	send(t, iface, 1, first)
+	send(t, iface, 2, sealed(t, keys, 2))
+	assert.Equal(t, uint32(2), read(t, r).Counter)
+	assert.Equal(t, "replayed request (counter: 1)", breach(t, breaches))
+}
+
+func Test_ChangedFrameCounter(t *testing.T) {
+	r, iface, keys, breaches := receiver(t)
+
+	// A large frame counter injected on the way must not block later requests.
+	first := sealed(t, keys, 1)
+	send(t, iface, 1000, first)
+	send(t, iface, 1, first)
+	assert.Equal(t, uint32(1), read(t, r).Counter)
+	assert.Equal(t, "frame counter changed (counter: 1, frame: 1000)", breach(t, breaches))
+
+	send(t, iface, 2, sealed(t, keys, 2))
+	assert.Equal(t, uint32(2), read(t, r).Counter)
+}
+
+func Test_RequestsOutOfOrder(t *testing.T) {
+	r, iface, keys, breaches := receiver(t)
+
+	send(t, iface, 2, sealed(t, keys, 2))
+	send(t, iface, 1, sealed(t, keys, 1))
+	assert.Equal(t, uint32(2), read(t, r).Counter)
+	assert.Equal(t, uint32(1), read(t, r).Counter)
+	assert.Empty(t, breaches)
+}
@@ -0,0 +1,71 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package requester
+
+import "fmt"
+
+// Sliding window of accepted request counters (as in IPsec).
+// The counter of every request must be new and not older than
+// windowSize requests than the newest one seen so far.
+// Counters are part of the encrypted message, so unlike
+// the frame counters they can't be changed by anybody on the way.
+
+const windowSize = 64
+
+type replayWindow struct {
+	last   uint32 // the highest accepted counter
+	bitmap uint64 // bit n set - counter (last - n) has been accepted
+}
+
+// Returns a description of the problem or an empty string
+// if the counter is accepted (and remembered).
+func (w *replayWindow) check(counter uint32) string {
+	switch {
+	case counter == 0:
+		return "request without counter"
+	case counter > w.last:
+		if shift := counter - w.last; shift < windowSize {
+			w.bitmap = w.bitmap<<shift | 1
+		} else {
+			w.bitmap = 1
+		}
+		w.last = counter
+		return ""
+	}
+
+	diff := w.last - counter
+	if diff >= windowSize {
+		return fmt.Sprintf("request out of window (counter: %d, last: %d)", counter, w.last)
+	}
+	if bit := uint64(1) << diff; w.bitmap&bit == 0 {
+		w.bitmap |= bit
+		return ""
+	}
+	return fmt.Sprintf("replayed request (counter: %d)", counter)
+}
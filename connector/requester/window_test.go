@@ -26,28 +26,39 @@
  * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
  */
 
-package datagram
+package requester
 
 import (
-	"Carmel/connector/tcpiface"
-	"Carmel/secret"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func Send(iface *tcpiface.TCPInterface, data []byte) bool {
-	n := uint32(len(data))
-	if n != 0 {
-		bytesNumber := secret.Uint32ToBytes(n)
-		return iface.Write(bytesNumber) && iface.Write(data)
+func Test_ReplayWindow(t *testing.T) {
+	tests := []struct {
+		counter  uint32
+		accepted bool
+	}{
+		{0, false},
+		{1, true},
+		{2, true},
+		{2, false}, // repeated
+		{1, false},
+		{5, true},
+		{4, true}, // late, but inside the window
+		{3, true},
+		{4, false},
+		{100, true},
+		{36, false}, // out of window
+		{37, true},
+		{37, false},
+		{99, true},
+		{1000, true},
+		{100, false},
 	}
-	return false
-}
 
-func Read(iface *tcpiface.TCPInterface) []byte {
-	if bytesNumber := iface.Read(4); bytesNumber != nil {
-		n := int(secret.BytesToUint32(bytesNumber))
-		if data := iface.Read(n); data != nil {
-			return data
-		}
+	var w replayWindow
+	for _, test := range tests {
+		assert.Equal(t, test.accepted, w.check(test.counter) == "", "counter: %d", test.counter)
 	}
-	return nil
 }
@@ -29,9 +29,8 @@
 package responder
 
 import (
-	"Carmel/connector/datagram"
 	"Carmel/connector/message"
-	"Carmel/connector/tcpiface"
+	"Carmel/connector/mux"
 	"Carmel/secret/enigma"
 	"Carmel/shared"
 	"Carmel/shared/vtc"
@@ -40,19 +39,16 @@ import (
 )
 
 type Responder struct {
-	iface  *tcpiface.TCPInterface
-	secret *enigma.Enigma
+	channel *mux.Channel
+	secret  *enigma.Keys
 }
 
-func New(iface *tcpiface.TCPInterface, e *enigma.Enigma) *Responder {
-	return &Responder{iface: iface, secret: e}
+func New(channel *mux.Channel, keys *enigma.Keys) *Responder {
+	return &Responder{channel: channel, secret: keys}
 }
 
 func (r *Responder) Close() {
-	if r.iface != nil {
-		r.iface.Close()
-		r.iface = nil
-	}
+	r.channel.Close()
 }
 
 func (r *Responder) IsValid(request, answer *message.Message, tstamp time.Time) bool {
@@ -79,25 +75,26 @@ func (r *Responder) IsValid(request, answer *message.Message, tstamp time.Time)
 // Client side - read answer from the server
 // The response must be the answer to the passed request
 // ---------------------------------------------------
-// 1. reading data from the network: message + signature
-// 2. message and signature separation
-// 3. signature verification
-// 4. decrypting the message
-// 5. unpacking JSON and converting it to a message object
-// 6. checking the received message in terms of security
+// 1. reading data from the network
+// 2. authentication and decryption
+// 3. unpacking JSON and converting it to a message object
+// 4. checking the received message in terms of security
 func (r *Responder) Read(request *message.Message) *message.Message {
-	if data := datagram.Read(r.iface); data != nil { // 1.
+	return r.answerFrom(request, r.channel.ReadAnswer(request.Counter)) // 1.
+}
+
+// Like Read, but waits for the answer at most for the given time.
+func (r *Responder) ReadTimeout(request *message.Message, timeout time.Duration) *message.Message {
+	return r.answerFrom(request, r.channel.ReadAnswerTimeout(request.Counter, timeout))
+}
+
+func (r *Responder) answerFrom(request *message.Message, data []byte) *message.Message {
+	if data != nil {
 		tstamp := shared.Now()
-		if bytesCount := len(data); bytesCount > vtc.SignatureSize {
-			sigIndex := bytesCount - vtc.SignatureSize
-			cipher, sign := data[:sigIndex], data[sigIndex:] // 2.
-			if r.secret.IsValidSignature(sign, cipher) {     // 3.
-				if plain := r.secret.Decrypt(cipher); plain != nil { // 4.
-					if answer := message.NewFromJson(plain); answer != nil { // 5.
-						if r.IsValid(request, answer, tstamp) { // 6.
-							return answer
-						}
-					}
+		if plain := r.secret.Decrypt(data); plain != nil { // 2.
+			if answer := message.NewFromJson(plain); answer != nil { // 3.
+				if r.IsValid(request, answer, tstamp) { // 4.
+					return answer
 				}
 			}
 		}
@@ -110,10 +107,8 @@ func (r *Responder) Read(request *message.Message) *message.Message {
 // ---------------------------------------------------
 // 1. create a message
 // 2. replace the message with JSON and pack (snapp)
-// 3. data encryption
-// 4. create a signature
-// 5. adding a signature to an encrypted message
-// 6. sending data to the network: message + signature
+// 3. data encryption (the message is authenticated by the cipher suite)
+// 4. sending data to the network
 func (r *Responder) Send(status vtc.OperationStatusType, request *message.Message, data, extra []byte) *message.Message {
 	if request == nil {
 		log.Printf("%s\n", "invalid request")
@@ -131,11 +126,8 @@ func (r *Responder) Send(status vtc.OperationStatusType, request *message.Messag
 
 	if data := msg.ToJsonSnapped(); data != nil { // 2.
 		if cipher := r.secret.Encrypt(data); cipher != nil { // 3.
-			if sign := r.secret.Signature(cipher); sign != nil { // 4.
-				cipher = append(cipher, sign...)    // 5.
-				if datagram.Send(r.iface, cipher) { // 6.
-					return msg
-				}
+			if r.channel.SendAnswer(request.Counter, cipher) { // 4.
+				return msg
 			}
 		}
 	}
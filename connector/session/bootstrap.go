@@ -0,0 +1,169 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/connector/stream"
+	"Carmel/rsakeys"
+	"Carmel/secret/enigma"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"encoding/json"
+	"github.com/golang/snappy"
+)
+
+const (
+	bootstrapDisabledReason = "the partner doesn't accept keys sent during the login"
+	bootstrapNameReason     = "the login name differs from the name sent with the key"
+)
+
+// Wymiana kluczy publicznych przy pierwszym kontakcie (patrz enigma/bootstrap.go).
+// Odbywa się przed logowaniem, gdy klient nie ma jeszcze klucza serwera:
+//
+//	klient -> serwer: PublicKey, Extra: klucz klienta (X25519)
+//	serwer -> klient: PublicKey, Data: nazwa serwera, Extra: klucz serwera, Blob: klucz publiczny serwera
+//	klient -> serwer: PublicKey, Data: nazwa klienta, Blob: klucz publiczny klienta
+//
+// Klucze publiczne są szyfrowane i uwierzytelnione kluczem uzgodnionym
+// na podstawie PIN-u (patrz pake.go).
+// Otrzymany klucz obowiązuje tylko w tej sesji,
+// zapisuje go użytkownik po sprawdzeniu odcisku (patrz ReceivedPublicKey).
+
+// Klient bez klucza publicznego rozmówcy.
+func BootstrapClientNew(addr string, port int, buddyName string, timeout int) *Session {
+	if e := enigma.New(""); e != nil {
+		ssn := newSession(vtc.Client, stream.Client(addr, port, timeout), e, buddyName)
+		ssn.Bootstrap = true
+		return ssn
+	}
+	return nil
+}
+
+// Klucz publiczny rozmówcy otrzymany przy logowaniu (nil, jeśli nie było wymiany).
+func (s *Session) ReceivedPublicKey() *rsakeys.PublicKey {
+	return s.receivedKey
+}
+
+func (s *Session) exchangePublicKeysAsClient(buddyName string) vtc.OperationStatusType {
+	e := s.Enigma
+	defer e.ClearBootstrap()
+
+	myKey, clientKey := e.PublicKey(), e.EphemeralKey()
+	if myKey == nil || clientKey == nil {
+		return vtc.Error
+	}
+	if s.Out.Requester.SendRawMessage(publicKeyMessage(vtc.Request, vtc.Ok, nil, clientKey, nil)) {
+		if answer := readPublicKey(s.Out.Requester.ReadRawMessage(), vtc.Answer); answer != nil {
+			if answer.Status == vtc.Rejected {
+				s.reason = string(answer.Data)
+				return vtc.Rejected
+			}
+			serverKey := answer.Extra
+			if string(answer.Data) != buddyName || !e.AgreeBootstrapKeys(vtc.Client, serverKey, clientKey) {
+				return vtc.SecurityBreach
+			}
+			buddyKey := e.OpenBootstrap(vtc.Server, buddyName, answer.Blob)
+			if buddyKey == nil {
+				// Serwer nie zna PIN-u.
+				return vtc.SecurityBreach
+			}
+			if sealed := e.SealBootstrap(vtc.Client, shared.MyUserName, myKey.Pem()); sealed != nil {
+				if s.Out.Requester.SendRawMessage(publicKeyMessage(vtc.Request, vtc.Ok, []byte(shared.MyUserName), nil, sealed)) {
+					e.SetBuddyPublicKey(buddyKey)
+					s.receivedKey = buddyKey
+					return vtc.Accepted
+				}
+			}
+		}
+	}
+	return vtc.Error
+}
+
+// Zwraca nazwę klienta, który przysłał swój klucz.
+func (s *Session) exchangePublicKeysAsServer(request *message.Message) (string, vtc.OperationStatusType) {
+	e := s.Enigma
+	defer e.ClearBootstrap()
+
+	if !s.Bootstrap {
+		s.reason = bootstrapDisabledReason
+		s.In.Requester.SendRawMessage(publicKeyMessage(vtc.Answer, vtc.Rejected, []byte(bootstrapDisabledReason), nil, nil))
+		return "", vtc.Rejected
+	}
+	myKey, serverKey, clientKey := e.PublicKey(), e.EphemeralKey(), request.Extra
+	if myKey == nil || serverKey == nil || !e.AgreeBootstrapKeys(vtc.Server, serverKey, clientKey) {
+		return "", vtc.Error
+	}
+	if sealed := e.SealBootstrap(vtc.Server, shared.MyUserName, myKey.Pem()); sealed != nil {
+		if s.In.Requester.SendRawMessage(publicKeyMessage(vtc.Answer, vtc.Ok, []byte(shared.MyUserName), serverKey, sealed)) {
+			if msg := readPublicKey(s.In.Requester.ReadRawMessage(), vtc.Request); msg != nil {
+				buddyName := string(msg.Data)
+				if buddyKey := e.OpenBootstrap(vtc.Client, buddyName, msg.Blob); buddyKey != nil {
+					e.SetBuddyPublicKey(buddyKey)
+					s.receivedKey = buddyKey
+					return buddyName, vtc.Accepted
+				}
+				// Klient nie zna PIN-u.
+				return "", vtc.SecurityBreach
+			}
+		}
+	}
+	return "", vtc.Error
+}
+
+func publicKeyMessage(kind vtc.MessageType, status vtc.OperationStatusType, data, key, blob []byte) []byte {
+	msg := message.NewWithType(kind)
+	msg.Id = vtc.PublicKey
+	msg.Status = status
+	msg.Data = data
+	msg.Extra = key
+	msg.Blob = blob
+	msg.Tstamp = shared.Now()
+	return msg.ToJsonSnapped()
+}
+
+func readPublicKey(data []byte, kind vtc.MessageType) *message.Message {
+	if isPlainMessage(data) {
+		if msg := message.NewFromJson(data); msg != nil && msg.Type == kind && msg.Id == vtc.PublicKey {
+			return msg
+		}
+	}
+	return nil
+}
+
+// Zaszyfrowanych danych logowania nie da się rozpakować,
+// sprawdzamy to bez komunikatów o błędach.
+func isPlainMessage(data []byte) bool {
+	if data != nil {
+		if plain, err := snappy.Decode(nil, data); err == nil {
+			return json.Valid(plain)
+		}
+	}
+	return false
+}
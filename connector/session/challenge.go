@@ -0,0 +1,89 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import (
+	"Carmel/shared/vtc"
+)
+
+// Wzajemne uwierzytelnienie po uzgodnieniu kluczy (patrz enigma/challenge.go):
+//
+//	serwer -> klient: Challenge, Data: wyzwanie serwera
+//	klient -> serwer: Ok, Data: wyzwanie klienta, Extra: podpis klienta
+//	serwer -> klient: Challenge, Data: podpis serwera
+//	klient -> serwer: Ok (lub SecurityBreach)
+//
+// Każda strona podpisuje kluczem tożsamości oba wyzwania razem ze skrótem
+// przebiegu logowania i uzgodnienia kluczy, więc podpis dowodzi posiadania
+// klucza prywatnego i nie da się go użyć w innym połączeniu.
+// Wiadomości są już szyfrowane uzgodnionymi kluczami.
+
+func (s *Session) AuthenticateAsServer() bool {
+	e := s.Enigma
+	serverChallenge := e.Challenge()
+	if serverChallenge == nil {
+		return false
+	}
+	if request := s.Out.Requester.Send(vtc.Challenge, serverChallenge, nil); request != nil {
+		if answer := s.Out.Responder.Read(request); answer != nil && answer.Status == vtc.Ok {
+			clientChallenge := answer.Data
+			if e.IsValidChallengeSignature(vtc.Client, answer.Extra, serverChallenge, clientChallenge) {
+				if sign := e.ChallengeSignature(vtc.Server, serverChallenge, clientChallenge); sign != nil {
+					if request := s.Out.Requester.Send(vtc.Challenge, sign, nil); request != nil {
+						if answer := s.Out.Responder.Read(request); answer != nil {
+							return answer.Status == vtc.Ok
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *Session) AuthenticateAsClient() bool {
+	e := s.Enigma
+	if request := s.In.Requester.Read(); request != nil && request.Id == vtc.Challenge {
+		serverChallenge := request.Data
+		clientChallenge := e.Challenge()
+		if clientChallenge == nil {
+			return false
+		}
+		if sign := e.ChallengeSignature(vtc.Client, serverChallenge, clientChallenge); sign != nil {
+			if answer := s.In.Responder.Send(vtc.Ok, request, clientChallenge, sign); answer != nil {
+				if request := s.In.Requester.Read(); request != nil && request.Id == vtc.Challenge {
+					if e.IsValidChallengeSignature(vtc.Server, request.Data, serverChallenge, clientChallenge) {
+						return s.In.Responder.Send(vtc.Ok, request, nil, nil) != nil
+					}
+					s.In.Responder.Send(vtc.SecurityBreach, request, nil, nil)
+				}
+			}
+		}
+	}
+	return false
+}
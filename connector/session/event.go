@@ -0,0 +1,64 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import "time"
+
+// Zdarzenia sesji, o których powinien wiedzieć użytkownik.
+type EventType uint8
+
+const (
+	_              EventType = iota
+	LinkLost                 // połączenie TCP zostało zerwane, trwa próba wznowienia
+	LinkRestored             // sesja została wznowiona
+	Heartbeat                // rozmówca odpowiedział na ping (czas w RTT)
+	SessionClosed            // sesja została zamknięta (powód w Reason)
+	SecurityBreach           // odrzucono powtórzone lub zbyt stare żądanie (powód w Reason)
+)
+
+const eventsQueueSize = 16
+
+type Event struct {
+	Type   EventType
+	RTT    time.Duration
+	Reason string
+}
+
+// Kanał, z którego można odczytywać zdarzenia sesji.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// Zdarzenie jest pomijane jeśli nikt nie odczytuje kanału.
+func (s *Session) emit(event Event) {
+	select {
+	case s.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/mux"
+	"Carmel/shared/vtc"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Co HeartbeatInterval każda ze stron wysyła do rozmówcy ping
+// i mierzy czas odpowiedzi (RTT). Dzięki temu milczący rozmówca
+// lub połączenie TCP zerwane tylko z jednej strony wykrywane są
+// po kilku sekundach, a nie po czasie keep-alive systemu.
+// Po MaxMissedHeartbeats kolejnych pingach bez odpowiedzi sesja jest zamykana.
+// W czasie wznawiania połączenia pingi nie są wysyłane.
+
+const (
+	DefaultHeartbeatInterval   = 5 * time.Second
+	DefaultMaxMissedHeartbeats = 3
+)
+
+// Ostatni zmierzony czas odpowiedzi rozmówcy (0 - jeszcze nie zmierzony).
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+func (s *Session) heartbeat() {
+	if s.HeartbeatInterval <= 0 || s.MaxMissedHeartbeats <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	m := s.Link.Mux
+	missed := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-m.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !isConnected(m) {
+			missed = 0
+			continue
+		}
+		if rtt, ok := s.ping(); ok {
+			missed = 0
+			atomic.StoreInt64(&s.rtt, int64(rtt))
+			s.emit(Event{Type: Heartbeat, RTT: rtt})
+			continue
+		}
+		if missed++; missed >= s.MaxMissedHeartbeats && isConnected(m) {
+			s.closeWithReason(fmt.Sprintf("%s did not answer %d heartbeats", s.buddyName, missed))
+			return
+		}
+	}
+}
+
+func (s *Session) ping() (time.Duration, bool) {
+	out := s.Out
+	start := time.Now()
+	if request := out.Requester.Send(vtc.Ping, nil, nil); request != nil {
+		if answer := out.Responder.ReadTimeout(request, s.HeartbeatInterval); answer != nil {
+			return time.Since(start), true
+		}
+	}
+	return 0, false
+}
+
+// Zamyka połączenie, użytkownik sesji dowie się o tym ze zdarzenia
+// SessionClosed i z tego, że odczyty zaczną zwracać nil.
+func (s *Session) closeWithReason(reason string) {
+	s.reason = reason
+	s.emit(Event{Type: SessionClosed, Reason: reason})
+	s.Link.Mux.Close()
+}
+
+func isConnected(m *mux.Mux) bool {
+	select {
+	case <-m.Restored():
+		return true
+	default:
+		return false
+	}
+}
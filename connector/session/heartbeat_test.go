@@ -0,0 +1,128 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testHeartbeatInterval = 20 * time.Millisecond
+
+// Uruchamia f do końca testu (kończy się przed zamknięciem sesji).
+func background(t *testing.T, s *Session, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	t.Cleanup(func() {
+		s.Link.Close()
+		<-done
+	})
+}
+
+func waitForEvent(t *testing.T, s *Session, eventType EventType) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-s.Events():
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no event: %d", eventType)
+			return Event{}
+		}
+	}
+}
+
+// Rozmówca odpowiada na pingi, mierzony jest czas odpowiedzi.
+func Test_HeartbeatRTT(t *testing.T) {
+	server, client := sessionPair(t)
+	background(t, client, func() { client.ReadRequest() })
+	server.HeartbeatInterval = testHeartbeatInterval
+	background(t, server, server.heartbeat)
+
+	event := waitForEvent(t, server, Heartbeat)
+	assert.True(t, event.RTT > 0)
+	assert.True(t, server.RTT() > 0)
+}
+
+// Rozmówca przestał odpowiadać: po MaxMissedHeartbeats pingach sesja jest zamykana.
+func Test_MissedHeartbeats(t *testing.T) {
+	server, _ := sessionPair(t)
+	server.HeartbeatInterval = testHeartbeatInterval
+	server.MaxMissedHeartbeats = 2
+	background(t, server, server.heartbeat)
+
+	event := waitForEvent(t, server, SessionClosed)
+	assert.Equal(t, "ala did not answer 2 heartbeats", event.Reason)
+	assert.Equal(t, event.Reason, server.Reason())
+	select {
+	case <-server.Link.Mux.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is still open")
+	}
+	assert.Nil(t, server.ReadRequest())
+}
+
+// Sesja zamykana w trakcie pingów i odczytu: pętle kończą pracę same.
+func Test_CloseWhileRunning(t *testing.T) {
+	server, client := sessionPair(t)
+	server.HeartbeatInterval = testHeartbeatInterval
+	client.HeartbeatInterval = testHeartbeatInterval
+
+	var running sync.WaitGroup
+	for _, f := range []func(){server.heartbeat, client.heartbeat, func() { server.ReadRequest() }, func() { client.ReadRequest() }} {
+		running.Add(1)
+		go func(f func()) {
+			defer running.Done()
+			f()
+		}(f)
+	}
+	waitForEvent(t, server, Heartbeat)
+	server.Close()
+	client.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loops are still running")
+	}
+	_, ok := server.ping()
+	assert.False(t, ok)
+}
@@ -0,0 +1,144 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/secret/enigma"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Hello przesyłany jest w polu 'Blob' komunikatu logowania
+// (od klienta) i odpowiedzi na niego (od serwera).
+// Zapis binarny:
+//
+// min. version (1) | max. version (1) | capabilities (4, LE) | app version
+type Hello struct {
+	MinVersion   uint8
+	MaxVersion   uint8
+	Capabilities vtc.Capabilities
+	AppVersion   string
+}
+
+// Wynik negocjacji - to czego obie strony będą używać.
+type Agreement struct {
+	Version         uint8
+	Capabilities    vtc.Capabilities
+	BuddyAppVersion string
+}
+
+const helloHeaderSize = 6
+
+// Oprócz funkcjonalności ogłaszane są akceptowane zestawy szyfrów
+// i dopełnienia RSA.
+func (s *Session) localHello() Hello {
+	capabilities := vtc.SupportedCapabilities | vtc.OAEPPSSPadding | enigma.SuiteCapabilities(s.CipherSuites)
+	if s.LegacyRSA {
+		capabilities |= vtc.PKCS1v15Padding
+	}
+	return Hello{
+		MinVersion:   vtc.MinProtocolVersion,
+		MaxVersion:   vtc.ProtocolVersion,
+		Capabilities: capabilities,
+		AppVersion:   shared.AppVersion,
+	}
+}
+
+// Dopełnienie RSA obsługiwane przez obie strony (0 - brak wspólnego).
+func padding(common vtc.Capabilities) enigma.Padding {
+	switch {
+	case common.Has(vtc.OAEPPSSPadding):
+		return enigma.OAEPPSS
+	case common.Has(vtc.PKCS1v15Padding):
+		return enigma.PKCS1v15
+	}
+	return 0
+}
+
+func (h Hello) Bytes() []byte {
+	buffer := make([]byte, helloHeaderSize, helloHeaderSize+len(h.AppVersion))
+	buffer[0], buffer[1] = h.MinVersion, h.MaxVersion
+	binary.LittleEndian.PutUint32(buffer[2:helloHeaderSize], uint32(h.Capabilities))
+	return append(buffer, h.AppVersion...)
+}
+
+// Brak danych oznacza rozmówcę, który nie zna negocjacji (wersja 1).
+func helloFromBytes(data []byte) (Hello, bool) {
+	if len(data) == 0 {
+		return Hello{MinVersion: 1, MaxVersion: 1}, true
+	}
+	if len(data) < helloHeaderSize || data[0] == 0 || data[0] > data[1] {
+		return Hello{}, false
+	}
+	return Hello{
+		MinVersion:   data[0],
+		MaxVersion:   data[1],
+		Capabilities: vtc.Capabilities(binary.LittleEndian.Uint32(data[2:helloHeaderSize])),
+		AppVersion:   string(data[helloHeaderSize:]),
+	}, true
+}
+
+// Wybór najwyższej wersji protokołu obsługiwanej przez obie strony
+// i wspólnych funkcjonalności.
+// Jeśli zakresy wersji są rozłączne zwracany jest czytelny powód odmowy.
+func negotiate(local, buddy Hello) (Agreement, string) {
+	version := local.MaxVersion
+	if buddy.MaxVersion < version {
+		version = buddy.MaxVersion
+	}
+	if version < local.MinVersion || version < buddy.MinVersion {
+		reason := fmt.Sprintf("incompatible protocol versions: %s supports %d-%d, %s supports %d-%d",
+			shared.AppNameAndVersion(), local.MinVersion, local.MaxVersion,
+			appName(buddy), buddy.MinVersion, buddy.MaxVersion)
+		return Agreement{}, reason
+	}
+	return Agreement{
+		Version:         version,
+		Capabilities:    local.Capabilities & buddy.Capabilities,
+		BuddyAppVersion: buddy.AppVersion,
+	}, ""
+}
+
+func suiteNames(suites []enigma.SuiteId) string {
+	names := make([]string, 0, len(suites))
+	for _, id := range suites {
+		names = append(names, id.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func appName(h Hello) string {
+	if h.AppVersion == "" {
+		return "the partner"
+	}
+	return fmt.Sprintf("%s %s", shared.AppName, h.AppVersion)
+}
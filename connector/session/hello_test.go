@@ -0,0 +1,127 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/secret/enigma"
+	"Carmel/shared/vtc"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HelloRoundtrip(t *testing.T) {
+	h := Hello{MinVersion: 2, MaxVersion: 3, Capabilities: 0x0105, AppVersion: "0.2.0"}
+	decoded, ok := helloFromBytes(h.Bytes())
+	assert.True(t, ok)
+	assert.Equal(t, h, decoded)
+}
+
+func Test_HelloFromBytes(t *testing.T) {
+	h, ok := helloFromBytes(nil)
+	assert.True(t, ok)
+	assert.Equal(t, Hello{MinVersion: 1, MaxVersion: 1}, h)
+
+	_, ok = helloFromBytes([]byte{2, 2, 0})
+	assert.False(t, ok)
+	_, ok = helloFromBytes([]byte{3, 2, 0, 0, 0, 0})
+	assert.False(t, ok)
+	_, ok = helloFromBytes([]byte{0, 2, 0, 0, 0, 0})
+	assert.False(t, ok)
+}
+
+func Test_Negotiate(t *testing.T) {
+	tests := []struct {
+		local, buddy Hello
+		version      uint8
+		caps         vtc.Capabilities
+		ok           bool
+	}{
+		{Hello{MinVersion: 2, MaxVersion: 2}, Hello{MinVersion: 2, MaxVersion: 2}, 2, 0, true},
+		{Hello{MinVersion: 2, MaxVersion: 4, Capabilities: 3}, Hello{MinVersion: 1, MaxVersion: 3, Capabilities: 6}, 3, 2, true},
+		{Hello{MinVersion: 2, MaxVersion: 3}, Hello{MinVersion: 3, MaxVersion: 5}, 3, 0, true},
+		{Hello{MinVersion: 2, MaxVersion: 2}, Hello{MinVersion: 1, MaxVersion: 1}, 0, 0, false},
+		{Hello{MinVersion: 2, MaxVersion: 2}, Hello{MinVersion: 3, MaxVersion: 4}, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		agreement, reason := negotiate(test.local, test.buddy)
+		if !test.ok {
+			assert.NotEmpty(t, reason)
+			continue
+		}
+		assert.Empty(t, reason)
+		assert.Equal(t, test.version, agreement.Version)
+		assert.Equal(t, test.caps, agreement.Capabilities)
+
+		// Wynik nie zależy od tego, kto negocjuje.
+		reverse, _ := negotiate(test.buddy, test.local)
+		assert.Equal(t, agreement.Version, reverse.Version)
+		assert.Equal(t, agreement.Capabilities, reverse.Capabilities)
+	}
+}
+
+// Zakres wersji programu i rozmówcy o innym zakresie.
+func Test_NegotiateVersionRanges(t *testing.T) {
+	local := (&Session{}).localHello()
+	assert.Equal(t, vtc.PakeProtocolVersion, local.MinVersion)
+
+	// Nowszy rozmówca, który nadal obsługuje naszą wersję.
+	newer := Hello{MinVersion: vtc.PakeProtocolVersion, MaxVersion: vtc.ProtocolVersion + 2}
+	agreement, reason := negotiate(local, newer)
+	assert.Empty(t, reason)
+	assert.Equal(t, vtc.ProtocolVersion, agreement.Version)
+
+	// Z zakresu obu stron wybierana jest najwyższa wspólna wersja.
+	agreement, reason = negotiate(Hello{MinVersion: 2, MaxVersion: 6}, Hello{MinVersion: 3, MaxVersion: 4})
+	assert.Empty(t, reason)
+	assert.Equal(t, uint8(4), agreement.Version)
+
+	// Rozłączne zakresy, w tym klient bez uzgodnienia klucza na podstawie PIN-u.
+	for _, buddy := range []Hello{
+		{MinVersion: 1, MaxVersion: vtc.PakeProtocolVersion - 1},
+		{MinVersion: vtc.ProtocolVersion + 1, MaxVersion: vtc.ProtocolVersion + 2},
+	} {
+		_, reason = negotiate(local, buddy)
+		assert.Contains(t, reason, "incompatible protocol versions")
+	}
+}
+
+func Test_Padding(t *testing.T) {
+	modern := &Session{}
+	legacy := &Session{LegacyRSA: true}
+
+	common := func(a, b *Session) vtc.Capabilities {
+		return a.localHello().Capabilities & b.localHello().Capabilities
+	}
+	assert.Equal(t, enigma.OAEPPSS, padding(common(modern, legacy)))
+	assert.Equal(t, enigma.OAEPPSS, padding(common(legacy, legacy)))
+	assert.Equal(t, enigma.PKCS1v15, padding(vtc.PKCS1v15Padding))
+	assert.Equal(t, enigma.Padding(0), padding(vtc.AESGCMSuite))
+}
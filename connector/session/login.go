@@ -0,0 +1,284 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/rsakeys"
+	"Carmel/secret/enigma"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"fmt"
+	"strings"
+)
+
+const declinedReason = "the partner declined the connection"
+
+// Klient wysyła dane do logowania.
+// Server to zaakceptuje lub nie :)
+// Brak akceptacji najprawdopodobniej oznacza, że po stronie
+// serwera brakuje twojego publicznego klucza RSA.
+// Razem z danymi logowania wysyłany jest Hello (wersje protokołu,
+// wersja programu, funkcjonalności), serwer w odpowiedzi wysyła swój.
+// Wcześniej obie strony uzgadniają klucz na podstawie PIN-u (patrz pake.go),
+// w trybie Bootstrap wymieniają też klucze publiczne.
+// Zwraca Accepted, Rejected (powód w Reason()), SecurityBreach
+// (serwer nie zna PIN-u) lub Error.
+func (s *Session) SendLogin(buddyName, pin string) vtc.OperationStatusType {
+	s.initPadding()
+	defer s.Enigma.ClearPake()
+	if state := s.agreePinKeyAsClient(buddyName, pin); state != vtc.Accepted {
+		return state
+	}
+	if s.Bootstrap {
+		if state := s.exchangePublicKeysAsClient(buddyName); state != vtc.Accepted {
+			return state
+		}
+	}
+
+	// Wysłanie danych logowania
+	msg := message.NewWithType(vtc.Request)
+	msg.Id = vtc.Login
+	msg.Data = []byte(fmt.Sprintf("%s|%s", shared.MyUserName, buddyName)) // my_name | yours_name
+	msg.Extra = s.Enigma.PakeConfirmation()
+	msg.Blob = s.localHello().Bytes()
+	msg.Keys = myKeys()
+	msg.Tstamp = shared.Now()
+
+	if data := msg.ToJsonSnapped(); data != nil {
+		answer := s.sendLoginData(data)
+		// Serwer mógł wymienić klucze (patrz transition.go).
+		if transitions := readKeyTransitions(answer, buddyName); transitions != nil {
+			if !s.followKeyTransitions(buddyName, transitions) {
+				return vtc.Error
+			}
+			answer = s.sendLoginData(data)
+		}
+		if answer != nil {
+			if plain := s.Enigma.DecryptRsa(answer); plain != nil {
+				if msg := message.NewFromJson(plain); msg != nil && msg.Id == vtc.Login {
+					switch msg.Status {
+					case vtc.Accepted:
+						s.Enigma.UpdateTranscript(data)
+						s.Enigma.UpdateTranscript(plain)
+						return s.acceptHello(msg.Blob)
+					case vtc.Rejected:
+						s.reason = string(msg.Data)
+						return vtc.Rejected
+					}
+				}
+			}
+		}
+	}
+	return vtc.Error
+}
+
+// Wysyła zaszyfrowane dane logowania i zwraca odpowiedź serwera.
+func (s *Session) sendLoginData(data []byte) []byte {
+	if cipher := s.Enigma.EncryptRSA(data); cipher != nil {
+		if s.Out.Requester.SendRawMessage(cipher) {
+			return s.Out.Requester.ReadRawMessage()
+		}
+	}
+	return nil
+}
+
+// Odczyt od klienta żądania inicjacyjnego.
+// Operacja przesyłu danych szyfrowana jest w całości kluczem RSA.
+// Wcześniej obie strony uzgadniają klucz na podstawie PIN-u (patrz pake.go),
+// klient może też wysłać swój klucz publiczny (patrz bootstrap.go).
+// Klient, który zna tylko nasz poprzedni klucz, otrzymuje oświadczenie
+// o nowym kluczu i ponawia logowanie (patrz transition.go).
+// Zwraca nazwę klienta i status:
+// Accepted - dane są poprawne i wersje protokołu są zgodne,
+// Rejected - nie da się uzgodnić wersji protokołu lub nie akceptujemy
+// wymiany kluczy (powód w Reason()),
+// SecurityBreach - dane są niepoprawne (zła nazwa, zły PIN, brak uzgodnienia klucza).
+func (s *Session) ReadLogin(pin string) (string, vtc.OperationStatusType) {
+	s.initPadding()
+	defer s.Enigma.ClearPake()
+
+	data := s.In.Requester.ReadRawMessage()
+	request := readPake(data, vtc.Request)
+	if request == nil {
+		return "", vtc.SecurityBreach
+	}
+	pakeName, state := s.agreePinKeyAsServer(data, request, pin)
+	if state != vtc.Accepted {
+		return pakeName, state
+	}
+	data = s.In.Requester.ReadRawMessage()
+	if isPakeFailure(data) {
+		return pakeName, vtc.SecurityBreach
+	}
+	bootstrapName := ""
+	if request := readPublicKey(data, vtc.Request); request != nil {
+		name, state := s.exchangePublicKeysAsServer(request)
+		if state != vtc.Accepted {
+			return name, state
+		}
+		bootstrapName = name
+		data = s.In.Requester.ReadRawMessage()
+	}
+	plain := s.Enigma.DecryptRsa(data)
+	if plain == nil && data != nil && s.sendKeyTransitions() {
+		// Klient mógł użyć naszego poprzedniego klucza.
+		plain = s.Enigma.DecryptRsa(s.In.Requester.ReadRawMessage())
+	}
+	if plain != nil {
+		if msg := message.NewFromJson(plain); msg != nil {
+			if msg.Id == vtc.Login {
+				if items := strings.Split(string(msg.Data), "|"); len(items) == 2 {
+					if items[0] == pakeName && items[1] == shared.MyUserName && s.Enigma.IsValidPakeConfirmation(msg.Extra) {
+						s.Enigma.UpdateTranscript(plain)
+						buddyName := items[0]
+						s.buddyName = buddyName
+						s.transitions = rsakeys.ParseKeyTransitions(msg.Keys)
+						s.revocations = rsakeys.ParseRevocations(msg.Keys)
+						if s.receivedKey != nil && buddyName != bootstrapName {
+							s.SendRejection(bootstrapNameReason)
+							return buddyName, vtc.SecurityBreach
+						}
+						if state := s.acceptHello(msg.Blob); state != vtc.Accepted {
+							// Odmowę da się wysłać tylko jeśli mamy klucz rozmówcy.
+							if s.receivedKey != nil || s.Enigma.SetBuddyRSAPublicKey(buddyName) {
+								s.followKeyTransitions(buddyName, s.transitions)
+								s.SendRejection(s.reason)
+							}
+							return buddyName, state
+						}
+						return buddyName, vtc.Accepted
+					}
+				}
+			}
+		}
+	}
+	return "", vtc.SecurityBreach
+}
+
+// Negocjacja na podstawie Hello otrzymanego od rozmówcy.
+func (s *Session) acceptHello(data []byte) vtc.OperationStatusType {
+	if buddy, ok := helloFromBytes(data); ok {
+		agreement, reason := negotiate(s.localHello(), buddy)
+		if reason == "" && enigma.ChooseSuite(s.CipherSuites, agreement.Capabilities) == 0 {
+			reason = fmt.Sprintf("no common cipher suite: %s accepts %s", shared.AppNameAndVersion(), suiteNames(s.CipherSuites))
+		}
+		if reason == "" && padding(agreement.Capabilities) == 0 {
+			reason = "no common RSA padding: PKCS#1 v1.5 is accepted only in the compatibility mode"
+		}
+		if reason == "" {
+			s.Enigma.Padding = padding(agreement.Capabilities)
+			s.agreement = agreement
+			return vtc.Accepted
+		}
+		s.reason = reason
+		return vtc.Rejected
+	}
+	s.reason = "invalid login data"
+	return vtc.Rejected
+}
+
+// Przed negocjacją klient w trybie zgodności szyfruje dane logowania
+// z dopełnieniem PKCS#1 v1.5 (tylko takie znają starsze programy).
+func (s *Session) initPadding() {
+	s.Enigma.LegacyRSA = s.LegacyRSA
+	if s.LegacyRSA && s.role == vtc.Client {
+		s.Enigma.Padding = enigma.PKCS1v15
+	}
+}
+
+// Serwer potwierdza klientowi, że akceptuje połączenie.
+func (s *Session) SendAcceptance() bool {
+	msg := message.NewWithType(vtc.Answer)
+	msg.Id = vtc.Login
+	msg.Status = vtc.Accepted
+	msg.Blob = s.localHello().Bytes()
+	msg.Tstamp = shared.Now()
+	return s.sendLoginAnswer(msg)
+}
+
+// Serwer informuje klienta, że odrzuca połączenie i dlaczego.
+func (s *Session) SendRejection(reason string) bool {
+	s.reason = reason
+	msg := message.NewWithType(vtc.Answer)
+	msg.Id = vtc.Login
+	msg.Status = vtc.Rejected
+	msg.Data = []byte(reason)
+	msg.Tstamp = shared.Now()
+	return s.sendLoginAnswer(msg)
+}
+
+// Użytkownik serwera nie chce rozmawiać z klientem.
+func (s *Session) Decline() bool {
+	return s.SendRejection(declinedReason)
+}
+
+// Odpowiedź trafia do skrótu przebiegu (patrz challenge.go).
+func (s *Session) sendLoginAnswer(msg *message.Message) bool {
+	if data := msg.ToJsonSnapped(); data != nil {
+		s.Enigma.UpdateTranscript(data)
+		if cipher := s.Enigma.EncryptRSA(data); cipher != nil {
+			return s.In.Requester.SendRawMessage(cipher)
+		}
+	}
+	return false
+}
+
+// Ostatni etap nawiązywania połączenia (po akceptacji rozmówcy).
+// Obie strony uzgadniają klucze symetryczne,
+// następnie uwierzytelniają się nawzajem (patrz challenge.go).
+// Od tej chwili zerwane połączenie TCP jest automatycznie wznawiane,
+// obie strony wymieniają pingi, a serwer co jakiś czas wymienia klucze.
+func (s *Session) Establish() bool {
+	var ok bool
+	switch s.role {
+	case vtc.Server:
+		ok = s.SendAcceptance() && s.AgreeKeysAsServer() && s.AuthenticateAsServer()
+	case vtc.Client:
+		ok = s.AgreeKeysAsClient() && s.AuthenticateAsClient()
+	}
+	if ok {
+		s.superviseLink()
+		go s.heartbeat()
+		go s.rekeyLoop()
+	}
+	return ok
+}
+
+// Wysyła informację o zakończeniu sesji.
+func (s *Session) Logout() bool {
+	if request := s.Out.Requester.Send(vtc.Logout, nil, nil); request != nil {
+		if answer := s.Out.Responder.Read(request); answer != nil {
+			if answer.Status == vtc.Ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"fmt"
+	"strings"
+)
+
+// Uzgodnienie klucza na podstawie PIN-u z zaproszenia (patrz enigma/pake.go).
+// Odbywa się na początku logowania, przed ewentualną wymianą kluczy publicznych:
+//
+//	klient -> serwer: Pake, Data: nazwa klienta | nazwa serwera, Extra: udział klienta
+//	serwer -> klient: Pake, Data: nazwa serwera, Extra: udział serwera, Blob: potwierdzenie serwera
+//
+// Potwierdzenie klienta wysyłane jest w danych logowania (zamiast PIN-u).
+// PIN nigdy nie jest przesyłany, zły PIN daje inne klucze i niezgodne potwierdzenia.
+// Klient, który nie przyjął potwierdzenia serwera, informuje o tym serwer
+// (Status: SecurityBreach) i kończy logowanie.
+
+func (s *Session) agreePinKeyAsClient(buddyName, pin string) vtc.OperationStatusType {
+	e := s.Enigma
+	share := e.PakeShare(vtc.Client, pin, shared.MyUserName, buddyName)
+	if share == nil {
+		return vtc.Error
+	}
+	request := pakeMessage(vtc.Request, vtc.Ok, []byte(fmt.Sprintf("%s|%s", shared.MyUserName, buddyName)), share, nil)
+	if request != nil && s.Out.Requester.SendRawMessage(request) {
+		data := s.Out.Requester.ReadRawMessage()
+		if answer := readPake(data, vtc.Answer); answer != nil {
+			if string(answer.Data) != buddyName || !e.AgreePakeKey(answer.Extra) || !e.IsValidPakeConfirmation(answer.Blob) {
+				// Serwer nie zna PIN-u (lub to nie ten serwer).
+				s.Out.Requester.SendRawMessage(pakeMessage(vtc.Request, vtc.SecurityBreach, nil, nil, nil))
+				return vtc.SecurityBreach
+			}
+			e.UpdateTranscript(request)
+			e.UpdateTranscript(data)
+			return vtc.Accepted
+		}
+	}
+	return vtc.Error
+}
+
+// Zwraca nazwę klienta (data to otrzymane żądanie).
+func (s *Session) agreePinKeyAsServer(data []byte, request *message.Message, pin string) (string, vtc.OperationStatusType) {
+	e := s.Enigma
+	items := strings.Split(string(request.Data), "|")
+	if len(items) != 2 || items[1] != shared.MyUserName {
+		return "", vtc.SecurityBreach
+	}
+	clientName := items[0]
+	share := e.PakeShare(vtc.Server, pin, clientName, shared.MyUserName)
+	if share == nil {
+		return clientName, vtc.Error
+	}
+	if !e.AgreePakeKey(request.Extra) {
+		return clientName, vtc.SecurityBreach
+	}
+	if answer := pakeMessage(vtc.Answer, vtc.Ok, []byte(shared.MyUserName), share, e.PakeConfirmation()); answer != nil {
+		if s.In.Requester.SendRawMessage(answer) {
+			e.UpdateTranscript(data)
+			e.UpdateTranscript(answer)
+			return clientName, vtc.Accepted
+		}
+	}
+	return clientName, vtc.Error
+}
+
+// Klient nie przyjął potwierdzenia serwera (zły PIN).
+func isPakeFailure(data []byte) bool {
+	msg := readPake(data, vtc.Request)
+	return msg != nil && msg.Status == vtc.SecurityBreach
+}
+
+func pakeMessage(kind vtc.MessageType, status vtc.OperationStatusType, data, share, confirmation []byte) []byte {
+	msg := message.NewWithType(kind)
+	msg.Id = vtc.Pake
+	msg.Status = status
+	msg.Data = data
+	msg.Extra = share
+	msg.Blob = confirmation
+	msg.Tstamp = shared.Now()
+	return msg.ToJsonSnapped()
+}
+
+func readPake(data []byte, kind vtc.MessageType) *message.Message {
+	if isPlainMessage(data) {
+		if msg := message.NewFromJson(data); msg != nil && msg.Type == kind && msg.Id == vtc.Pake {
+			return msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import "Carmel/rsakeys"
+
+// Decyzja o kluczu rozmówcy po logowaniu (patrz rsakeys/partner.go).
+// Unieważnienia i nowe klucze otrzymane od rozmówcy są zapisywane,
+// klucz rozmówcy (zapisany lub otrzymany przy logowaniu) obowiązuje
+// od teraz w tej sesji. Interfejs użytkownika tylko pokazuje werdykt
+// i pyta użytkownika, jego zgodę zapisuje AcceptPeer.
+func (s *Session) CheckPeer(rsaManager *rsakeys.Manager) *rsakeys.Verdict {
+	v := rsaManager.CheckPartner(s.buddyName, s.receivedKey, s.transitions, s.revocations)
+	if v.Key != nil {
+		s.Enigma.SetBuddyPublicKey(v.Key)
+	}
+	return v
+}
+
+// Użytkownik zgodził się na rozmowę: otrzymany klucz jest zapisywany,
+// a klucz rozmówcy zapamiętywany (patrz rsakeys/knownpeers.go).
+func (s *Session) AcceptPeer(rsaManager *rsakeys.Manager, v *rsakeys.Verdict) error {
+	return rsaManager.AcceptPartner(s.buddyName, v)
+}
@@ -0,0 +1,160 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/secret"
+	"Carmel/shared/vtc"
+	"encoding/binary"
+	"time"
+)
+
+// Wymiana kluczy symetrycznych w trakcie sesji.
+//
+// Co RekeyInterval serwer losuje klucze następnej generacji
+// i wysyła je klientowi (żądanie Rekey, szyfrowane bieżącymi kluczami).
+// Klient od razu zaczyna ich używać, serwer - po otrzymaniu odpowiedzi.
+// Każda zaszyfrowana wiadomość zawiera identyfikator generacji kluczy,
+// więc wiadomości będące w drodze w czasie zmiany dają się odszyfrować.
+// Stare klucze są wymazywane (Enigma.ClearKeys) po upływie rekeyGrace,
+// chyba że sesję wcześniej zamknięto.
+
+const DefaultRekeyInterval = 5 * time.Minute
+
+// Czas przez który stare klucze są jeszcze potrzebne.
+func (s *Session) rekeyGrace() time.Duration {
+	grace := time.Duration(vtc.MessageTimeout) * time.Second
+	if half := s.RekeyInterval / 2; half < grace {
+		grace = half
+	}
+	return grace
+}
+
+func (s *Session) rekeyLoop() {
+	if s.role != vtc.Server || s.RekeyInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.RekeyInterval)
+	defer ticker.Stop()
+
+	m := s.Link.Mux
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-m.Done():
+			return
+		case <-ticker.C:
+		}
+		if !isConnected(m) {
+			continue
+		}
+		if !s.rekey() {
+			if s.isClosed() {
+				return
+			}
+			s.closeWithReason("the exchange of keys failed")
+			return
+		}
+	}
+}
+
+// Serwer: wysłanie kluczy następnej generacji.
+func (s *Session) rekey() bool {
+	if s.isClosed() {
+		return false
+	}
+	e, out := s.Enigma, s.Out
+	key, id, ok := e.NextKeys()
+	if !ok {
+		return false
+	}
+	defer secret.ClearSlice(&key)
+
+	generation := make([]byte, 4)
+	binary.LittleEndian.PutUint32(generation, id)
+
+	if request := out.Requester.Send(vtc.Rekey, key, generation); request != nil {
+		timeout := time.Duration(vtc.MessageTimeout) * time.Second
+		if answer := out.Responder.ReadTimeout(request, timeout); answer != nil && answer.Status == vtc.Ok {
+			if e.SwitchKeys() {
+				return s.clearKeysLater()
+			}
+		}
+	}
+	return false
+}
+
+// Klient: instalacja kluczy otrzymanych od serwera.
+func (s *Session) acceptRekey(request *message.Message) bool {
+	if s.role != vtc.Client || len(request.Extra) != 4 {
+		return false
+	}
+	defer secret.ClearSlice(&request.Data)
+
+	if s.isClosed() {
+		return false
+	}
+	e := s.Enigma
+	if e.AddKeys(binary.LittleEndian.Uint32(request.Extra), request.Data) && e.SwitchKeys() {
+		return s.clearKeysLater()
+	}
+	return false
+}
+
+// Zaplanowanie wymazania starych kluczy (zegar zatrzymuje Close).
+// Po zamknięciu sesji nic nie jest planowane.
+func (s *Session) clearKeysLater() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closedLocked() {
+		return false
+	}
+	if s.clearTimer != nil {
+		s.clearTimer.Stop()
+	}
+	s.clearTimer = time.AfterFunc(s.rekeyGrace(), s.Enigma.ClearKeys)
+	return true
+}
+
+func (s *Session) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closedLocked()
+}
+
+func (s *Session) closedLocked() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
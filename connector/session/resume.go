@@ -0,0 +1,244 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/frame"
+	"Carmel/connector/message"
+	"Carmel/connector/mux"
+	"Carmel/connector/tcpiface"
+	"Carmel/secret"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+)
+
+// Wznawianie sesji po zerwaniu połączenia TCP.
+//
+// Po wymianie kluczy obie strony wyliczają ten sam bilet
+// (Enigma.ResumptionTicket). Klient ponownie łączy się z serwerem
+// (serwer nasłuchuje przez cały czas trwania sesji) i obie strony
+// dowodzą, że znają bilet:
+//
+//	klient -> serwer: Resume, Extra: nonce klienta
+//	serwer -> klient: Resume, Extra: nonce serwera, Blob: HMAC(bilet, "server" | nonces)
+//	klient -> serwer: Resume, Blob: HMAC(bilet, "client" | nonces)
+//	serwer -> klient: Resume, Status: Accepted
+//
+// Po tej wymianie nowe połączenie zastępuje stare w multiplekserze,
+// który ponownie wysyła żądania oczekujące na odpowiedź.
+
+const (
+	nonceSize          = 16
+	resumeTimeout      = shared.ConnectionTimeout // w sekundach
+	resumeDialInterval = 2 * time.Second
+	resumeStepTimeout  = 10 * time.Second // cała wymiana po stronie serwera
+	resumeMaxAttempts  = 4                // jednocześnie obsługiwane próby wznowienia
+)
+
+var (
+	serverLabel = []byte("server")
+	clientLabel = []byte("client")
+)
+
+// Pilnuje połączenia do końca sesji.
+func (s *Session) superviseLink() {
+	if s.ticket == nil {
+		return
+	}
+	s.Link.Mux.EnableResumption()
+	if s.role == vtc.Server {
+		go s.acceptResumptions()
+	}
+	go s.watchLink()
+}
+
+func (s *Session) watchLink() {
+	m := s.Link.Mux
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-m.Done():
+			return
+		case <-m.Lost():
+			s.emit(Event{Type: LinkLost})
+			if !s.waitForResumption() {
+				s.closeWithReason("the connection could not be resumed")
+				return
+			}
+			s.emit(Event{Type: LinkRestored})
+		}
+	}
+}
+
+// Klient ponawia próby połączenia, serwer czeka aż klient się połączy.
+func (s *Session) waitForResumption() bool {
+	deadline := time.After(resumeTimeout * time.Second)
+	m := s.Link.Mux
+
+	if s.role == vtc.Server {
+		select {
+		case <-m.Restored():
+			return true
+		case <-deadline:
+		case <-s.done:
+		}
+		return false
+	}
+
+	for {
+		if iface := s.Link.Redial(); iface != nil {
+			if s.resumeAsClient(iface) {
+				m.Attach(iface)
+				return true
+			}
+			iface.Close()
+		}
+		select {
+		case <-time.After(resumeDialInterval):
+		case <-deadline:
+			return false
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// Serwer przyjmuje ponowne połączenia klienta.
+// Klient może wykryć zerwanie połączenia wcześniej niż serwer,
+// dlatego nowe połączenie (po weryfikacji) zawsze zastępuje bieżące.
+// Połączenia nie są jeszcze uwierzytelnione, dlatego obsługujemy naraz
+// najwyżej resumeMaxAttempts prób (nadmiarowe połączenia są od razu zamykane),
+// każda trwa najwyżej resumeStepTimeout. Po zakończeniu sesji serwer
+// przestaje nasłuchiwać.
+func (s *Session) acceptResumptions() {
+	m := s.Link.Mux
+	go func() {
+		select {
+		case <-s.done:
+		case <-m.Done():
+		}
+		s.Link.StopListening()
+	}()
+
+	attempts := make(chan struct{}, resumeMaxAttempts)
+	for {
+		iface := s.Link.Accept()
+		if iface == nil {
+			return
+		}
+		select {
+		case attempts <- struct{}{}:
+		default:
+			iface.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-attempts }()
+			if s.resumeAsServer(iface) {
+				m.Attach(iface)
+				return
+			}
+			iface.Close()
+		}()
+	}
+}
+
+func (s *Session) resumeAsClient(iface *tcpiface.TCPInterface) bool {
+	iface.SetDeadline(time.Now().Add(resumeStepTimeout))
+	defer iface.SetDeadline(time.Time{})
+
+	clientNonce := secret.RandomBytes(nonceSize)
+	if writeResume(iface, vtc.Request, 0, clientNonce, nil) {
+		if answer := readResume(iface, vtc.Answer); answer != nil && answer.Status == vtc.Ok {
+			if hmac.Equal(answer.Blob, s.resumeProof(serverLabel, clientNonce, answer.Extra)) {
+				if writeResume(iface, vtc.Request, 0, nil, s.resumeProof(clientLabel, clientNonce, answer.Extra)) {
+					if answer := readResume(iface, vtc.Answer); answer != nil {
+						return answer.Status == vtc.Accepted
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *Session) resumeAsServer(iface *tcpiface.TCPInterface) bool {
+	iface.SetDeadline(time.Now().Add(resumeStepTimeout))
+	defer iface.SetDeadline(time.Time{})
+
+	if request := readResume(iface, vtc.Request); request != nil && len(request.Extra) == nonceSize {
+		clientNonce, serverNonce := request.Extra, secret.RandomBytes(nonceSize)
+		if writeResume(iface, vtc.Answer, vtc.Ok, serverNonce, s.resumeProof(serverLabel, clientNonce, serverNonce)) {
+			if request := readResume(iface, vtc.Request); request != nil {
+				if hmac.Equal(request.Blob, s.resumeProof(clientLabel, clientNonce, serverNonce)) {
+					return writeResume(iface, vtc.Answer, vtc.Accepted, nil, nil)
+				}
+				writeResume(iface, vtc.Answer, vtc.Rejected, nil, nil)
+			}
+		}
+	}
+	return false
+}
+
+func (s *Session) resumeProof(label, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, s.ticket)
+	mac.Write(label)
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// Komunikaty wznowienia przesyłane są bezpośrednio przez nowe połączenie
+// (jeszcze zanim trafi ono do multipleksera).
+func writeResume(iface *tcpiface.TCPInterface, kind vtc.MessageType, status vtc.OperationStatusType, nonce, proof []byte) bool {
+	msg := message.NewWithType(kind)
+	msg.Id = vtc.Resume
+	msg.Status = status
+	msg.Extra = nonce
+	msg.Blob = proof
+	msg.Tstamp = shared.Now()
+	if data := msg.ToJsonSnapped(); data != nil {
+		f := &frame.Frame{Type: frame.Raw, Channel: uint8(mux.Upstream), Payload: data}
+		return iface.WriteFrame(f) == nil
+	}
+	return false
+}
+
+func readResume(iface *tcpiface.TCPInterface, kind vtc.MessageType) *message.Message {
+	if f, err := iface.ReadFrame(); err == nil && f.Type == frame.Raw {
+		if msg := message.NewFromJson(f.Payload); msg != nil && msg.Type == kind && msg.Id == vtc.Resume {
+			return msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import (
+	"Carmel/rsakeys"
+)
+
+// Unieważnienia kluczy (patrz rsakeys/revocation.go).
+// Klient wysyła w logowaniu (razem z oświadczeniami o nowych kluczach)
+// wszystkie znane mu unieważnienia, serwer przekazuje je użytkownikowi sesji.
+// Unieważnienie jest podpisane unieważnionym kluczem, więc każdy może je sprawdzić.
+
+// Unieważnienia otrzymane od rozmówcy przy logowaniu.
+// Użytkownik sesji dopisuje je do swoich (rsakeys.Manager.ImportRevocations).
+func (s *Session) Revocations() []*rsakeys.Revocation {
+	return s.revocations
+}
+
+func myRevocations() []*rsakeys.Revocation {
+	if rsaManager := rsakeys.New(); rsaManager != nil {
+		return rsaManager.Revocations()
+	}
+	return nil
+}
+
+// Oświadczenia i unieważnienia wysyłane w logowaniu.
+func myKeys() []byte {
+	return append(rsakeys.ArmorKeyTransitions(myKeyTransitions()), rsakeys.ArmorRevocations(myRevocations())...)
+}
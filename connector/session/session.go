@@ -29,72 +29,212 @@
 package session
 
 import (
+	"Carmel/connector/message"
+	"Carmel/connector/mux"
 	"Carmel/connector/stream"
-	"Carmel/secret"
+	"Carmel/rsakeys"
 	"Carmel/secret/enigma"
-	"Carmel/shared/tr"
+	"Carmel/shared"
 	"Carmel/shared/vtc"
-	"encoding/json"
+	"context"
+	"sync"
+	"time"
 )
 
 type Session struct {
+	rtt int64 // time.Duration, atomic (pierwsze pole - wyrównanie do 64 bitów)
+
+	// Można zmienić przed Establish (patrz heartbeat.go i rekey.go).
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+	RekeyInterval       time.Duration // tylko serwer (patrz rekey.go)
+
+	// Akceptowane zestawy szyfrów w kolejności preferencji.
+	// Można zmienić przed SendLogin/ReadLogin.
+	// Zestaw wybiera serwer (pierwszy z jego listy obsługiwany przez klienta).
+	CipherSuites []enigma.SuiteId
+
+	// Tryb zgodności ze starszymi programami: zgoda na dopełnienie
+	// PKCS#1 v1.5 (szyfrowanie i podpisy RSA). Można zmienić przed SendLogin/ReadLogin.
+	LegacyRSA bool
+
+	// Wymiana kluczy publicznych przy pierwszym kontakcie (patrz bootstrap.go).
+	// Klient wysyła swój klucz i prosi o klucz serwera,
+	// serwer akceptuje taką wymianę. Można zmienić przed SendLogin/ReadLogin.
+	Bootstrap bool
+
+	role   vtc.RoleType
+	Link   *stream.Link   // jedno połączenie TCP dla obu kierunków
 	In     *stream.Stream // klient -> serwer
 	Out    *stream.Stream // serwer -> klient
 	Enigma *enigma.Enigma
+
+	agreement   Agreement // wynik negocjacji wersji protokołu
+	reason      string    // powód odrzucenia lub zamknięcia połączenia
+	buddyName   string
+	ticket      []byte                   // bilet wznowienia sesji (patrz resume.go)
+	receivedKey *rsakeys.PublicKey       // klucz rozmówcy otrzymany przy logowaniu (patrz bootstrap.go)
+	transitions []*rsakeys.KeyTransition // oświadczenia rozmówcy o nowych kluczach (patrz transition.go)
+	revocations []*rsakeys.Revocation    // unieważnienia kluczy otrzymane od rozmówcy (patrz revocation.go)
+	events      chan Event
+	done        chan struct{}
+	once        sync.Once
+	mutex       sync.Mutex  // done i clearTimer (zamknięcie a wymiana kluczy)
+	clearTimer  *time.Timer // wymazanie starych kluczy (patrz rekey.go)
 }
 
 func ServerNew(port int) *Session {
 	if e := enigma.New(""); e != nil {
-		return &Session{In: stream.Server(port, e), Out: stream.Server(port+1, e), Enigma: e}
+		return newSession(vtc.Server, stream.Server(port), e, "")
 	}
 	return nil
 }
 
 func ClientNew(addr string, port int, buddyName string, timeout int) *Session {
 	if e := enigma.New(buddyName); e != nil {
-		return &Session{In: stream.Client(addr, port+1, e, timeout), Out: stream.Client(addr, port, e, timeout), Enigma: e}
+		return newSession(vtc.Client, stream.Client(addr, port, timeout), e, buddyName)
 	}
 	return nil
 }
 
-func (s *Session) Close() {
-	if s.In != nil {
-		s.In.Close()
-		s.In = nil
+func newSession(role vtc.RoleType, link *stream.Link, e *enigma.Enigma, buddyName string) *Session {
+	return &Session{
+		HeartbeatInterval:   DefaultHeartbeatInterval,
+		MaxMissedHeartbeats: DefaultMaxMissedHeartbeats,
+		RekeyInterval:       DefaultRekeyInterval,
+		CipherSuites:        enigma.DefaultSuites,
+		role:                role,
+		Link:                link,
+		Enigma:              e,
+		buddyName:           buddyName,
+		events:              make(chan Event, eventsQueueSize),
+		done:                make(chan struct{}),
+	}
+}
+
+func (s *Session) Role() vtc.RoleType {
+	return s.role
+}
+
+func (s *Session) Agreement() Agreement {
+	return s.agreement
+}
+
+// Czytelny powód odrzucenia połączenia (przez nas lub rozmówcę)
+// albo zamknięcia sesji (np. brak odpowiedzi na pingi).
+func (s *Session) Reason() string {
+	return s.reason
+}
+
+// Nawiązanie połączenia z rozmówcą.
+// Oba strumienie (In i Out) korzystają z tego samego połączenia TCP,
+// każdy z nich to osobny kanał logiczny.
+// Zwraca status operacji i numer portu, którego on dotyczy.
+func (s *Session) Connect(ctx context.Context) (vtc.OperationStatusType, int) {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	state := s.Link.Run(ctx, &wg)
+	wg.Wait()
+
+	if state == vtc.Ok && !s.openStreams() {
+		state = vtc.Error
 	}
-	if s.Out != nil {
-		s.Out.Close()
-		s.Out = nil
+	return state, s.Link.ServerPort
+}
+
+// Oba strumienie na połączeniu, które już jest w multiplekserze.
+func (s *Session) openStreams() bool {
+	in, out := mux.Upstream, mux.Downstream
+	inKeys, outKeys := enigma.ClientToServer, enigma.ServerToClient
+	if s.role == vtc.Client {
+		in, out = out, in
+		inKeys, outKeys = outKeys, inKeys
+	}
+	s.In = stream.New(s.Link, in, s.Enigma.Keys(inKeys))
+	s.Out = stream.New(s.Link, out, s.Enigma.Keys(outKeys))
+	if s.In == nil || s.Out == nil {
+		return false
 	}
-	if s.Enigma != nil {
-		s.Enigma = nil
+	s.In.Requester.OnSecurityBreach = func(reason string) {
+		s.emit(Event{Type: SecurityBreach, Reason: reason})
 	}
+	return true
 }
 
-// Serwer wysyła do klienta wszystki klucze symetryczne.
-func (s *Session) SendKeys() bool {
-	defer s.Enigma.ClearKeys()
+// Strumienie i klucze zostają na miejscu: pętle sesji (pingi, wymiana
+// kluczy) i jej użytkownik mogą z nich jeszcze korzystać, kończą pracę
+// po zamknięciu done albo gdy odczyt zwróci nil.
+func (s *Session) Close() {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		close(s.done)
+		if s.clearTimer != nil {
+			s.clearTimer.Stop()
+		}
+		s.mutex.Unlock()
+		if s.In != nil {
+			s.In.Close()
+		}
+		if s.Out != nil {
+			s.Out.Close()
+		}
+		if s.Link != nil {
+			s.Link.Close()
+		}
+	})
+}
 
-	if data, err := json.Marshal(s.Enigma.Keys); tr.IsOK(err) {
-		if cipher := s.Enigma.EncryptRSA(data); cipher != nil {
-			if s.Out.Requester.SendRawMessage(cipher) {
-				return true
+// Odczyt kolejnego żądania od rozmówcy.
+// Pingi i wymiana kluczy obsługiwane są tutaj,
+// użytkownik sesji ich nie widzi.
+func (s *Session) ReadRequest() *message.Message {
+	in := s.In
+	for {
+		request := in.Requester.Read()
+		if request == nil {
+			return nil
+		}
+		status := vtc.Ok
+		switch request.Id {
+		case vtc.Ping:
+		case vtc.Rekey:
+			if !s.acceptRekey(request) {
+				status = vtc.Error
 			}
+		default:
+			return request
+		}
+		if answer := in.Responder.Send(status, request, nil, nil); answer == nil {
+			return nil
 		}
 	}
-	return false
 }
 
-// Klient odczytuje wszystkie klucze symetryczne od serwera.
-func (s *Session) ReadKeys() bool {
-	defer s.Enigma.ClearKeys()
+// Uzgodnienie kluczy symetrycznych (patrz enigma/agreement.go):
+//
+//	serwer -> klient: KeyAgreement, Data: zestaw szyfrów, Extra: klucz serwera, Blob: podpis serwera
+//	klient -> serwer: KeyAgreement, Data: zestaw szyfrów, Extra: klucz klienta, Blob: podpis klienta
+//
+// Klucze X25519 są jednorazowe, podpisywane kluczami RSA obu stron.
+// Obie wiadomości trafiają do skrótu przebiegu (patrz challenge.go).
+func (s *Session) AgreeKeysAsServer() bool {
+	e := s.Enigma
+	defer e.ClearKeys()
 
-	if cipher := s.In.Requester.ReadRawMessage(); cipher != nil {
-		if data := s.Enigma.DecryptRsa(cipher); data != nil {
-			if err := json.Unmarshal(data, &s.Enigma.Keys); tr.IsOK(err) {
-				if s.Enigma.InitBlowfish(s.Enigma.Keys.Blowfish) {
-					if s.Enigma.InitGost(s.Enigma.Keys.Gost) {
-						if s.Enigma.InitWay3(s.Enigma.Keys.Way3) {
+	suite := enigma.ChooseSuite(s.CipherSuites, s.agreement.Capabilities)
+	if serverKey := e.EphemeralKey(); serverKey != nil {
+		if sign := e.AgreementSignature(vtc.Server, suite, serverKey, nil); sign != nil {
+			request := agreementMessage(vtc.Request, suite, serverKey, sign)
+			if s.Out.Requester.SendRawMessage(request) {
+				data := s.Out.Requester.ReadRawMessage()
+				if answer := readAgreement(data, vtc.Answer); answer != nil {
+					e.UpdateTranscript(request)
+					e.UpdateTranscript(data)
+					clientKey := answer.Extra
+					if e.IsValidAgreementSignature(vtc.Client, answer.Blob, suite, serverKey, clientKey) {
+						if e.AgreeKeys(vtc.Server, suite, serverKey, clientKey) {
+							s.ticket = e.ResumptionTicket(s.role)
 							return true
 						}
 					}
@@ -105,29 +245,64 @@ func (s *Session) ReadKeys() bool {
 	return false
 }
 
-func (s *Session) ExchangeBlockIdentifiersAsServer() bool {
-	// serwer żada blok identyfikujący od klienta (wysyła własny)
-	if request := s.Out.Requester.Send(vtc.GetBlockID, s.Enigma.ServerId, nil); request != nil {
-		if answer := s.Out.Responder.Read(request); answer != nil {
-			if secret.AreSlicesEqual(answer.Data, s.Enigma.ClientId) {
-				return true
+func (s *Session) AgreeKeysAsClient() bool {
+	e := s.Enigma
+	defer e.ClearKeys()
+
+	data := s.In.Requester.ReadRawMessage()
+	if request := readAgreement(data, vtc.Request); request != nil {
+		suite, serverKey := suiteFrom(request.Data), request.Extra
+		if s.acceptsSuite(suite) && e.IsValidAgreementSignature(vtc.Server, request.Blob, suite, serverKey, nil) {
+			if clientKey := e.EphemeralKey(); clientKey != nil {
+				if sign := e.AgreementSignature(vtc.Client, suite, serverKey, clientKey); sign != nil {
+					answer := agreementMessage(vtc.Answer, suite, clientKey, sign)
+					if s.In.Requester.SendRawMessage(answer) {
+						e.UpdateTranscript(data)
+						e.UpdateTranscript(answer)
+						if e.AgreeKeys(vtc.Client, suite, serverKey, clientKey) {
+							s.ticket = e.ResumptionTicket(s.role)
+							return true
+						}
+					}
+				}
 			}
 		}
 	}
 	return false
 }
 
-func (s *Session) ExchangeBlockIdentifiersAsClient() bool {
-	// klient czeka na żądanie od serwera,
-	// jeśli wszystko jest ok odsyła swój block identyfikujący
-	if request := s.In.Requester.Read(); request != nil {
-		if request.Id == vtc.GetBlockID {
-			if secret.AreSlicesEqual(request.Data, s.Enigma.ServerId) {
-				if answer := s.In.Responder.Send(vtc.Ok, request, s.Enigma.ClientId, nil); answer != nil {
-					return true
-				}
-			}
+// Klient przyjmuje tylko zestaw, który sam zaproponował.
+func (s *Session) acceptsSuite(suite enigma.SuiteId) bool {
+	for _, id := range s.CipherSuites {
+		if id == suite {
+			return true
 		}
 	}
 	return false
 }
+
+func suiteFrom(data []byte) enigma.SuiteId {
+	if len(data) == 1 {
+		return enigma.SuiteId(data[0])
+	}
+	return 0
+}
+
+func agreementMessage(kind vtc.MessageType, suite enigma.SuiteId, key, sign []byte) []byte {
+	msg := message.NewWithType(kind)
+	msg.Id = vtc.KeyAgreement
+	msg.Data = []byte{byte(suite)}
+	msg.Extra = key
+	msg.Blob = sign
+	msg.Tstamp = shared.Now()
+	return msg.ToJsonSnapped()
+}
+
+func readAgreement(data []byte, kind vtc.MessageType) *message.Message {
+	if data != nil {
+		if msg := message.NewFromJson(data); msg != nil && msg.Type == kind && msg.Id == vtc.KeyAgreement {
+			return msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/connector/mux"
+	"Carmel/connector/stream"
+	"Carmel/connector/tcpiface"
+	"Carmel/secret/enigma"
+	"Carmel/shared/vtc"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Dwie strony sesji połączone przez net.Pipe, z uzgodnionymi kluczami
+// (bez logowania).
+func sessionPair(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+	server := newSession(vtc.Server, &stream.Link{Mux: mux.New(tcpiface.New(a))}, enigma.NewWithKeys(nil, nil), "ala")
+	client := newSession(vtc.Client, &stream.Link{Mux: mux.New(tcpiface.New(b))}, enigma.NewWithKeys(nil, nil), "ola")
+	t.Cleanup(server.Close)
+	t.Cleanup(client.Close)
+
+	serverKey, clientKey := server.Enigma.EphemeralKey(), client.Enigma.EphemeralKey()
+	if !assert.True(t, server.Enigma.AgreeKeys(vtc.Server, enigma.AESGCM, serverKey, clientKey)) ||
+		!assert.True(t, client.Enigma.AgreeKeys(vtc.Client, enigma.AESGCM, serverKey, clientKey)) ||
+		!assert.True(t, server.openStreams()) || !assert.True(t, client.openStreams()) {
+		t.FailNow()
+	}
+	return server, client
+}
+
+func within(t *testing.T, read func() *message.Message) *message.Message {
+	result := make(chan *message.Message, 1)
+	go func() {
+		result <- read()
+	}()
+	select {
+	case msg := <-result:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+// Żądanie jednej strony i odpowiedź drugiej.
+func exchange(t *testing.T, sender, recipient *Session, text string) {
+	request := sender.Out.Requester.Send(vtc.Message, []byte(text), nil)
+	if !assert.NotNil(t, request) {
+		return
+	}
+	received := within(t, recipient.ReadRequest)
+	if assert.NotNil(t, received) {
+		assert.Equal(t, text, string(received.Data))
+		assert.NotNil(t, recipient.In.Responder.Send(vtc.Ok, received, []byte("ok"), nil))
+	}
+	answer := within(t, func() *message.Message { return sender.Out.Responder.Read(request) })
+	if assert.NotNil(t, answer) {
+		assert.Equal(t, "ok", string(answer.Data))
+	}
+}
+
+// Oba kierunki sesji w jednym połączeniu.
+func Test_BothDirections(t *testing.T) {
+	server, client := sessionPair(t)
+	exchange(t, client, server, "Ala ma kota")
+	exchange(t, server, client, "Ola ma psa")
+	exchange(t, client, server, "kot ma Alę")
+}
+
+// Pingi obsługuje sesja, użytkownik widzi tylko następne żądanie.
+func Test_PingNotDelivered(t *testing.T) {
+	server, client := sessionPair(t)
+	received := make(chan *message.Message, 1)
+	go func() {
+		received <- server.ReadRequest()
+	}()
+
+	rtt, ok := client.ping()
+	assert.True(t, ok)
+	assert.True(t, rtt > 0)
+	request := client.Out.Requester.Send(vtc.Message, []byte("po pingu"), nil)
+	assert.NotNil(t, request)
+	select {
+	case msg := <-received:
+		if assert.NotNil(t, msg) {
+			assert.Equal(t, vtc.Message, msg.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+// Zamknięcie sesji przez rozmówcę kończy odczyty.
+func Test_ClosedByPartner(t *testing.T) {
+	server, client := sessionPair(t)
+	client.Close()
+	assert.Nil(t, within(t, server.ReadRequest))
+}
+
+// Wymiana kluczy w trakcie sesji, po zamknięciu sesji nic nie jest planowane.
+func Test_RekeyAndClose(t *testing.T) {
+	server, client := sessionPair(t)
+	received := make(chan *message.Message, 1)
+	go func() {
+		received <- client.ReadRequest()
+	}()
+
+	assert.True(t, server.rekey())
+	assert.NotNil(t, server.clearTimer)
+	assert.NotNil(t, server.Out.Requester.Send(vtc.Message, []byte("nowe klucze"), nil))
+	if msg := within(t, func() *message.Message { return <-received }); assert.NotNil(t, msg) {
+		assert.Equal(t, "nowe klucze", string(msg.Data))
+	}
+
+	server.Close()
+	client.Close()
+	assert.False(t, server.clearTimer.Stop(), "the timer is stopped by Close")
+	assert.False(t, server.rekey())
+	assert.False(t, client.acceptRekey(&message.Message{Extra: make([]byte, 4)}))
+}
@@ -0,0 +1,98 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"Carmel/connector/message"
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"Carmel/shared/vtc"
+)
+
+// Rotacja kluczy (patrz rsakeys/transition.go).
+// Klient zawsze wysyła w logowaniu swoje oświadczenia (nowy klucz podpisany starym),
+// serwer przekazuje je użytkownikowi sesji (patrz KeyTransitions).
+// Jeśli serwer nie może odszyfrować logowania (klient zna tylko jego stary klucz),
+// raz odsyła jawnie swoje oświadczenia:
+//
+//	serwer -> klient: KeyTransition, Data: nazwa serwera, Blob: oświadczenia
+//
+// Klient sprawdza je znanym kluczem serwera i ponawia logowanie z nowym kluczem.
+
+// Oświadczenia rozmówcy otrzymane przy logowaniu.
+// Użytkownik sesji zastępuje nimi zapisany klucz rozmówcy
+// (patrz rsakeys.Manager.ApplyKeyTransitions).
+func (s *Session) KeyTransitions() []*rsakeys.KeyTransition {
+	return s.transitions
+}
+
+func myKeyTransitions() []*rsakeys.KeyTransition {
+	if rsaManager := rsakeys.New(); rsaManager != nil && shared.MyUserName != "" {
+		return rsaManager.KeyTransitionsFor(shared.MyUserName)
+	}
+	return nil
+}
+
+// Zamiana klucza rozmówcy (tylko w tej sesji) na najnowszy poświadczony przez znany klucz.
+func (s *Session) followKeyTransitions(buddyName string, transitions []*rsakeys.KeyTransition) bool {
+	if current := s.Enigma.BuddyPublicKey(); current != nil {
+		if newKey := rsakeys.FollowKeyTransitions(current, buddyName, transitions); newKey.Fingerprint() != current.Fingerprint() {
+			s.Enigma.SetBuddyPublicKey(newKey)
+			s.transitions = transitions
+			return true
+		}
+	}
+	return false
+}
+
+// Serwer bez oświadczeń nie ma czego wysłać.
+func (s *Session) sendKeyTransitions() bool {
+	if transitions := myKeyTransitions(); transitions != nil {
+		msg := message.NewWithType(vtc.Answer)
+		msg.Id = vtc.KeyTransition
+		msg.Data = []byte(shared.MyUserName)
+		msg.Blob = rsakeys.ArmorKeyTransitions(transitions)
+		msg.Tstamp = shared.Now()
+		if data := msg.ToJsonSnapped(); data != nil {
+			return s.In.Requester.SendRawMessage(data)
+		}
+	}
+	return false
+}
+
+func readKeyTransitions(data []byte, buddyName string) []*rsakeys.KeyTransition {
+	if isPlainMessage(data) {
+		if msg := message.NewFromJson(data); msg != nil && msg.Type == vtc.Answer && msg.Id == vtc.KeyTransition {
+			if string(msg.Data) == buddyName {
+				return rsakeys.ParseKeyTransitions(msg.Blob)
+			}
+		}
+	}
+	return nil
+}
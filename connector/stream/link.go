@@ -0,0 +1,291 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stream
+
+import (
+	"Carmel/connector/mux"
+	"Carmel/connector/tcpiface"
+	"Carmel/shared/tr"
+	"Carmel/shared/vtc"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Link is the only TCP connection of the session.
+// Both streams (In and Out) are carried by it as logical channels.
+type Link struct {
+	role         vtc.RoleType
+	Mux          *mux.Mux
+	RemoteAddr   string
+	ServerAddr   string           // client only
+	ServerPort   int              // server & client
+	MaxFrameSize int              // 0 - default size (frame.DefaultMaxSize)
+	timeout      int              // client only
+	listener     *net.TCPListener // server only, kept open for session resumption
+	mutex        sync.Mutex       // guards listener
+}
+
+func Server(port int) *Link {
+	return &Link{role: vtc.Server, ServerPort: port}
+}
+
+func Client(addr string, port int, timeout int) *Link {
+	return &Link{role: vtc.Client, ServerAddr: addr, ServerPort: port, timeout: timeout}
+}
+
+func (l *Link) Close() {
+	if l.Mux != nil {
+		l.Mux.Close()
+	}
+	l.StopListening()
+}
+
+// Server
+// Koniec przyjmowania ponownych połączeń (Accept zwraca nil).
+func (l *Link) StopListening() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.listener != nil {
+		l.listener.Close()
+	}
+}
+
+// Server
+// Czeka na ponowne połączenie klienta (wznowienie sesji).
+// Zwraca nil po zamknięciu połączenia (Close).
+func (l *Link) Accept() *tcpiface.TCPInterface {
+	l.mutex.Lock()
+	listener := l.listener
+	l.mutex.Unlock()
+	if listener != nil {
+		if conn, err := listener.AcceptTCP(); err == nil {
+			if iface := l.newInterface(conn); iface != nil {
+				return iface
+			}
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// Client
+// Jedna próba ponownego połączenia z serwerem (wznowienie sesji).
+func (l *Link) Redial() *tcpiface.TCPInterface {
+	if addr, err := net.ResolveIPAddr("ip", l.ServerAddr); tr.IsOK(err) {
+		tcpAddr := net.TCPAddr{IP: addr.IP, Port: l.ServerPort, Zone: addr.Zone}
+		if conn, err := net.DialTCP("tcp", nil, &tcpAddr); tr.IsOK(err) {
+			if iface := l.newInterface(conn); iface != nil {
+				return iface
+			}
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+func (l *Link) newInterface(conn *net.TCPConn) *tcpiface.TCPInterface {
+	if err := conn.SetKeepAlive(true); tr.IsOK(err) {
+		if iface := tcpiface.New(conn); iface != nil {
+			iface.SetMaxFrameSize(l.MaxFrameSize)
+			l.RemoteAddr = conn.RemoteAddr().String()
+			return iface
+		}
+	}
+	return nil
+}
+
+/********************************************************************
+*                                                                   *
+*                             R U N                                 *
+*                                                                   *
+********************************************************************/
+
+func (l *Link) Run(ctx context.Context, wg *sync.WaitGroup) vtc.OperationStatusType {
+	defer wg.Done()
+
+	retChan := make(chan vtc.OperationStatusType)
+	defer close(retChan)
+	var iwg sync.WaitGroup
+
+	switch l.role {
+	//------- Server -------
+	case vtc.Server:
+		ictx, cancel := context.WithCancel(context.Background())
+		iwg.Add(1)
+		go l.runServer(ictx, &iwg, retChan)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stream.Run.Server:", ctx.Err())
+			cancel()
+			iwg.Wait()
+			return vtc.Cancel
+		case retv := <-retChan:
+			cancel()
+			return retv
+		}
+
+	//------- Client -------
+	case vtc.Client:
+		ictx, cancel := context.WithTimeout(context.Background(), time.Duration(l.timeout)*time.Second)
+		iwg.Add(1)
+		go l.runClient(ictx, &iwg, retChan)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stream.Run.Client:", ctx.Err())
+			cancel()
+			iwg.Wait()
+			return vtc.Cancel
+		case retv := <-retChan:
+			cancel()
+			iwg.Wait()
+			return retv
+		}
+
+	}
+	return vtc.Error
+}
+
+func (l *Link) runServer(ctx context.Context, wg *sync.WaitGroup, retChan chan<- vtc.OperationStatusType) {
+	defer wg.Done()
+
+	rc := make(chan vtc.OperationStatusType, 1)
+	go l.waitForClient(ctx, rc)
+
+	select {
+	case <-ctx.Done():
+		log.Println("Stream.runServer:", ctx.Err())
+		// AcceptTCP returns after the listener is closed.
+		l.StopListening()
+		if <-rc == vtc.Ok {
+			l.Mux.Close()
+		}
+	case retv := <-rc:
+		retChan <- retv
+	}
+}
+
+func (l *Link) waitForClient(ctx context.Context, retChan chan<- vtc.OperationStatusType) {
+	if hostname, err := os.Hostname(); tr.IsOK(err) {
+		if addr, err := net.ResolveIPAddr("ip", hostname); tr.IsOK(err) {
+			tcpAdrr := net.TCPAddr{IP: addr.IP, Port: l.ServerPort, Zone: addr.Zone}
+			fmt.Printf("Server: %s:%d\n", tcpAdrr.IP, tcpAdrr.Port)
+
+			if listener, err := net.ListenTCP("tcp", &tcpAdrr); tr.IsOK(err) {
+				// Stored before AcceptTCP, so that StopListening can interrupt it.
+				l.mutex.Lock()
+				if ctx.Err() != nil {
+					l.mutex.Unlock()
+					listener.Close()
+					retChan <- vtc.Cancel
+					return
+				}
+				l.listener = listener
+				l.mutex.Unlock()
+
+				if conn, err := listener.AcceptTCP(); tr.IsOK(err) {
+					if iface := l.newInterface(conn); iface != nil {
+						l.Mux = mux.New(iface)
+						retChan <- vtc.Ok
+						return
+					}
+				}
+				listener.Close()
+			}
+		}
+	}
+	retChan <- vtc.Error
+}
+
+func (l *Link) runClient(ctx context.Context, wg *sync.WaitGroup, retChan chan<- vtc.OperationStatusType) {
+	defer wg.Done()
+
+	rc := make(chan vtc.OperationStatusType)
+	ictx, cancel := context.WithCancel(context.Background())
+	var iwg sync.WaitGroup
+	iwg.Add(1)
+
+	go l.connectToServer(ictx, &iwg, rc)
+
+	select {
+	case <-ctx.Done():
+		cancel()
+		iwg.Wait()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Println("Stream.runClient: timeout")
+			retChan <- vtc.Timeout
+		} else {
+			log.Println("Stream.runClient:", ctx.Err())
+		}
+	case retval := <-rc:
+		cancel()
+		iwg.Wait()
+		retChan <- retval
+	}
+}
+
+func (l *Link) connectToServer(ctx context.Context, wg *sync.WaitGroup, retChan chan<- vtc.OperationStatusType) {
+	defer wg.Done()
+
+	if addr, err := net.ResolveIPAddr("ip", l.ServerAddr); tr.IsOK(err) {
+		tcpAddr := net.TCPAddr{IP: addr.IP, Port: l.ServerPort, Zone: addr.Zone}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if l.dial(tcpAddr) {
+					log.Println("connection with server established")
+					retChan <- vtc.Ok
+					return
+				}
+				// następna próba za 5 sekund
+				time.Sleep(5 * time.Second)
+			}
+		}
+	}
+}
+
+// Client
+// Próba połączenia z serwerem.
+func (l *Link) dial(tcpAddr net.TCPAddr) bool {
+	if conn, err := net.DialTCP("tcp", nil, &tcpAddr); tr.IsOK(err) {
+		if iface := l.newInterface(conn); iface != nil {
+			l.Mux = mux.New(iface)
+			return true
+		}
+	}
+	return false
+}
@@ -29,50 +29,53 @@
 package tcpiface
 
 import (
-	"Carmel/shared/tr"
+	"Carmel/connector/frame"
 	"bufio"
 	"fmt"
 	"net"
+	"time"
 )
 
 type TCPInterface struct {
-	writer *net.TCPConn
-	reader *bufio.Reader
+	writer       net.Conn
+	reader       *bufio.Reader
+	maxFrameSize int
 }
 
-func New(conn *net.TCPConn) *TCPInterface {
+// Usually a TCP connection (net.Pipe in tests).
+func New(conn net.Conn) *TCPInterface {
 	if conn != nil {
 		if reader := bufio.NewReader(conn); reader != nil {
-			return &TCPInterface{writer: conn, reader: reader}
+			return &TCPInterface{writer: conn, reader: reader, maxFrameSize: frame.DefaultMaxSize}
 		}
 	}
 	return nil
 }
 
 func (iface *TCPInterface) Close() {
-	defer func() {
-		iface.writer = nil
-		iface.reader = nil
-	}()
-
 	if iface.writer != nil {
 		iface.writer.Close()
 	}
 }
 
-func (iface *TCPInterface) Write(data []byte) bool {
-	if _, err := iface.writer.Write(data); tr.IsOK(err) {
-		return true
+// Frames bigger than the given size are neither sent nor accepted.
+func (iface *TCPInterface) SetMaxFrameSize(nbytes int) {
+	if nbytes > 0 {
+		iface.maxFrameSize = nbytes
 	}
-	return false
 }
 
-func (iface *TCPInterface) Read(bytesNumber int) []byte {
-	buffer := make([]byte, bytesNumber)
-	if _, err := iface.reader.Read(buffer); tr.IsOK(err) {
-		return buffer
-	}
-	return nil
+// Zero value of t means no deadline.
+func (iface *TCPInterface) SetDeadline(t time.Time) error {
+	return iface.writer.SetDeadline(t)
+}
+
+func (iface *TCPInterface) WriteFrame(f *frame.Frame) error {
+	return frame.Write(iface.writer, f, iface.maxFrameSize)
+}
+
+func (iface *TCPInterface) ReadFrame() (*frame.Frame, error) {
+	return frame.Read(iface.reader, iface.maxFrameSize)
 }
 
 func (iface *TCPInterface) Address() string {
@@ -30,8 +30,8 @@ package connectTo
 
 import (
 	"Carmel/chat"
-	"Carmel/connector/message"
 	"Carmel/connector/session"
+	"Carmel/rsakeys"
 	"Carmel/shared"
 	"Carmel/shared/tr"
 	"Carmel/shared/vtc"
@@ -42,7 +42,6 @@ import (
 	"github.com/gotk3/gotk3/gtk"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 const (
@@ -64,10 +63,13 @@ const (
 	portTooltip     = "port number on which the server listens"
 	nameTooltip     = "user name to which you would like to connect"
 	pinTooltip      = "pin needed to establish connection to the server"
+	keysTooltip     = "without the partner's public key send yours and receive theirs (protected by the PIN)"
 
 	connectionTimeout   = "Timeout"
 	connectionCanceled  = "Canceled"
 	connectionError     = "Unknown error"
+	connectionSecurity  = "Security breach"
+	connectionRejected  = "Connection rejected"
 	connectionMsgFormat = "Connection failed with:  %s:%d"
 )
 
@@ -79,6 +81,7 @@ type Dialog struct {
 	portEntry         *gtk.Entry
 	nameEntry         *gtk.Entry
 	pinEntry          *gtk.Entry
+	bootstrapCheck    *gtk.CheckButton
 	startBtn          *gtk.Button
 	copyBtn           *gtk.Button
 	cancelBtn         *gtk.Button
@@ -172,33 +175,39 @@ func (d *Dialog) createContent() *gtk.Grid {
 			if portPrompt, portEntry := createPortWidgets(); portPrompt != nil {
 				if namePrompt, nameEntry := createUsernameWidgets(); namePrompt != nil {
 					if pinPrompt, pinEntry := createPINWidgets(); pinPrompt != nil {
-						if spinner, err := gtk.SpinnerNew(); tr.IsOK(err) {
-							ipEntry.SetTooltipText(ipTooltip)
-							portEntry.SetTooltipText(portTooltip)
-							nameEntry.SetTooltipText(nameTooltip)
-							pinEntry.SetTooltipText(pinTooltip)
-
-							d.ipEntry = ipEntry
-							d.portEntry = portEntry
-							d.nameEntry = nameEntry
-							d.pinEntry = pinEntry
-							d.spinner = spinner
-
-							y := 0
-							grid.Attach(d.spinner, 0, y, 2, 1)
-							y++
-							grid.Attach(ipPrompt, 0, y, 1, 1)
-							grid.Attach(ipEntry, 1, y, 1, 1)
-							y++
-							grid.Attach(portPrompt, 0, y, 1, 1)
-							grid.Attach(portEntry, 1, y, 1, 1)
-							y++
-							grid.Attach(namePrompt, 0, y, 1, 1)
-							grid.Attach(nameEntry, 1, y, 1, 1)
-							y++
-							grid.Attach(pinPrompt, 0, y, 1, 1)
-							grid.Attach(pinEntry, 1, y, 1, 1)
-							return grid
+						if bootstrapCheck, err := gtk.CheckButtonNewWithLabel("exchange public keys (first contact)"); tr.IsOK(err) {
+							if spinner, err := gtk.SpinnerNew(); tr.IsOK(err) {
+								ipEntry.SetTooltipText(ipTooltip)
+								portEntry.SetTooltipText(portTooltip)
+								nameEntry.SetTooltipText(nameTooltip)
+								pinEntry.SetTooltipText(pinTooltip)
+								bootstrapCheck.SetTooltipText(keysTooltip)
+
+								d.ipEntry = ipEntry
+								d.portEntry = portEntry
+								d.nameEntry = nameEntry
+								d.pinEntry = pinEntry
+								d.bootstrapCheck = bootstrapCheck
+								d.spinner = spinner
+
+								y := 0
+								grid.Attach(d.spinner, 0, y, 2, 1)
+								y++
+								grid.Attach(ipPrompt, 0, y, 1, 1)
+								grid.Attach(ipEntry, 1, y, 1, 1)
+								y++
+								grid.Attach(portPrompt, 0, y, 1, 1)
+								grid.Attach(portEntry, 1, y, 1, 1)
+								y++
+								grid.Attach(namePrompt, 0, y, 1, 1)
+								grid.Attach(nameEntry, 1, y, 1, 1)
+								y++
+								grid.Attach(pinPrompt, 0, y, 1, 1)
+								grid.Attach(pinEntry, 1, y, 1, 1)
+								y++
+								grid.Attach(bootstrapCheck, 1, y, 1, 1)
+								return grid
+							}
 						}
 					}
 				}
@@ -214,6 +223,7 @@ func (d *Dialog) enableDisable(state bool) {
 		d.portEntry.SetSensitive(state)
 		d.nameEntry.SetSensitive(state)
 		d.pinEntry.SetSensitive(state)
+		d.bootstrapCheck.SetSensitive(state)
 		d.startBtn.SetSensitive(state)
 		d.copyBtn.SetSensitive(state)
 		d.cancelBtn.SetSensitive(true)
@@ -288,34 +298,28 @@ func (d *Dialog) start() {
 		pin, _ := d.pinEntry.GetText()
 		portn, _ := strconv.Atoi(port)
 
-		if ssn := session.ClientNew(ip, portn, name, shared.ConnectionTimeout); ssn != nil {
+		newSession := session.ClientNew
+		if d.bootstrapCheck.GetActive() && !rsakeys.New().ExistPublicKeyFor(name) {
+			newSession = session.BootstrapClientNew
+		}
+		if ssn := newSession(ip, portn, name, shared.ConnectionTimeout); ssn != nil {
 			d.ctx, d.cancel = context.WithCancel(context.Background())
 			go func() {
 				var failureReason string
-				var wg sync.WaitGroup
-
-				currentPort := ssn.In.ServerPort
-				wg.Add(1)
-				state := ssn.In.Run(d.ctx, &wg)
-				wg.Wait()
 
+				state, currentPort := ssn.Connect(d.ctx)
 				if state == vtc.Ok {
-					currentPort = ssn.Out.ServerPort
-					wg.Add(1)
-					state = ssn.Out.Run(d.ctx, &wg)
-					wg.Wait()
-
-					if state == vtc.Ok {
-						if d.initConnection(ssn, name, pin) {
-							glib.IdleAdd(func() {
-								d.self.Destroy()
-								if chatter := chat.New(d.app, vtc.Client, name, ssn); chatter != nil {
-									chatter.ShowAll()
-								}
-							})
-							return
-						}
+					state = ssn.SendLogin(name, pin)
+					if state == vtc.Accepted {
+						glib.IdleAdd(func() {
+							d.self.Destroy()
+							if chatter := chat.New(d.app, name, ssn); chatter != nil {
+								chatter.ShowAll()
+							}
+						})
+						return
 					}
+					ssn.Close()
 				}
 
 				switch state {
@@ -323,6 +327,10 @@ func (d *Dialog) start() {
 					failureReason = connectionTimeout
 				case vtc.Cancel:
 					failureReason = connectionCanceled
+				case vtc.SecurityBreach:
+					failureReason = connectionSecurity
+				case vtc.Rejected:
+					failureReason = connectionRejected
 				default:
 					failureReason = connectionError
 				}
@@ -334,7 +342,11 @@ func (d *Dialog) start() {
 							dialog.Destroy()
 							d.continueEdition()
 						}()
-						dialog.FormatSecondaryText(fmt.Sprintf(connectionMsgFormat, ip, currentPort))
+						if state == vtc.Rejected {
+							dialog.FormatSecondaryText(ssn.Reason())
+						} else {
+							dialog.FormatSecondaryText(fmt.Sprintf(connectionMsgFormat, ip, currentPort))
+						}
 						dialog.Run()
 					}
 				})
@@ -346,34 +358,6 @@ func (d *Dialog) start() {
 	}
 }
 
-// Klient wysyła dane do logowania.
-// Server to zaakceptuje lub nie :)
-// Brak akceptacji najprawdopodobniej oznacza, że po stronie
-// serwera brakuje twojego publicznego klucza RSA.
-func (d *Dialog) initConnection(ssn *session.Session, name, pin string) bool {
-	// Wysłanie dnaych logowania
-	msg := message.NewWithType(vtc.Request)
-	msg.Id = vtc.Login
-	msg.Data = []byte(fmt.Sprintf("%s|%s", shared.MyUserName, name)) // my_name | yours_name
-	msg.Extra = []byte(pin)
-	msg.Tstamp = shared.Now()
-
-	if data := msg.ToJsonSnapped(); data != nil {
-		if cipher := ssn.Out.Enigma.EncryptRSA(data); cipher != nil {
-			if ssn.Out.Requester.SendRawMessage(cipher) {
-				if data := ssn.Out.Requester.ReadRawMessage(); data != nil {
-					if plain := ssn.Out.Enigma.DecryptRsa(data); plain != nil {
-						if msg := message.NewFromJson(plain); msg != nil {
-							return true
-						}
-					}
-				}
-			}
-		}
-	}
-	return false
-}
-
 func (d *Dialog) continueEdition() {
 	d.connectionAttempt = false
 	d.enableDisable(true)
@@ -57,6 +57,8 @@ type DialogWithOneField struct {
 	descriptionLabel *gtk.Label
 	promptLabel      *gtk.Label
 	entry            *gtk.Entry
+	secret           bool
+	keepCase         bool
 }
 
 const (
@@ -181,7 +183,26 @@ func (dialog *DialogWithOneField) SetValue(text string) {
 
 func (dialog *DialogWithOneField) GetValue() string {
 	if text, err := dialog.entry.GetText(); tr.IsOK(err) {
+		if dialog.keepCase {
+			return text
+		}
 		return strings.ToLower(text)
 	}
 	return ""
 }
+
+// SetSecret
+// The entered text is not visible (e.g. passphrase)
+// and is returned without any changes.
+func (dialog *DialogWithOneField) SetSecret() {
+	dialog.secret = true
+	dialog.keepCase = true
+	dialog.entry.SetVisibility(false)
+	dialog.entry.SetWidthChars(20)
+}
+
+// SetKeepCase
+// The entered text is returned without any changes (e.g. display name).
+func (dialog *DialogWithOneField) SetKeepCase() {
+	dialog.keepCase = true
+}
@@ -30,7 +30,6 @@ package waitForConnection
 
 import (
 	"Carmel/chat"
-	"Carmel/connector/message"
 	"Carmel/connector/session"
 	"Carmel/secret"
 	"Carmel/shared"
@@ -44,8 +43,6 @@ import (
 	"github.com/gotk3/gotk3/gtk"
 	"os"
 	"strconv"
-	"strings"
-	"sync"
 )
 
 const (
@@ -68,10 +65,12 @@ const (
 	cancelTooltip = "break action and return"
 	copyTooltip   = "copy data to the clipboard"
 	startTooltip  = "start waiting for connection"
+	keysTooltip   = "a partner without your public key sends theirs and receives yours (protected by the PIN)"
 
 	connectionCanceled  = "Canceled"
 	connectionError     = "Unknown error"
 	connectionSecurity  = "Security breach"
+	connectionRejected  = "Connection rejected"
 	connectionMsgFormat = "Connection failed on port:  %d"
 )
 
@@ -88,6 +87,7 @@ type Dialog struct {
 	copyBtn           *gtk.Button
 	cancelBtn         *gtk.Button
 	internetCheck     *gtk.CheckButton
+	bootstrapCheck    *gtk.CheckButton
 	connectionAttempt bool
 	ctx               context.Context
 	cancel            context.CancelFunc
@@ -188,41 +188,47 @@ func (d *Dialog) createContent() *gtk.Grid {
 				if namePrompt, nameLabel := createUsernameWidgets(); namePrompt != nil {
 					if pinPrompt, pinLabel := createPINWidgets(); pinPrompt != nil {
 						if internetCheck := createInternetChecker(); internetCheck != nil {
-							if spinner, err := gtk.SpinnerNew(); tr.IsOK(err) {
-
-								if shared.MyInternetIP != "" {
-									internetCheck.Connect("toggled", func() {
-										if internetCheck.GetActive() {
-											ipLabel.SetText(shared.MyInternetIP)
-										} else {
-											ipLabel.SetText(shared.MyLocalIP)
-										}
-									})
+							if bootstrapCheck, err := gtk.CheckButtonNewWithLabel("exchange public keys (first contact)"); tr.IsOK(err) {
+								if spinner, err := gtk.SpinnerNew(); tr.IsOK(err) {
+
+									if shared.MyInternetIP != "" {
+										internetCheck.Connect("toggled", func() {
+											if internetCheck.GetActive() {
+												ipLabel.SetText(shared.MyInternetIP)
+											} else {
+												ipLabel.SetText(shared.MyLocalIP)
+											}
+										})
+									}
+
+									d.ipLabel = ipLabel
+									d.portEntry = portEntry
+									d.nameLabel = nameLabel
+									d.pinLabel = pinLabel
+									d.spinner = spinner
+									d.internetCheck = internetCheck
+									d.bootstrapCheck = bootstrapCheck
+									bootstrapCheck.SetTooltipText(keysTooltip)
+
+									y := 0
+									grid.Attach(spinner, 0, y, 2, 1)
+									y++
+									grid.Attach(ipPrompt, 0, y, 1, 1)
+									grid.Attach(ipLabel, 1, y, 1, 1)
+									grid.Attach(internetCheck, 2, y, 1, 1)
+									y++
+									grid.Attach(portPrompt, 0, y, 1, 1)
+									grid.Attach(portEntry, 1, y, 2, 1)
+									y++
+									grid.Attach(namePrompt, 0, y, 1, 1)
+									grid.Attach(nameLabel, 1, y, 2, 1)
+									y++
+									grid.Attach(pinPrompt, 0, y, 1, 1)
+									grid.Attach(pinLabel, 1, y, 2, 1)
+									y++
+									grid.Attach(bootstrapCheck, 1, y, 2, 1)
+									return grid
 								}
-
-								d.ipLabel = ipLabel
-								d.portEntry = portEntry
-								d.nameLabel = nameLabel
-								d.pinLabel = pinLabel
-								d.spinner = spinner
-								d.internetCheck = internetCheck
-
-								y := 0
-								grid.Attach(spinner, 0, y, 2, 1)
-								y++
-								grid.Attach(ipPrompt, 0, y, 1, 1)
-								grid.Attach(ipLabel, 1, y, 1, 1)
-								grid.Attach(internetCheck, 2, y, 1, 1)
-								y++
-								grid.Attach(portPrompt, 0, y, 1, 1)
-								grid.Attach(portEntry, 1, y, 2, 1)
-								y++
-								grid.Attach(namePrompt, 0, y, 1, 1)
-								grid.Attach(nameLabel, 1, y, 2, 1)
-								y++
-								grid.Attach(pinPrompt, 0, y, 1, 1)
-								grid.Attach(pinLabel, 1, y, 2, 1)
-								return grid
 							}
 						}
 					}
@@ -257,46 +263,25 @@ func (d *Dialog) start() {
 	d.enableDisable(false)
 
 	if ssn := session.ServerNew(port); ssn != nil {
+		ssn.Bootstrap = d.bootstrapCheck.GetActive()
 		d.ctx, d.cancel = context.WithCancel(context.Background())
 		go func() {
 			var failureReason string
-			var faildePort int
-			var wg sync.WaitGroup
-			var stateIn, stateOut vtc.OperationStatusType
-			state := vtc.Ok
-
-			wg.Add(2)
-			go func() {
-				stateIn = ssn.In.Run(d.ctx, &wg)
-			}()
-			go func() {
-				stateOut = ssn.Out.Run(d.ctx, &wg)
-			}()
-			wg.Wait()
-
-			if stateIn == vtc.Ok && stateOut == vtc.Ok {
-				if buddyName := d.initConnection(ssn, pin); buddyName != "" {
+
+			state, failedPort := ssn.Connect(d.ctx)
+			if state == vtc.Ok {
+				buddyName, loginState := ssn.ReadLogin(pin)
+				if loginState == vtc.Accepted {
 					glib.IdleAdd(func() {
 						d.self.Destroy()
-						if chatter := chat.New(d.app, vtc.Server, buddyName, ssn); chatter != nil {
+						if chatter := chat.New(d.app, buddyName, ssn); chatter != nil {
 							chatter.ShowAll()
 						}
 					})
 					return
 				}
-				state = vtc.SecurityBreach
+				state = loginState
 				ssn.Close()
-				ssn = nil
-			}
-
-			if state == vtc.Ok {
-				if stateIn != vtc.Ok {
-					faildePort = ssn.In.ServerPort
-					state = stateIn
-				} else {
-					faildePort = ssn.Out.ServerPort
-					state = stateOut
-				}
 			}
 
 			switch state {
@@ -304,6 +289,8 @@ func (d *Dialog) start() {
 				failureReason = connectionCanceled
 			case vtc.SecurityBreach:
 				failureReason = connectionSecurity
+			case vtc.Rejected:
+				failureReason = connectionRejected
 			default:
 				failureReason = connectionError
 			}
@@ -315,8 +302,12 @@ func (d *Dialog) start() {
 						errDialog.Destroy()
 						d.continueEdition()
 					}()
-					if state != vtc.SecurityBreach {
-						errDialog.FormatSecondaryText(fmt.Sprintf(connectionMsgFormat, faildePort))
+					switch state {
+					case vtc.SecurityBreach:
+					case vtc.Rejected:
+						errDialog.FormatSecondaryText(ssn.Reason())
+					default:
+						errDialog.FormatSecondaryText(fmt.Sprintf(connectionMsgFormat, failedPort))
 					}
 					errDialog.Run()
 					if state == vtc.SecurityBreach {
@@ -331,25 +322,6 @@ func (d *Dialog) start() {
 	d.stop()
 }
 
-// Odczyt od klienta żądania inicjacyjnego.
-// Operacja przesyłu danych szyfrowana jest w całości kluczem RSA.
-func (d *Dialog) initConnection(ssn *session.Session, pin string) string {
-	if data := ssn.In.Requester.ReadRawMessage(); data != nil {
-		if plain := ssn.In.Enigma.DecryptRsa(data); plain != nil {
-			if msg := message.NewFromJson(plain); msg != nil {
-				if msg.Id == vtc.Login {
-					if items := strings.Split(string(msg.Data), "|"); len(items) == 2 {
-						if items[1] == shared.MyUserName && pin == string(msg.Extra) {
-							return items[0]
-						}
-					}
-				}
-			}
-		}
-	}
-	return ""
-}
-
 func (d *Dialog) continueEdition() {
 	d.connectionAttempt = false
 	d.enableDisable(true)
@@ -404,6 +376,7 @@ func (d *Dialog) enableDisable(state bool) {
 		d.startBtn.SetSensitive(state)
 		d.copyBtn.SetSensitive(state)
 		d.pinBtn.SetSensitive(state)
+		d.bootstrapCheck.SetSensitive(state)
 		d.cancelBtn.SetSensitive(true)
 		d.portEntry.GrabFocusWithoutSelecting()
 	})
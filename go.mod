@@ -1,9 +1,17 @@
 module Carmel
 
-go 1.13
+go 1.20
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/golang/snappy v0.0.1
 	github.com/gotk3/gotk3 v0.0.0-20191204062422-9d4abcb16021
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.9.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -60,6 +60,7 @@ func main() {
 				})
 				app.AddAction(quitAction)
 				mw.ShowAll()
+				mw.UnlockPrivateKey()
 			}
 		})
 		retv := app.Run(os.Args)
@@ -0,0 +1,149 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package mainWindow
+
+import (
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"Carmel/shared/tr"
+	"github.com/gotk3/gotk3/gtk"
+	"strings"
+)
+
+/********************************************************************
+*                                                                   *
+*                    B A C K U P   H A N D L E R S                  *
+*                                                                   *
+********************************************************************/
+
+// backupHandler
+// All files of the keys directory are saved in one encrypted file
+// protected with its own passphrase.
+func (mw *MainWindow) backupHandler() {
+	if shared.MyUserName == "" {
+		mw.notDefinedUserNameInfo()
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+	filePath, ok := mw.getBackupFilePath(gtk.FILE_CHOOSER_ACTION_SAVE, "Back up identity", "Save")
+	if !ok {
+		return
+	}
+	passphrase, ok := mw.getBackupPassphrase(true)
+	if !ok {
+		return
+	}
+	if !strings.HasSuffix(filePath, rsakeys.BackupExtension) {
+		filePath += rsakeys.BackupExtension
+	}
+	if !rsaManager.SaveBackup(filePath, passphrase) {
+		mw.warning("The backup could not be saved", filePath)
+	}
+}
+
+// restoreHandler
+// The existing identity is replaced only if the user agrees,
+// it is moved aside (nothing is removed).
+func (mw *MainWindow) restoreHandler() {
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+	filePath, ok := mw.getBackupFilePath(gtk.FILE_CHOOSER_ACTION_OPEN, "Restore identity", "Open")
+	if !ok {
+		return
+	}
+	passphrase, ok := mw.getBackupPassphrase(false)
+	if !ok {
+		return
+	}
+	status := rsaManager.RestoreBackupFromFile(filePath, passphrase, false)
+	if status == rsakeys.BackupConflict {
+		const msgSecondary = "Your keys (or other files) would be overwritten.\n" +
+			"Would you like to move them aside and restore the backup?"
+		if !mw.question("The identity already exists", msgSecondary) {
+			return
+		}
+		status = rsaManager.RestoreBackupFromFile(filePath, passphrase, true)
+	}
+	switch status {
+	case rsakeys.BackupRestored:
+		shared.MyUserName = ""
+		mw.updateUser()
+		mw.UnlockPrivateKey()
+	case rsakeys.BackupUnsupported:
+		mw.warning("The backup could not be restored", "It was made by a newer version of the program.")
+	case rsakeys.BackupInvalid:
+		mw.warning("The backup could not be restored", "Invalid passphrase or damaged backup.")
+	default:
+		mw.warning("The backup could not be restored", "")
+	}
+}
+
+func (mw *MainWindow) getBackupPassphrase(repeat bool) (string, bool) {
+	const description = "The passphrase protects the backup,\n" +
+		"it is needed to restore it."
+
+	if passphrase, ok := mw.getPassphraseFromDialog("Passphrase of the backup:", description); ok {
+		if !repeat {
+			return passphrase, true
+		}
+		if repeated, ok := mw.getPassphraseFromDialog("Repeat passphrase:", ""); ok {
+			if repeated == passphrase {
+				return passphrase, true
+			}
+			mw.warning("The passphrases are different", "")
+		}
+	}
+	return "", false
+}
+
+func (mw *MainWindow) getBackupFilePath(action gtk.FileChooserAction, title, button string) (string, bool) {
+	if dialog, err := gtk.FileChooserDialogNewWith2Buttons(title, mw.win, action, "Cancel", gtk.RESPONSE_CANCEL, button, gtk.RESPONSE_ACCEPT); tr.IsOK(err) {
+		defer dialog.Destroy()
+
+		if filter, err := gtk.FileFilterNew(); tr.IsOK(err) {
+			filter.SetName("Backups")
+			filter.AddPattern("*" + rsakeys.BackupExtension)
+			dialog.AddFilter(filter)
+		}
+		if action == gtk.FILE_CHOOSER_ACTION_SAVE {
+			dialog.SetDoOverwriteConfirmation(true)
+			dialog.SetCurrentName(shared.MyUserName + rsakeys.BackupExtension)
+		}
+		if dialog.Run() == gtk.RESPONSE_ACCEPT {
+			if filePath := dialog.GetFilename(); filePath != "" {
+				return filePath, true
+			}
+		}
+	}
+	return "", false
+}
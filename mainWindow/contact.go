@@ -0,0 +1,156 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mainWindow
+
+import (
+	"Carmel/dialog/dialogWithOneField"
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"Carmel/shared/tr"
+	"fmt"
+	"github.com/gotk3/gotk3/gtk"
+	"strings"
+)
+
+/********************************************************************
+*                                                                   *
+*                C O N T A C T   C A R D   H A N D L E R S          *
+*                                                                   *
+********************************************************************/
+
+// exportContactCardHandler
+// The card is signed with the private key, so it must be unlocked.
+func (mw *MainWindow) exportContactCardHandler() {
+	if shared.MyUserName == "" {
+		mw.notDefinedUserNameInfo()
+		return
+	}
+	if !mw.isPrivateKeyAvailable() {
+		return
+	}
+	displayName, ok := mw.getDisplayNameFromDialog()
+	if !ok {
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+	card := rsaManager.ContactCardForUser(shared.MyUserName, displayName)
+	if card == nil {
+		mw.warning("The contact card could not be created", "")
+		return
+	}
+	if filePath, ok := mw.getCardFilePath(gtk.FILE_CHOOSER_ACTION_SAVE, "Export contact card", "Save"); ok {
+		if !strings.HasSuffix(filePath, rsakeys.ContactCardExtension) {
+			filePath += rsakeys.ContactCardExtension
+		}
+		if !card.Save(filePath) {
+			mw.warning("The contact card could not be saved", filePath)
+		}
+	}
+}
+
+// importContactCardHandler
+// The signature of the card is checked, the user compares the fingerprint
+// with the partner and decides if the key should be installed.
+func (mw *MainWindow) importContactCardHandler() {
+	filePath, ok := mw.getCardFilePath(gtk.FILE_CHOOSER_ACTION_OPEN, "Import contact card", "Open")
+	if !ok {
+		return
+	}
+	card := rsakeys.ContactCardFromFile(filePath)
+	if card == nil {
+		mw.warning("Invalid contact card", "The file is damaged or its signature is invalid.")
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+
+	msg := fmt.Sprintf("Contact card of %s", card.Name)
+	msgSecondary := fmt.Sprintf("%s\nCreated: %s\n\nKey fingerprint (%s):\n%s\n\n"+
+		"Compare the fingerprint with your partner (e.g. over the phone).\nWould you like to install the key?",
+		card.DisplayName, card.Created.Local().Format("2006-01-02 15:04"), card.PublicKey.Type, card.Fingerprint)
+	if !mw.question(msg, msgSecondary) {
+		return
+	}
+	switch rsaManager.ImportContactCard(card) {
+	case rsakeys.CardImported, rsakeys.CardKnown:
+	case rsakeys.CardKeyConflict:
+		mw.warning(fmt.Sprintf("A different key of %s is installed", card.Name), "The installed key was not replaced.")
+	case rsakeys.CardRevoked:
+		mw.warning(fmt.Sprintf("The key of %s is revoked", card.Name), "The owner reported the key as lost or stolen.")
+	default:
+		mw.warning("The key could not be installed", "")
+	}
+}
+
+func (mw *MainWindow) getDisplayNameFromDialog() (string, bool) {
+	validate := func(text string) dialogWithOneField.ValidationResult {
+		return dialogWithOneField.Ok
+	}
+
+	if dialog := dialogWithOneField.New(mw.app, validate); dialog != nil {
+		defer dialog.Destroy()
+
+		dialog.SetKeepCase()
+		dialog.SetPrompt("Display name:")
+		dialog.SetDescription("Your name shown to the partner who imports the card (optional).")
+		dialog.ShowAll()
+
+		if dialog.Run() == gtk.RESPONSE_ACCEPT {
+			return dialog.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+func (mw *MainWindow) getCardFilePath(action gtk.FileChooserAction, title, button string) (string, bool) {
+	if dialog, err := gtk.FileChooserDialogNewWith2Buttons(title, mw.win, action, "Cancel", gtk.RESPONSE_CANCEL, button, gtk.RESPONSE_ACCEPT); tr.IsOK(err) {
+		defer dialog.Destroy()
+
+		if filter, err := gtk.FileFilterNew(); tr.IsOK(err) {
+			filter.SetName("Contact cards")
+			filter.AddPattern("*" + rsakeys.ContactCardExtension)
+			dialog.AddFilter(filter)
+		}
+		if action == gtk.FILE_CHOOSER_ACTION_SAVE {
+			dialog.SetDoOverwriteConfirmation(true)
+			dialog.SetCurrentName(shared.MyUserName + rsakeys.ContactCardExtension)
+		}
+		if dialog.Run() == gtk.RESPONSE_ACCEPT {
+			if filePath := dialog.GetFilename(); filePath != "" {
+				return filePath, true
+			}
+		}
+	}
+	return "", false
+}
@@ -77,6 +77,9 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.`
 		"<span font_desc='10' foreground='#FF9966'> unknown</span>"
 )
 
+// Response of the dialog (see canRecreateKeys).
+const rotateKeysResponse gtk.ResponseType = 1
+
 type MainWindow struct {
 	app             *gtk.Application
 	win             *gtk.ApplicationWindow
@@ -131,6 +134,12 @@ func (mw *MainWindow) SetupMenu(headerBar *gtk.HeaderBar) bool {
 			menu.Append("Wait for connection...", "custom.wait4connection")
 			menu.Append("Connect to...", "custom.connect_to")
 			menu.Append("Generate RSA keys...", "custom.rsa_keys")
+			menu.Append("Change passphrase...", "custom.passphrase")
+			menu.Append("Export contact card...", "custom.export_card")
+			menu.Append("Import contact card...", "custom.import_card")
+			menu.Append("Import revocation...", "custom.import_revocation")
+			menu.Append("Back up identity...", "custom.backup")
+			menu.Append("Restore identity...", "custom.restore")
 			//menu.Append("Settings...", "custom.settings")
 			menu.Append("About...", "custom.about")
 			menu.Append("Quit", "app.quit")
@@ -153,6 +162,36 @@ func (mw *MainWindow) SetupMenu(headerBar *gtk.HeaderBar) bool {
 				mw.generatingRSAKeysHandler()
 			})
 			//.......................................................
+			passphraseAction := glib.SimpleActionNew("passphrase", nil)
+			passphraseAction.Connect("activate", func() {
+				mw.changePassphraseHandler()
+			})
+			//.......................................................
+			exportCardAction := glib.SimpleActionNew("export_card", nil)
+			exportCardAction.Connect("activate", func() {
+				mw.exportContactCardHandler()
+			})
+			//.......................................................
+			importCardAction := glib.SimpleActionNew("import_card", nil)
+			importCardAction.Connect("activate", func() {
+				mw.importContactCardHandler()
+			})
+			//.......................................................
+			importRevocationAction := glib.SimpleActionNew("import_revocation", nil)
+			importRevocationAction.Connect("activate", func() {
+				mw.importRevocationHandler()
+			})
+			//.......................................................
+			backupAction := glib.SimpleActionNew("backup", nil)
+			backupAction.Connect("activate", func() {
+				mw.backupHandler()
+			})
+			//.......................................................
+			restoreAction := glib.SimpleActionNew("restore", nil)
+			restoreAction.Connect("activate", func() {
+				mw.restoreHandler()
+			})
+			//.......................................................
 			wait4connectionAction := glib.SimpleActionNew("wait4connection", nil)
 			wait4connectionAction.Connect("activate", func() {
 				mw.waitForConnection()
@@ -162,6 +201,12 @@ func (mw *MainWindow) SetupMenu(headerBar *gtk.HeaderBar) bool {
 			customGroup.AddAction(aboutAction)
 			customGroup.AddAction(mw.connectToAction)
 			customGroup.AddAction(mw.rsaAction)
+			customGroup.AddAction(passphraseAction)
+			customGroup.AddAction(exportCardAction)
+			customGroup.AddAction(importCardAction)
+			customGroup.AddAction(importRevocationAction)
+			customGroup.AddAction(backupAction)
+			customGroup.AddAction(restoreAction)
 
 			mw.win.InsertActionGroup("custom", customGroup)
 			//=======================================================
@@ -233,6 +278,9 @@ func (mw *MainWindow) waitForConnection() {
 		mw.unknownIPAddress()
 		return
 	}
+	if !mw.isPrivateKeyAvailable() {
+		return
+	}
 	if dialog := waitForConnection.New(mw.app); dialog != nil {
 		defer dialog.Destroy()
 
@@ -252,6 +300,9 @@ func (mw *MainWindow) connectToActionHandler() {
 		mw.notDefinedUserNameInfo()
 		return
 	}
+	if !mw.isPrivateKeyAvailable() {
+		return
+	}
 
 	if dialog := connectTo.New(mw.app); dialog != nil {
 		defer dialog.Destroy()
@@ -325,21 +376,33 @@ func (mw *MainWindow) getNameFromDialog() (string, bool) {
 	return "", false
 }
 
+// createRSAKeysForUserName
+// Existing keys are replaced with new ones signed with the old private key (rotation),
+// so the partners can trust the new key. Keys are recreated from scratch
+// only when the old private key can't be used.
 func (mw *MainWindow) createRSAKeysForUserName(userName string) bool {
 	if rsaManager := rsakeys.New(); rsaManager != nil {
 		canCreate := true
 		if rsaManager.ExistPrivateKeyFor(userName) || rsaManager.ExistPublicKeyFor(userName) {
 			canCreate = false
-			if mw.canRecreateKeys(userName) {
+			switch mw.canRecreateKeys(userName) {
+			case rotateKeysResponse:
+				return mw.rotateKeys(rsaManager, userName)
+			case gtk.RESPONSE_OK:
 				if rsaManager.RemoveKeysFor(userName) {
 					canCreate = true
 				}
 			}
 		}
 		if canCreate {
-			if rsaManager.CreateKeysForUser(userName) {
+			passphrase, ok := mw.getNewPassphrase()
+			if !ok {
+				return false
+			}
+			if rsaManager.CreateKeysForUser(userName, passphrase) {
 				shared.MyUserName = userName
 				mw.updateUser()
+				mw.revocationCreatedInfo(rsaManager, userName)
 				return true
 			}
 		}
@@ -349,22 +412,48 @@ func (mw *MainWindow) createRSAKeysForUserName(userName string) bool {
 
 // canRecreateKeys
 // Displays a dialog in which the user should decide
-// whether to delete old keys and create new ones.
-func (mw *MainWindow) canRecreateKeys(userName string) bool {
+// whether to replace old keys with new ones signed with the old key (rotateKeysResponse),
+// delete old keys and create new ones (RESPONSE_OK) or cancel.
+func (mw *MainWindow) canRecreateKeys(userName string) gtk.ResponseType {
 	const (
 		msgFormat = "Keys for user %s already exists"
-		msgSecond = "Would you like to recreate keys?"
+		msgSecond = "Would you like to replace keys?\n" +
+			"Your partners accept new keys signed with the old private key automatically.\n" +
+			"Recreated keys must be sent to them again."
 	)
 
 	title := fmt.Sprintf(msgFormat, userName)
-	if dialog := gtk.MessageDialogNew(mw.app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_OK, title); dialog != nil {
+	if dialog := gtk.MessageDialogNew(mw.app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_NONE, title); dialog != nil {
 		defer dialog.Destroy()
-		if _, err := dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL); tr.IsOK(err) {
-			dialog.FormatSecondaryText(msgSecond)
-			return dialog.Run() == gtk.RESPONSE_OK
+		if _, err := dialog.AddButton("Replace", rotateKeysResponse); tr.IsOK(err) {
+			if _, err := dialog.AddButton("Recreate", gtk.RESPONSE_OK); tr.IsOK(err) {
+				if _, err := dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL); tr.IsOK(err) {
+					dialog.FormatSecondaryText(msgSecond)
+					dialog.SetDefaultResponse(rotateKeysResponse)
+					return dialog.Run()
+				}
+			}
 		}
 	}
-	return false
+	return gtk.RESPONSE_CANCEL
+}
+
+// rotateKeys
+// The old private key must be unlocked to sign the new public key.
+func (mw *MainWindow) rotateKeys(rsaManager *rsakeys.Manager, userName string) bool {
+	if userName != shared.MyUserName || !mw.isPrivateKeyAvailable() {
+		return false
+	}
+	passphrase, ok := mw.getNewPassphrase()
+	if !ok {
+		return false
+	}
+	if !rsaManager.RotateKeysForUser(userName, rsakeys.DefaultKeyType, passphrase) {
+		mw.warning("The keys could not be replaced", "")
+		return false
+	}
+	mw.revocationCreatedInfo(rsaManager, userName)
+	return true
 }
 
 /********************************************************************
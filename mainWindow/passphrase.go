@@ -0,0 +1,199 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mainWindow
+
+import (
+	"Carmel/dialog/dialogWithOneField"
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"fmt"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+/********************************************************************
+*                                                                   *
+*                  P A S S P H R A S E   H A N D L E R S            *
+*                                                                   *
+********************************************************************/
+
+// UnlockPrivateKey
+// Asks for the passphrase of the private key (at startup).
+// A plain key, saved by older versions of the program, can be protected at once.
+func (mw *MainWindow) UnlockPrivateKey() {
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+	userName := rsaManager.MyUserName()
+	if userName == "" {
+		return
+	}
+
+	if !rsaManager.IsPrivateKeyEncryptedFor(userName) {
+		const (
+			msg          = "Your private key is not protected"
+			msgSecondary = "Anyone who can read the program directory can impersonate you.\n" +
+				"Would you like to protect the key with a passphrase?"
+		)
+		if mw.question(msg, msgSecondary) {
+			if passphrase, ok := mw.getNewPassphrase(); ok {
+				if !rsaManager.ProtectPrivateKey(userName, passphrase) {
+					mw.warning("The passphrase could not be set", "")
+				}
+			}
+		}
+		return
+	}
+
+	description := fmt.Sprintf("Your private key (user %s) is encrypted.\n"+
+		"Enter the passphrase to unlock it.", userName)
+	for {
+		passphrase, ok := mw.getPassphraseFromDialog("Passphrase:", description)
+		if !ok {
+			return
+		}
+		if rsaManager.Unlock(userName, passphrase) {
+			return
+		}
+		mw.warning("Invalid passphrase", "")
+	}
+}
+
+// isPrivateKeyAvailable
+// The private key is needed to connect with somebody.
+// When the key is still locked the user is asked for the passphrase.
+func (mw *MainWindow) isPrivateKeyAvailable() bool {
+	if rsaManager := rsakeys.New(); rsaManager != nil {
+		if rsaManager.PrivateKeyFromFileForUser(shared.MyUserName) == nil {
+			mw.UnlockPrivateKey()
+		}
+		if rsaManager.PrivateKeyFromFileForUser(shared.MyUserName) != nil {
+			return true
+		}
+	}
+	mw.warning("Your private key is locked", "Sorry, you can't connect without your private key.")
+	return false
+}
+
+func (mw *MainWindow) changePassphraseHandler() {
+	if shared.MyUserName == "" {
+		mw.notDefinedUserNameInfo()
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+
+	if !rsaManager.IsPrivateKeyEncryptedFor(shared.MyUserName) {
+		if passphrase, ok := mw.getNewPassphrase(); ok {
+			if !rsaManager.ProtectPrivateKey(shared.MyUserName, passphrase) {
+				mw.warning("The passphrase could not be set", "")
+			}
+		}
+		return
+	}
+
+	if oldPassphrase, ok := mw.getPassphraseFromDialog("Current passphrase:", "Enter the passphrase you use now."); ok {
+		if passphrase, ok := mw.getNewPassphrase(); ok {
+			if !rsaManager.ChangePassphrase(shared.MyUserName, oldPassphrase, passphrase) {
+				mw.warning("The passphrase could not be changed", "Is the current passphrase correct?")
+			}
+		}
+	}
+}
+
+// getNewPassphrase
+// The new passphrase must be entered twice.
+func (mw *MainWindow) getNewPassphrase() (string, bool) {
+	const description = "The passphrase protects your private key.\n" +
+		"It is needed every time the program starts."
+
+	if passphrase, ok := mw.getPassphraseFromDialog("New passphrase:", description); ok {
+		if repeated, ok := mw.getPassphraseFromDialog("Repeat passphrase:", ""); ok {
+			if repeated == passphrase {
+				return passphrase, true
+			}
+			mw.warning("The passphrases are different", "")
+		}
+	}
+	return "", false
+}
+
+func (mw *MainWindow) getPassphraseFromDialog(prompt, description string) (string, bool) {
+	validate := func(text string) dialogWithOneField.ValidationResult {
+		if len(text) == 0 {
+			return dialogWithOneField.EmptyStringNotAllowed
+		}
+		return dialogWithOneField.Ok
+	}
+
+	if dialog := dialogWithOneField.New(mw.app, validate); dialog != nil {
+		defer dialog.Destroy()
+
+		dialog.SetSecret()
+		dialog.SetPrompt(prompt)
+		dialog.SetDescription(description)
+		dialog.ShowAll()
+
+		if dialog.Run() == gtk.RESPONSE_ACCEPT {
+			return dialog.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+func (mw *MainWindow) question(msg, msgSecondary string) bool {
+	if dialog := gtk.MessageDialogNew(mw.app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO, msg); dialog != nil {
+		defer dialog.Destroy()
+		dialog.FormatSecondaryText(msgSecondary)
+		return dialog.Run() == gtk.RESPONSE_YES
+	}
+	return false
+}
+
+func (mw *MainWindow) warning(msg, msgSecondary string) {
+	if dialog := gtk.MessageDialogNew(mw.app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_OK, msg); dialog != nil {
+		defer dialog.Destroy()
+		if msgSecondary != "" {
+			dialog.FormatSecondaryText(msgSecondary)
+		}
+		dialog.Run()
+	}
+}
+
+func (mw *MainWindow) info(msg, msgSecondary string) {
+	if dialog := gtk.MessageDialogNew(mw.app.GetActiveWindow(), gtk.DIALOG_MODAL, gtk.MESSAGE_INFO, gtk.BUTTONS_OK, msg); dialog != nil {
+		defer dialog.Destroy()
+		if msgSecondary != "" {
+			dialog.FormatSecondaryText(msgSecondary)
+		}
+		dialog.Run()
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package mainWindow
+
+import (
+	"Carmel/rsakeys"
+	"Carmel/shared"
+	"Carmel/shared/tr"
+	"fmt"
+	"github.com/gotk3/gotk3/gtk"
+	"strings"
+)
+
+/********************************************************************
+*                                                                   *
+*                 R E V O C A T I O N   H A N D L E R S             *
+*                                                                   *
+********************************************************************/
+
+// revocationCreatedInfo
+// The certificate is created together with the keys,
+// the user should move it to a safe place.
+func (mw *MainWindow) revocationCreatedInfo(rsaManager *rsakeys.Manager, userName string) {
+	mw.info("The revocation certificate was created",
+		fmt.Sprintf("%s\n\nStore it offline (e.g. on a USB stick) and remove it from this computer.\n"+
+			"Send it to your partners only if your private key is lost or stolen:\n"+
+			"they will refuse the key from then on.", rsaManager.RevocationPathFor(userName)))
+}
+
+// importRevocationHandler
+// The certificate is signed with the revoked key, so it can't be forged
+// and is imported without a question.
+func (mw *MainWindow) importRevocationHandler() {
+	filePath, ok := mw.getRevocationFilePath()
+	if !ok {
+		return
+	}
+	rsaManager := rsakeys.New()
+	if rsaManager == nil {
+		return
+	}
+	revocations := rsakeys.RevocationsFromFile(filePath)
+	if revocations == nil {
+		mw.warning("Invalid revocation certificate", "The file is damaged or its signature is invalid.")
+		return
+	}
+	added := rsaManager.ImportRevocations(revocations)
+	if added == nil {
+		mw.info("The keys are already revoked", "")
+		return
+	}
+	var lines []string
+	myKey := rsaManager.PublicKeyFromFileForUser(shared.MyUserName)
+	for _, r := range added {
+		lines = append(lines, fmt.Sprintf("%s (%s):\n%s", r.Name, r.Created.Local().Format("2006-01-02 15:04"), r.Fingerprint))
+		if myKey != nil && myKey.Fingerprint() == r.Fingerprint {
+			lines = append(lines, "This is your own key, create new keys.")
+		}
+	}
+	mw.info("Revoked keys", strings.Join(lines, "\n\n"))
+}
+
+func (mw *MainWindow) getRevocationFilePath() (string, bool) {
+	if dialog, err := gtk.FileChooserDialogNewWith2Buttons("Import revocation certificate", mw.win, gtk.FILE_CHOOSER_ACTION_OPEN, "Cancel", gtk.RESPONSE_CANCEL, "Open", gtk.RESPONSE_ACCEPT); tr.IsOK(err) {
+		defer dialog.Destroy()
+
+		if filter, err := gtk.FileFilterNew(); tr.IsOK(err) {
+			filter.SetName("Revocation certificates")
+			filter.AddPattern("*.pem")
+			dialog.AddFilter(filter)
+		}
+		if dialog.Run() == gtk.RESPONSE_ACCEPT {
+			if filePath := dialog.GetFilename(); filePath != "" {
+				return filePath, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,297 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package rsakeys
+
+import (
+	"Carmel/secret"
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Backup of the identity: all files of the keys directory (keys, known peers,
+// verified keys, contact cards, key transitions and revocations) packed
+// into one archive (tar, gzip) and encrypted with a key derived from
+// the passphrase (as the private key, see passphrase.go):
+//
+//	-----BEGIN CARMEL BACKUP-----
+//	Version: 1
+//	Created: 2019-12-01T10:00:00Z
+//	Kdf: scrypt 32768 8 1
+//	Salt: <hex>
+//
+//	<nonce | cipher text + tag>
+//	-----END CARMEL BACKUP-----
+//
+// All headers are authenticated, a backup of an unknown version isn't restored.
+
+const (
+	backupType       = "CARMEL BACKUP"
+	versionHeader    = "Version"
+	backupVersion    = 1
+	BackupExtension  = ".backup"
+	maxBackupSize    = 16 << 20 // protection against archives filling the disk
+	oldDirTimeFormat = "20060102-150405"
+)
+
+type BackupStatus uint8
+
+const (
+	BackupRestored    BackupStatus = iota // the files are restored
+	BackupConflict                        // an identity (or different files) would be overwritten
+	BackupUnsupported                     // the backup was made by a newer program
+	BackupInvalid                         // invalid passphrase, damaged or malformed backup
+)
+
+// Encrypted archive of the keys directory.
+func (m *Manager) Backup(passphrase string) []byte {
+	if passphrase == "" {
+		return nil
+	}
+	archive := m.archive()
+	salt := secret.RandomBytes(saltSize)
+	if archive == nil || salt == nil {
+		return nil
+	}
+	block := &pem.Block{
+		Type: backupType,
+		Headers: map[string]string{
+			versionHeader: strconv.Itoa(backupVersion),
+			createdHeader: time.Now().UTC().Format(time.RFC3339),
+			kdfHeader:     fmt.Sprintf(kdfFormat, scryptN, scryptR, scryptP),
+			saltHeader:    hex.EncodeToString(salt),
+		},
+	}
+	if aead := passphraseCipher(passphrase, block); aead != nil {
+		if nonce := secret.RandomBytes(aead.NonceSize()); nonce != nil {
+			block.Bytes = aead.Seal(nonce, nonce, archive, backupAdditionalData(block))
+			return pem.EncodeToMemory(block)
+		}
+	}
+	return nil
+}
+
+// The backup contains the private key, so only the owner can read the file.
+func (m *Manager) SaveBackup(filePath, passphrase string) bool {
+	if data := m.Backup(passphrase); data != nil {
+		return saveFile(filePath, privateFileMode, data)
+	}
+	return false
+}
+
+// Restores the files of the backup. The existing identity is never overwritten
+// silently: with replace the current keys directory is moved aside
+// (rsa_keys.<date>) and nothing is lost, without it the restore is refused.
+// Files with the same contents as in the backup don't count as a conflict.
+func (m *Manager) RestoreBackup(data []byte, passphrase string, replace bool) BackupStatus {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != backupType {
+		return BackupInvalid
+	}
+	if version, err := strconv.Atoi(block.Headers[versionHeader]); err != nil || version != backupVersion {
+		if err == nil && version > backupVersion {
+			return BackupUnsupported
+		}
+		return BackupInvalid
+	}
+	aead := passphraseCipher(passphrase, block)
+	if aead == nil || len(block.Bytes) <= aead.NonceSize() {
+		return BackupInvalid
+	}
+	nonce, cipherText := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	archive, err := aead.Open(nil, nonce, cipherText, backupAdditionalData(block))
+	if err != nil {
+		log.Println("invalid passphrase or damaged backup")
+		return BackupInvalid
+	}
+	files := unpackArchive(archive)
+	if files == nil {
+		return BackupInvalid
+	}
+
+	if m.conflictsWith(files) {
+		if !replace {
+			return BackupConflict
+		}
+		info, err := os.Stat(m.dir)
+		if err != nil {
+			log.Println(err)
+			return BackupConflict
+		}
+		oldDir := m.dir + "." + time.Now().Format(oldDirTimeFormat)
+		if err := os.Rename(m.dir, oldDir); err != nil {
+			log.Println(err)
+			return BackupConflict
+		}
+		if err := os.Mkdir(m.dir, info.Mode().Perm()); err != nil {
+			log.Println(err)
+			os.Rename(oldDir, m.dir)
+			return BackupConflict
+		}
+		log.Printf("the previous identity is moved to %s\n", oldDir)
+	}
+	clearUnlockedKeys()
+	for _, f := range files {
+		if !saveFile(filepath.Join(m.dir, f.name), f.mode, f.data) {
+			return BackupInvalid
+		}
+	}
+	return BackupRestored
+}
+
+func (m *Manager) RestoreBackupFromFile(filePath, passphrase string, replace bool) BackupStatus {
+	if data, err := ioutil.ReadFile(filePath); err == nil {
+		return m.RestoreBackup(data, passphrase, replace)
+	}
+	return BackupInvalid
+}
+
+type backupFile struct {
+	name string
+	mode os.FileMode
+	data []byte
+}
+
+// Any private key in the directory is an identity; other files
+// are a conflict only if the backup has different contents of them.
+func (m *Manager) conflictsWith(files []backupFile) bool {
+	items, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return false
+	}
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		current, err := ioutil.ReadFile(filepath.Join(m.dir, item.Name()))
+		if err != nil {
+			return true
+		}
+		same := false
+		for _, f := range files {
+			if f.name == item.Name() {
+				if !bytes.Equal(f.data, current) {
+					return true
+				}
+				same = true
+			}
+		}
+		if !same && getUserNameFromFileName(item.Name()) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) archive() []byte {
+	items, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return nil
+	}
+	var buffer bytes.Buffer
+	zw := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(zw)
+	for _, item := range items {
+		if !item.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(m.dir, item.Name()))
+		if err != nil {
+			return nil
+		}
+		header := &tar.Header{
+			Name:    item.Name(),
+			Mode:    int64(backupFileMode(item.Mode())),
+			Size:    int64(len(data)),
+			ModTime: item.ModTime(),
+		}
+		if tw.WriteHeader(header) != nil {
+			return nil
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil
+		}
+	}
+	if tw.Close() != nil || zw.Close() != nil {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// Only plain file names (no paths) are accepted.
+func unpackArchive(archive []byte) []backupFile {
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil
+	}
+	reader := tar.NewReader(io.LimitReader(zr, maxBackupSize))
+	files := []backupFile{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil || header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if header.Name != filepath.Base(header.Name) || header.Name == "." || header.Name == ".." {
+			return nil
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil
+		}
+		files = append(files, backupFile{name: header.Name, mode: backupFileMode(os.FileMode(header.Mode)), data: data})
+	}
+}
+
+// Files readable only by the owner stay private.
+func backupFileMode(mode os.FileMode) os.FileMode {
+	if mode.Perm()&0077 == 0 {
+		return privateFileMode
+	}
+	return publicFileMode
+}
+
+func backupAdditionalData(block *pem.Block) []byte {
+	data := []byte(block.Type)
+	for _, name := range []string{versionHeader, createdHeader, kdfHeader, saltHeader} {
+		data = append(data, fmt.Sprintf("\n%s: %s", name, block.Headers[name])...)
+	}
+	return data
+}
@@ -0,0 +1,238 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"Carmel/shared"
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Contact card: user name, display name, public key, fingerprint and creation date
+// signed by the owner's private key. The card is an armored text (PEM), so it can be
+// pasted into an e-mail or saved to a file:
+//
+//	-----BEGIN CARMEL CONTACT CARD-----
+//	Name, Display-Name, Created, Fingerprint (headers)
+//	signature
+//	-----END CARMEL CONTACT CARD-----
+//	public key blocks (as in the key file)
+//
+// The signature proves only that the card comes from the owner of the key,
+// the fingerprint should still be compared with the partner.
+
+const (
+	contactCardType       = "CARMEL CONTACT CARD"
+	contactCardLabel      = "carmel contact card"
+	nameHeader            = "Name"
+	displayNameHeader     = "Display-Name"
+	createdHeader         = "Created"
+	fingerprintHeader     = "Fingerprint"
+	contactCardFileFormat = "%s_card.pem"
+	ContactCardExtension  = ".card"
+	maxDisplayNameLength  = 64
+)
+
+type ContactCard struct {
+	Name        string
+	DisplayName string
+	PublicKey   *PublicKey
+	Fingerprint string // as PublicKey.Fingerprint
+	Created     time.Time
+	Signature   []byte
+}
+
+type CardStatus uint8
+
+const (
+	CardImported    CardStatus = iota // the public key is installed
+	CardKnown                         // the same key is already installed
+	CardKeyConflict                   // a different key of the user is installed (not replaced)
+	CardInvalid                       // malformed card or invalid signature
+	CardRevoked                       // the key of the card is revoked
+)
+
+// Card of the user signed with the user's private key (it must be unlocked).
+func (m *Manager) ContactCardForUser(userName, displayName string) *ContactCard {
+	displayName = strings.TrimSpace(displayName)
+	if !isValidDisplayName(displayName) {
+		log.Printf("invalid display name: %q\n", displayName)
+		return nil
+	}
+	if privateKey := m.PrivateKeyFromFileForUser(userName); privateKey != nil {
+		card := &ContactCard{
+			Name:        userName,
+			DisplayName: displayName,
+			PublicKey:   privateKey.Public(),
+			Created:     time.Now().UTC().Truncate(time.Second),
+		}
+		card.Fingerprint = card.PublicKey.Fingerprint()
+		if card.Signature = privateKey.Sign(card.signedData()); card.Signature != nil {
+			return card
+		}
+	}
+	return nil
+}
+
+// Text form of the card.
+func (c *ContactCard) Armor() []byte {
+	block := &pem.Block{
+		Type: contactCardType,
+		Headers: map[string]string{
+			nameHeader:        c.Name,
+			displayNameHeader: c.DisplayName,
+			createdHeader:     c.Created.Format(time.RFC3339),
+			fingerprintHeader: c.Fingerprint,
+		},
+		Bytes: c.Signature,
+	}
+	var buffer bytes.Buffer
+	if err := pem.Encode(&buffer, block); err != nil {
+		return nil
+	}
+	if key := c.PublicKey.Pem(); key != nil {
+		buffer.Write(key)
+		return buffer.Bytes()
+	}
+	return nil
+}
+
+// File form of the card (the same armored text).
+func (c *ContactCard) Save(filePath string) bool {
+	if data := c.Armor(); data != nil {
+		return saveFile(filePath, publicFileMode, data)
+	}
+	return false
+}
+
+// Reads the card from the text (other text around it is skipped)
+// and checks its signature. Returns nil for an invalid card.
+func ParseContactCard(data []byte) *ContactCard {
+	var block *pem.Block
+	for {
+		if block, data = pem.Decode(data); block == nil || block.Type == contactCardType {
+			break
+		}
+	}
+	if block == nil {
+		return nil
+	}
+	created, err := time.Parse(time.RFC3339, block.Headers[createdHeader])
+	if err != nil {
+		return nil
+	}
+	card := &ContactCard{
+		Name:        block.Headers[nameHeader],
+		DisplayName: block.Headers[displayNameHeader],
+		PublicKey:   PublicKeyFromPem(data),
+		Fingerprint: block.Headers[fingerprintHeader],
+		Created:     created,
+		Signature:   block.Bytes,
+	}
+	if !shared.IsValidName(card.Name) || !isValidDisplayName(card.DisplayName) || card.PublicKey == nil {
+		return nil
+	}
+	if card.Fingerprint != card.PublicKey.Fingerprint() || !card.PublicKey.Verify(card.signedData(), card.Signature) {
+		return nil
+	}
+	return card
+}
+
+func ContactCardFromFile(filePath string) *ContactCard {
+	if data, err := ioutil.ReadFile(filePath); err == nil {
+		return ParseContactCard(data)
+	}
+	return nil
+}
+
+// Installs <name>_public.pem from the card and keeps the card.
+// A different key of the user saved before is replaced only if it is revoked.
+func (m *Manager) ImportContactCard(card *ContactCard) CardStatus {
+	if card == nil {
+		return CardInvalid
+	}
+	if m.RevocationOf(card.PublicKey) != nil {
+		return CardRevoked
+	}
+	if m.ExistPublicKeyFor(card.Name) {
+		current := m.PublicKeyFromFileForUser(card.Name)
+		if current != nil && current.Fingerprint() == card.Fingerprint {
+			m.saveContactCard(card)
+			return CardKnown
+		}
+		if m.RevocationOf(current) == nil {
+			return CardKeyConflict
+		}
+	}
+	if m.SavePublicKeyForUser(card.Name, card.PublicKey) {
+		m.saveContactCard(card)
+		return CardImported
+	}
+	return CardInvalid
+}
+
+// Card of the partner saved at import (nil if there is none).
+func (m *Manager) ContactCardFor(userName string) *ContactCard {
+	return ContactCardFromFile(filepath.Join(m.dir, fmt.Sprintf(contactCardFileFormat, userName)))
+}
+
+func (m *Manager) saveContactCard(card *ContactCard) bool {
+	return card.Save(filepath.Join(m.dir, fmt.Sprintf(contactCardFileFormat, card.Name)))
+}
+
+func (c *ContactCard) signedData() []byte {
+	return signedFields(
+		[]byte(contactCardLabel),
+		[]byte(c.Name),
+		[]byte(c.DisplayName),
+		[]byte(c.Created.Format(time.RFC3339)),
+		[]byte(c.PublicKey.Type),
+		c.PublicKey.Bytes(),
+	)
+}
+
+// The display name is saved in a header of the card (one line).
+func isValidDisplayName(text string) bool {
+	if len(text) > maxDisplayNameLength {
+		return false
+	}
+	for _, c := range text {
+		if !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Fingerprints of the public keys and safety numbers
+// let partners check (e.g. over the phone) that they use the right keys.
+
+const (
+	fingerprintLabel    = "carmel fingerprint"
+	safetyNumberLabel   = "carmel safety number"
+	safetyNumberGroups  = 12
+	safetyNumberDigits  = 100000 // 5 digits in a group
+	verifiedKeysFile    = "verified_keys"
+	verifiedEntryFormat = "%s %s\n"
+)
+
+func (k *PublicKey) fingerprint() []byte {
+	hash := sha256.New()
+	hash.Write([]byte(fingerprintLabel))
+	hash.Write([]byte(k.Type))
+	hash.Write(k.Bytes())
+	return hash.Sum(nil)
+}
+
+// Fingerprint of the key: SHA-256 of its type and the public keys,
+// in groups of 4 hex digits.
+func (k *PublicKey) Fingerprint() string {
+	return groupFingerprint(hex.EncodeToString(k.fingerprint()))
+}
+
+func groupFingerprint(text string) string {
+	text = strings.ToUpper(text)
+	groups := make([]string, 0, len(text)/4+1)
+	for len(text) > 4 {
+		groups = append(groups, text[:4])
+		text = text[4:]
+	}
+	return strings.Join(append(groups, text), " ")
+}
+
+// Safety number of two partners: 60 digits (12 groups of 5) depending
+// on both names and keys. Both sides see the same number.
+func SafetyNumber(userName string, publicKey *PublicKey, buddyName string, buddyPublicKey *PublicKey) string {
+	first, second := append([]byte(userName+"\n"), publicKey.fingerprint()...), append([]byte(buddyName+"\n"), buddyPublicKey.fingerprint()...)
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	hash := sha512.New()
+	hash.Write([]byte(safetyNumberLabel))
+	hash.Write(first)
+	hash.Write(second)
+	sum := hash.Sum(nil)
+
+	groups := make([]string, 0, safetyNumberGroups)
+	for i := 0; i < safetyNumberGroups; i++ {
+		chunk := append([]byte{0, 0, 0}, sum[i*5:i*5+5]...)
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%safetyNumberDigits))
+	}
+	return strings.Join(groups, " ")
+}
+
+/********************************************************************
+*                                                                   *
+*                    V E R I F I E D   K E Y S                      *
+*                                                                   *
+********************************************************************/
+
+// The partner's key is verified when both sides compared the safety number.
+// Only the fingerprint is saved, a new key of the partner isn't verified.
+func (m *Manager) IsVerified(userName string, publicKey *PublicKey) bool {
+	fingerprint := hex.EncodeToString(publicKey.fingerprint())
+	return m.verifiedKeys()[userName] == fingerprint
+}
+
+func (m *Manager) SetVerified(userName string, publicKey *PublicKey, verified bool) bool {
+	keys := m.verifiedKeys()
+	if verified {
+		keys[userName] = hex.EncodeToString(publicKey.fingerprint())
+	} else {
+		delete(keys, userName)
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buffer bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buffer, verifiedEntryFormat, name, keys[name])
+	}
+	return saveFile(filepath.Join(m.dir, verifiedKeysFile), publicFileMode, buffer.Bytes())
+}
+
+func (m *Manager) verifiedKeys() map[string]string {
+	keys := make(map[string]string)
+	if file, err := os.Open(filepath.Join(m.dir, verifiedKeysFile)); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+				keys[fields[0]] = fields[1]
+			}
+		}
+	}
+	return keys
+}
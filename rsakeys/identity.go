@@ -0,0 +1,311 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/tr"
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+)
+
+// Type of the identity keys, recorded in the header of the PEM blocks.
+// Files without the header come from older programs (RSA keys).
+type KeyType string
+
+const (
+	RSA2048 KeyType = "rsa-2048"
+	RSA3072 KeyType = "rsa-3072"
+	RSA4096 KeyType = "rsa-4096"
+	Ed25519 KeyType = "ed25519"
+
+	// RSA keys can be used also by older programs.
+	DefaultKeyType = RSA3072
+)
+
+var (
+	KeyTypes   = []KeyType{RSA2048, RSA3072, RSA4096, Ed25519}
+	pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+)
+
+const (
+	keyTypeHeader     = "Key-Type"
+	keyUseHeader      = "Key-Use"
+	encryptionKeyUse  = "encryption"
+	pkcs8PrivateType  = "PRIVATE KEY"
+	x25519SeedLabel   = "carmel identity encryption key"
+	x25519PrivateSize = 32
+)
+
+func (t KeyType) IsValid() bool {
+	return t.rsaBits() != 0 || t == Ed25519
+}
+
+func (t KeyType) IsRSA() bool {
+	return t.rsaBits() != 0
+}
+
+func (t KeyType) rsaBits() int {
+	switch t {
+	case RSA2048:
+		return 2048
+	case RSA3072:
+		return 3072
+	case RSA4096:
+		return 4096
+	}
+	return 0
+}
+
+func rsaKeyType(bits int) KeyType {
+	for _, t := range KeyTypes {
+		if t.rsaBits() == bits {
+			return t
+		}
+	}
+	return ""
+}
+
+// Private identity keys of the user.
+// Ed25519 keys can only sign, so an Ed25519 identity has also
+// an X25519 key (derived from the Ed25519 seed) used for encryption.
+type PrivateKey struct {
+	Type    KeyType
+	RSA     *rsa.PrivateKey
+	Ed25519 ed25519.PrivateKey
+	X25519  *ecdh.PrivateKey
+}
+
+// Public identity keys of the user (see PrivateKey).
+type PublicKey struct {
+	Type    KeyType
+	RSA     *rsa.PublicKey
+	Ed25519 ed25519.PublicKey
+	X25519  *ecdh.PublicKey
+}
+
+func GenerateKey(keyType KeyType) *PrivateKey {
+	switch {
+	case keyType.IsRSA():
+		if privateKey, err := rsa.GenerateKey(rand.Reader, keyType.rsaBits()); tr.IsOK(err) {
+			return &PrivateKey{Type: keyType, RSA: privateKey}
+		}
+	case keyType == Ed25519:
+		if _, privateKey, err := ed25519.GenerateKey(rand.Reader); tr.IsOK(err) {
+			return newEd25519Key(privateKey)
+		}
+	}
+	return nil
+}
+
+func newEd25519Key(privateKey ed25519.PrivateKey) *PrivateKey {
+	seed := secret.HKDF(privateKey.Seed(), nil, []byte(x25519SeedLabel), x25519PrivateSize)
+	defer secret.ClearSlice(&seed)
+	if x25519Key, err := ecdh.X25519().NewPrivateKey(seed); tr.IsOK(err) {
+		return &PrivateKey{Type: Ed25519, Ed25519: privateKey, X25519: x25519Key}
+	}
+	return nil
+}
+
+func (k *PrivateKey) Public() *PublicKey {
+	if k.Type == Ed25519 {
+		return &PublicKey{Type: k.Type, Ed25519: k.Ed25519.Public().(ed25519.PublicKey), X25519: k.X25519.PublicKey()}
+	}
+	return &PublicKey{Type: k.Type, RSA: &k.RSA.PublicKey}
+}
+
+// Binary form of the public keys (used in signed data).
+func (k *PublicKey) Bytes() []byte {
+	if k.Type == Ed25519 {
+		return append(append([]byte{}, k.Ed25519...), k.X25519.Bytes()...)
+	}
+	return x509.MarshalPKCS1PublicKey(k.RSA)
+}
+
+// Signature of data published by the owner of the keys (e.g. a contact card).
+// RSA keys always use PSS here, these signatures aren't read by older programs.
+func (k *PrivateKey) Sign(data []byte) []byte {
+	if k.Type == Ed25519 {
+		return ed25519.Sign(k.Ed25519, data)
+	}
+	hash := sha512.Sum512(data)
+	if sign, err := rsa.SignPSS(rand.Reader, k.RSA, crypto.SHA512, hash[:], pssOptions); tr.IsOK(err) {
+		return sign
+	}
+	return nil
+}
+
+func (k *PublicKey) Verify(data, sign []byte) bool {
+	if k.Type == Ed25519 {
+		return ed25519.Verify(k.Ed25519, data, sign)
+	}
+	hash := sha512.Sum512(data)
+	return rsa.VerifyPSS(k.RSA, crypto.SHA512, hash[:], sign, pssOptions) == nil
+}
+
+// Signed data: all fields with their lengths, so they can't be shifted.
+func signedFields(fields ...[]byte) []byte {
+	var buffer bytes.Buffer
+	for _, field := range fields {
+		binary.Write(&buffer, binary.BigEndian, uint32(len(field)))
+		buffer.Write(field)
+	}
+	return buffer.Bytes()
+}
+
+/********************************************************************
+*                                                                   *
+*                            P E M                                  *
+*                                                                   *
+********************************************************************/
+
+// RSA keys are saved as before (PKCS#1), so older programs can read them,
+// Ed25519 keys as PKCS#8 (private) and PKIX (public).
+func privatePemFromKey(privateKey *PrivateKey) *pem.Block {
+	headers := map[string]string{keyTypeHeader: string(privateKey.Type)}
+	if privateKey.Type == Ed25519 {
+		if encoded, err := x509.MarshalPKCS8PrivateKey(privateKey.Ed25519); tr.IsOK(err) {
+			return &pem.Block{Type: pkcs8PrivateType, Headers: headers, Bytes: encoded}
+		}
+		return nil
+	}
+	if encoded := x509.MarshalPKCS1PrivateKey(privateKey.RSA); encoded != nil {
+		return &pem.Block{Type: privateKeyType, Headers: headers, Bytes: encoded}
+	}
+	return nil
+}
+
+// The public keys of an Ed25519 identity are saved in two blocks:
+// the signing key and the encryption key.
+func publicPemFromKey(publicKey *PublicKey) []*pem.Block {
+	headers := map[string]string{keyTypeHeader: string(publicKey.Type)}
+	if publicKey.Type == Ed25519 {
+		signing, err := x509.MarshalPKIXPublicKey(publicKey.Ed25519)
+		if !tr.IsOK(err) {
+			return nil
+		}
+		encryption, err := x509.MarshalPKIXPublicKey(publicKey.X25519)
+		if !tr.IsOK(err) {
+			return nil
+		}
+		return []*pem.Block{
+			{Type: publicKeyType, Headers: headers, Bytes: signing},
+			{Type: publicKeyType, Headers: map[string]string{keyTypeHeader: string(publicKey.Type), keyUseHeader: encryptionKeyUse}, Bytes: encryption},
+		}
+	}
+	if encoded := x509.MarshalPKCS1PublicKey(publicKey.RSA); encoded != nil {
+		return []*pem.Block{{Type: publicKeyType, Headers: headers, Bytes: encoded}}
+	}
+	return nil
+}
+
+// Public keys in the form of the key file.
+func (k *PublicKey) Pem() []byte {
+	var buffer bytes.Buffer
+	for _, block := range publicPemFromKey(k) {
+		if err := pem.Encode(&buffer, block); !tr.IsOK(err) {
+			return nil
+		}
+	}
+	return buffer.Bytes()
+}
+
+// The block must be decrypted before (see decryptPem).
+func privateKeyFromBlock(block *pem.Block) *PrivateKey {
+	if block == nil {
+		return nil
+	}
+	keyType := KeyType(block.Headers[keyTypeHeader])
+	switch {
+	case keyType == Ed25519 && block.Type == pkcs8PrivateType:
+		if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); tr.IsOK(err) {
+			if privateKey, ok := key.(ed25519.PrivateKey); ok {
+				return newEd25519Key(privateKey)
+			}
+		}
+	case (keyType == "" || keyType.IsRSA()) && block.Type == privateKeyType:
+		if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); tr.IsOK(err) {
+			if t := rsaKeyType(privateKey.N.BitLen()); t != "" && (keyType == "" || keyType == t) {
+				return &PrivateKey{Type: t, RSA: privateKey}
+			}
+		}
+	}
+	return nil
+}
+
+// Public keys in the form of the key file (see Pem).
+func PublicKeyFromPem(data []byte) *PublicKey {
+	publicKey, _ := publicKeyFromBlocks(data)
+	return publicKey
+}
+
+// Reads the blocks of one public key, returns also the data after them.
+func publicKeyFromBlocks(data []byte) (*PublicKey, []byte) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != publicKeyType {
+		return nil, data
+	}
+	keyType := KeyType(block.Headers[keyTypeHeader])
+	switch {
+	case keyType == Ed25519:
+		next, rest := pem.Decode(rest)
+		if next == nil || next.Type != publicKeyType || next.Headers[keyUseHeader] != encryptionKeyUse {
+			return nil, rest
+		}
+		signing, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if !tr.IsOK(err) {
+			return nil, rest
+		}
+		encryption, err := x509.ParsePKIXPublicKey(next.Bytes)
+		if !tr.IsOK(err) {
+			return nil, rest
+		}
+		signingKey, ok := signing.(ed25519.PublicKey)
+		encryptionKey, ok2 := encryption.(*ecdh.PublicKey)
+		if ok && ok2 && encryptionKey.Curve() == ecdh.X25519() {
+			return &PublicKey{Type: Ed25519, Ed25519: signingKey, X25519: encryptionKey}, rest
+		}
+		return nil, rest
+	case keyType == "" || keyType.IsRSA():
+		if publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes); tr.IsOK(err) {
+			if t := rsaKeyType(publicKey.N.BitLen()); t != "" && (keyType == "" || keyType == t) {
+				return &PublicKey{Type: t, RSA: publicKey}, rest
+			}
+		}
+	}
+	return nil, rest
+}
@@ -0,0 +1,162 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Known peers (like known_hosts of SSH): the fingerprint of every partner's key
+// is remembered at the first contact (trust on first use).
+// Each line of the file: name fingerprint first-seen (RFC 3339).
+
+const (
+	knownPeersFile   = "known_peers"
+	knownPeersFormat = "%s %s %s\n"
+)
+
+type PeerStatus uint8
+
+const (
+	NewPeer    PeerStatus = iota // first contact (see TrustPeer)
+	KnownPeer                    // the same key as before
+	ChangedKey                   // the key differs from the remembered one
+)
+
+type Peer struct {
+	Name        string
+	Fingerprint string // as PublicKey.Fingerprint
+	FirstSeen   time.Time
+}
+
+// Compares the partner's key with the remembered one.
+// Nothing is saved: the key of a new partner is remembered
+// with TrustPeer, a changed key with AcceptChangedKey
+// (both after the user agrees to talk).
+// Returns the status and the remembered data of the partner
+// (for a new one - the data TrustPeer would remember).
+func (m *Manager) CheckPeer(userName string, publicKey *PublicKey) (PeerStatus, *Peer, error) {
+	fingerprint := publicKey.Fingerprint()
+	peers, err := m.knownPeers()
+	if err != nil {
+		return ChangedKey, nil, err
+	}
+	for i := range peers {
+		if peers[i].Name == userName {
+			if peers[i].Fingerprint == fingerprint {
+				return KnownPeer, &peers[i], nil
+			}
+			return ChangedKey, &peers[i], nil
+		}
+	}
+	return NewPeer, &Peer{Name: userName, Fingerprint: fingerprint, FirstSeen: time.Now()}, nil
+}
+
+// The user agreed to talk with a new partner: the key is remembered.
+// A different key remembered before isn't replaced (see AcceptChangedKey).
+func (m *Manager) TrustPeer(userName string, publicKey *PublicKey) error {
+	status, peer, err := m.CheckPeer(userName, publicKey)
+	switch {
+	case err != nil:
+		return err
+	case status == KnownPeer:
+		return nil
+	case status == ChangedKey:
+		return fmt.Errorf("another key of %s is remembered", userName)
+	}
+	peers, _ := m.knownPeers()
+	if !m.saveKnownPeers(append(peers, *peer)) {
+		return fmt.Errorf("can't save %s", knownPeersFile)
+	}
+	return nil
+}
+
+// The user acknowledged the new key of the partner.
+// The old key is forgotten (with its verification).
+func (m *Manager) AcceptChangedKey(userName string, publicKey *PublicKey) bool {
+	peers, err := m.knownPeers()
+	if err != nil {
+		return false
+	}
+	peer := Peer{Name: userName, Fingerprint: publicKey.Fingerprint(), FirstSeen: time.Now()}
+	replaced := false
+	for i := range peers {
+		if peers[i].Name == userName {
+			peers[i] = peer
+			replaced = true
+		}
+	}
+	if !replaced {
+		peers = append(peers, peer)
+	}
+	return m.saveKnownPeers(peers) && m.SetVerified(userName, publicKey, false)
+}
+
+func (m *Manager) KnownPeers() []Peer {
+	peers, _ := m.knownPeers()
+	return peers
+}
+
+// A missing file means no known peers, other errors are returned.
+func (m *Manager) knownPeers() ([]Peer, error) {
+	file, err := os.Open(filepath.Join(m.dir, knownPeersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []Peer
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 3 {
+			if firstSeen, err := time.Parse(time.RFC3339, fields[2]); err == nil {
+				peers = append(peers, Peer{Name: fields[0], Fingerprint: groupFingerprint(fields[1]), FirstSeen: firstSeen})
+			}
+		}
+	}
+	return peers, scanner.Err()
+}
+
+func (m *Manager) saveKnownPeers(peers []Peer) bool {
+	var buffer bytes.Buffer
+	for _, peer := range peers {
+		fingerprint := strings.Replace(peer.Fingerprint, " ", "", -1)
+		fmt.Fprintf(&buffer, knownPeersFormat, peer.Name, fingerprint, peer.FirstSeen.UTC().Format(time.RFC3339))
+	}
+	return saveFile(filepath.Join(m.dir, knownPeersFile), publicFileMode, buffer.Bytes())
+}
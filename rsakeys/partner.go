@@ -0,0 +1,111 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package rsakeys
+
+import "fmt"
+
+// Decision about the partner's key after the login, shared by all user interfaces:
+// revocations and key transitions received from the partner are applied,
+// then the key (saved or received during the login) is checked against
+// the revocations, the saved key and the known peers.
+// The user interface only shows the verdict and asks the user,
+// the answers are saved with AcceptPartner.
+
+type Verdict struct {
+	Key          *PublicKey    // the partner's key for this session (nil - no key, refused)
+	Revocations  []*Revocation // revocations received from the partner (saved)
+	RotatedKey   *PublicKey    // new key endorsed by the saved one (it replaced the saved one)
+	Revoked      *Revocation   // the key is revoked: refused
+	DifferentKey bool          // the received key differs from the saved one: refused
+	Err          error         // the known peers can't be read: refused
+	SaveKey      bool          // the key was received: the user compares the fingerprint before it's saved
+	NewPeer      bool          // first contact (see TrustPeer)
+	ChangedKey   *Peer         // the remembered key differs: the user must accept the new one
+}
+
+// The connection must be refused (without asking the user).
+func (v *Verdict) IsRefused() bool {
+	return v.Key == nil || v.Revoked != nil || v.DifferentKey || v.Err != nil
+}
+
+// received - the partner's key received during the login (nil if there was no exchange).
+func (m *Manager) CheckPartner(userName string, received *PublicKey, transitions []*KeyTransition, revocations []*Revocation) *Verdict {
+	v := &Verdict{}
+	if revocations != nil {
+		v.Revocations = m.ImportRevocations(revocations)
+	}
+	if transitions != nil {
+		v.RotatedKey = m.ApplyKeyTransitions(userName, transitions)
+	}
+
+	// A revoked key can be replaced with the received one.
+	replacesRevoked := false
+	if received != nil {
+		v.Key = received
+		if !m.ExistPublicKeyFor(userName) {
+			v.SaveKey = true
+		} else if saved := m.PublicKeyFromFileForUser(userName); saved == nil || saved.Fingerprint() != received.Fingerprint() {
+			if m.RevocationOf(saved) == nil {
+				v.DifferentKey = true
+				return v
+			}
+			v.SaveKey, replacesRevoked = true, true
+		}
+	} else if v.Key = m.PublicKeyFromFileForUser(userName); v.Key == nil {
+		return v
+	}
+	if v.Revoked = m.RevocationOf(v.Key); v.Revoked != nil {
+		return v
+	}
+
+	status, peer, err := m.CheckPeer(userName, v.Key)
+	switch {
+	case err != nil:
+		v.Err = err
+	case status == NewPeer:
+		v.NewPeer = true
+	case status == ChangedKey && !replacesRevoked:
+		v.ChangedKey = peer
+	}
+	return v
+}
+
+// The user agreed to talk (after comparing the fingerprint of the received key
+// and accepting the changed key, if the verdict asked for it).
+func (m *Manager) AcceptPartner(userName string, v *Verdict) error {
+	if v.IsRefused() {
+		return fmt.Errorf("the key of %s is refused", userName)
+	}
+	if v.SaveKey && !m.SavePublicKeyForUser(userName, v.Key) {
+		return fmt.Errorf("the key of %s can't be saved", userName)
+	}
+	if v.ChangedKey != nil && !m.AcceptChangedKey(userName, v.Key) {
+		return fmt.Errorf("the new key of %s can't be remembered", userName)
+	}
+	return m.TrustPeer(userName, v.Key)
+}
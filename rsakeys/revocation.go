@@ -0,0 +1,236 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"Carmel/shared"
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Revocation certificate: the private key signs a statement that it must not be
+// used any more. It is created together with the keys (<name>_revocation_<fingerprint>.pem),
+// the user should store it offline and publish it (send it to the partners)
+// only when the private key is lost or compromised:
+//
+//	-----BEGIN CARMEL KEY REVOCATION-----
+//	Name, Created, Fingerprint (headers)
+//	signature made with the revoked key
+//	-----END CARMEL KEY REVOCATION-----
+//	revoked public key blocks (as in the key file)
+//
+// The certificate carries the revoked key, so anybody can check it. The certificates
+// imported by the user are kept in the revocations file and sent to the partners
+// at login, a revoked key is refused.
+
+const (
+	revocationType       = "CARMEL KEY REVOCATION"
+	revocationLabel      = "carmel key revocation"
+	revocationFileFormat = "%s_revocation_%s.pem"
+	revocationsFile      = "revocations.pem"
+)
+
+type Revocation struct {
+	Name        string
+	Fingerprint string // as PublicKey.Fingerprint
+	PublicKey   *PublicKey
+	Created     time.Time
+	Signature   []byte
+}
+
+func newRevocation(userName string, privateKey *PrivateKey) *Revocation {
+	r := &Revocation{
+		Name:      userName,
+		PublicKey: privateKey.Public(),
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+	r.Fingerprint = r.PublicKey.Fingerprint()
+	if r.Signature = privateKey.Sign(r.signedData()); r.Signature != nil {
+		return r
+	}
+	return nil
+}
+
+func (r *Revocation) Armor() []byte {
+	block := &pem.Block{
+		Type: revocationType,
+		Headers: map[string]string{
+			nameHeader:        r.Name,
+			createdHeader:     r.Created.Format(time.RFC3339),
+			fingerprintHeader: r.Fingerprint,
+		},
+		Bytes: r.Signature,
+	}
+	var buffer bytes.Buffer
+	if err := pem.Encode(&buffer, block); err != nil {
+		return nil
+	}
+	if key := r.PublicKey.Pem(); key != nil {
+		buffer.Write(key)
+		return buffer.Bytes()
+	}
+	return nil
+}
+
+func ArmorRevocations(revocations []*Revocation) []byte {
+	var buffer bytes.Buffer
+	for _, r := range revocations {
+		buffer.Write(r.Armor())
+	}
+	return buffer.Bytes()
+}
+
+// Reads all certificates from the text (other text around them is skipped).
+// Only certificates signed with the revoked key are returned.
+func ParseRevocations(data []byte) []*Revocation {
+	var revocations []*Revocation
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return revocations
+		}
+		data = rest
+		if block.Type != revocationType {
+			continue
+		}
+		publicKey, rest := publicKeyFromBlocks(data)
+		data = rest
+		created, err := time.Parse(time.RFC3339, block.Headers[createdHeader])
+		if err != nil || publicKey == nil {
+			continue
+		}
+		r := &Revocation{
+			Name:        block.Headers[nameHeader],
+			Fingerprint: block.Headers[fingerprintHeader],
+			PublicKey:   publicKey,
+			Created:     created,
+			Signature:   block.Bytes,
+		}
+		if r.isValid() {
+			revocations = append(revocations, r)
+		}
+	}
+}
+
+func RevocationsFromFile(filePath string) []*Revocation {
+	if data, err := ioutil.ReadFile(filePath); err == nil {
+		return ParseRevocations(data)
+	}
+	return nil
+}
+
+// Path of the certificate created together with the current keys of the user.
+func (m *Manager) RevocationPathFor(userName string) string {
+	if publicKey := m.PublicKeyFromFileForUser(userName); publicKey != nil {
+		return filepath.Join(m.dir, revocationFileName(userName, publicKey))
+	}
+	return ""
+}
+
+// Creates the certificate for the current keys of the user (keys created
+// by older versions have none). The private key must be unlocked.
+func (m *Manager) CreateRevocationForUser(userName string) bool {
+	if privateKey := m.PrivateKeyFromFileForUser(userName); privateKey != nil {
+		return m.saveRevocation(userName, privateKey)
+	}
+	return false
+}
+
+// Adds the certificates to the revocations file.
+// Returns the certificates which weren't known before.
+func (m *Manager) ImportRevocations(revocations []*Revocation) []*Revocation {
+	known := m.Revocations()
+	var added []*Revocation
+	for _, r := range revocations {
+		if r.isValid() && findRevocation(known, r.Fingerprint) == nil {
+			known = append(known, r)
+			added = append(added, r)
+		}
+	}
+	if added != nil && !saveFile(filepath.Join(m.dir, revocationsFile), publicFileMode, ArmorRevocations(known)) {
+		return nil
+	}
+	return added
+}
+
+// Certificates imported by the user (or received from the partners).
+func (m *Manager) Revocations() []*Revocation {
+	return RevocationsFromFile(filepath.Join(m.dir, revocationsFile))
+}
+
+// Returns the certificate which revokes the key (nil if the key isn't revoked).
+func (m *Manager) RevocationOf(publicKey *PublicKey) *Revocation {
+	if publicKey == nil {
+		return nil
+	}
+	return findRevocation(m.Revocations(), publicKey.Fingerprint())
+}
+
+func (m *Manager) saveRevocation(userName string, privateKey *PrivateKey) bool {
+	if r := newRevocation(userName, privateKey); r != nil {
+		if data := r.Armor(); data != nil {
+			return saveFile(filepath.Join(m.dir, revocationFileName(userName, r.PublicKey)), privateFileMode, data)
+		}
+	}
+	return false
+}
+
+// Every key has its own certificate, so the certificates of the older keys
+// are never overwritten.
+func revocationFileName(userName string, publicKey *PublicKey) string {
+	return fmt.Sprintf(revocationFileFormat, userName, hex.EncodeToString(publicKey.fingerprint()[:4]))
+}
+
+func findRevocation(revocations []*Revocation, fingerprint string) *Revocation {
+	for _, r := range revocations {
+		if r.Fingerprint == fingerprint {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Revocation) isValid() bool {
+	return shared.IsValidName(r.Name) && r.PublicKey != nil && r.Fingerprint == r.PublicKey.Fingerprint() && r.PublicKey.Verify(r.signedData(), r.Signature)
+}
+
+func (r *Revocation) signedData() []byte {
+	return signedFields(
+		[]byte(revocationLabel),
+		[]byte(r.Name),
+		[]byte(r.Created.Format(time.RFC3339)),
+		[]byte(r.PublicKey.Type),
+		r.PublicKey.Bytes(),
+	)
+}
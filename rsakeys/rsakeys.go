@@ -31,12 +31,11 @@ package rsakeys
 import (
 	"Carmel/shared"
 	"Carmel/shared/tr"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"bytes"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -47,7 +46,8 @@ const (
 	publicKeyType            = "PUBLIC KEY"
 	privateKeyFileNameFormat = "%s_priv.pem"
 	publicKeyFileNameFormat  = "%s_public.pem"
-	keySize                  = 2048
+	privateFileMode          = 0600
+	publicFileMode           = 0644
 )
 
 type Manager struct {
@@ -90,7 +90,13 @@ func getUserNameFromFileName(text string) string {
 	return ""
 }
 
+// New keys created after removing are not endorsed by the old ones,
+// so the statements of earlier rotations (see transition.go) are removed too.
 func (m *Manager) RemoveKeysFor(userName string) bool {
+	setUnlockedKey(userName, nil)
+	if path := filepath.Join(m.dir, fmt.Sprintf(transitionsFileFormat, userName)); shared.ExistsFile(path) {
+		shared.RemoveFile(path)
+	}
 	return m.RemovePrivateKeyFor(userName) && m.RemovePublicKeyFor(userName)
 }
 
@@ -114,15 +120,29 @@ func (m *Manager) ExistPublicKeyFor(userName string) bool {
 	return shared.ExistsFile(path)
 }
 
-func (m *Manager) CreateKeysForUser(userName string) bool {
-	if privateKey, err := rsa.GenerateKey(rand.Reader, keySize); tr.IsOK(err) {
+// Creates the keys of the default type.
+// The private key is encrypted with the passphrase (if it isn't empty).
+func (m *Manager) CreateKeysForUser(userName, passphrase string) bool {
+	return m.CreateKeysOfTypeForUser(userName, DefaultKeyType, passphrase)
+}
+
+func (m *Manager) CreateKeysOfTypeForUser(userName string, keyType KeyType, passphrase string) bool {
+	if privateKey := GenerateKey(keyType); privateKey != nil {
 		privatePem := privatePemFromKey(privateKey)
-		publicPem := publicPemFromKey(privateKey.PublicKey)
+		publicPem := publicPemFromKey(privateKey.Public())
+		if privatePem != nil && passphrase != "" {
+			privatePem = encryptPem(privatePem, passphrase)
+		}
 		if privatePem != nil && publicPem != nil {
 			privateKeyFilePath := filepath.Join(m.dir, fmt.Sprintf(privateKeyFileNameFormat, userName))
 			publicKeyFilePath := filepath.Join(m.dir, fmt.Sprintf(publicKeyFileNameFormat, userName))
-			if savePemToFile(privateKeyFilePath, privatePem) && savePemToFile(publicKeyFilePath, publicPem) {
-				return true
+			if savePemToFile(privateKeyFilePath, privateFileMode, privatePem) && savePemToFile(publicKeyFilePath, publicFileMode, publicPem...) {
+				if m.saveRevocation(userName, privateKey) {
+					if passphrase != "" {
+						setUnlockedKey(userName, privateKey)
+					}
+					return true
+				}
 			}
 			shared.RemoveFile(privateKeyFilePath)
 			shared.RemoveFile(publicKeyFilePath)
@@ -131,58 +151,87 @@ func (m *Manager) CreateKeysForUser(userName string) bool {
 	return false
 }
 
-func (m *Manager) PrivateKeyFromFileForUser(userName string) *rsa.PrivateKey {
-	filePath := filepath.Join(m.dir, fmt.Sprintf(privateKeyFileNameFormat, userName))
-	if data, err := ioutil.ReadFile(filePath); tr.IsOK(err) {
-		//tr.Info("%s\n%s", userName, string(data))
-		if block, _ := pem.Decode(data); block != nil && block.Type == privateKeyType {
-			if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); tr.IsOK(err) {
+// An encrypted private key is available only after Unlock.
+func (m *Manager) PrivateKeyFromFileForUser(userName string) *PrivateKey {
+	if block := m.privatePemBlock(userName); block != nil {
+		if block.Type == encryptedKeyType {
+			if privateKey := unlockedKey(userName); privateKey != nil {
 				return privateKey
 			}
+			log.Printf("private key of %s is locked\n", userName)
+			return nil
 		}
+		return privateKeyFromBlock(block)
 	}
 	return nil
 }
 
-func (m *Manager) PublicKeyFromFileForUser(userName string) *rsa.PublicKey {
+func (m *Manager) PublicKeyFromFileForUser(userName string) *PublicKey {
 	filePath := filepath.Join(m.dir, fmt.Sprintf(publicKeyFileNameFormat, userName))
 	if data, err := ioutil.ReadFile(filePath); tr.IsOK(err) {
-		//tr.Info("%s\n%s", userName, string(data))
-		if block, _ := pem.Decode(data); block != nil && block.Type == publicKeyType {
-			if publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes); tr.IsOK(err) {
-				return publicKey
-			}
-		}
+		return PublicKeyFromPem(data)
 	}
 	return nil
 }
 
-func privatePemFromKey(privateKey *rsa.PrivateKey) *pem.Block {
-	if encoded := x509.MarshalPKCS1PrivateKey(privateKey); encoded != nil {
-		return &pem.Block{Type: privateKeyType, Bytes: encoded}
+// Saves the public key of the partner received during the first contact.
+// A different key saved before isn't replaced (see AcceptChangedKey),
+// unless it is revoked (see revocation.go).
+func (m *Manager) SavePublicKeyForUser(userName string, publicKey *PublicKey) bool {
+	replaced := false
+	if m.ExistPublicKeyFor(userName) {
+		current := m.PublicKeyFromFileForUser(userName)
+		if current != nil && current.Fingerprint() == publicKey.Fingerprint() {
+			return true
+		}
+		if m.RevocationOf(current) == nil {
+			log.Printf("public key of %s already exists\n", userName)
+			return false
+		}
+		replaced = true
+	}
+	if blocks := publicPemFromKey(publicKey); blocks != nil {
+		filePath := filepath.Join(m.dir, fmt.Sprintf(publicKeyFileNameFormat, userName))
+		return savePemToFile(filePath, publicFileMode, blocks...) && (!replaced || m.AcceptChangedKey(userName, publicKey))
+	}
+	return false
+}
+
+func (m *Manager) privatePemBlock(userName string) *pem.Block {
+	filePath := filepath.Join(m.dir, fmt.Sprintf(privateKeyFileNameFormat, userName))
+	if data, err := ioutil.ReadFile(filePath); tr.IsOK(err) {
+		block, _ := pem.Decode(data)
+		return block
 	}
 	return nil
 }
 
-func publicPemFromKey(publicKey rsa.PublicKey) *pem.Block {
-	if encoded := x509.MarshalPKCS1PublicKey(&publicKey); encoded != nil {
-		return &pem.Block{Type: publicKeyType, Bytes: encoded}
+func (m *Manager) savePrivatePem(userName string, block *pem.Block) bool {
+	if block != nil {
+		filePath := filepath.Join(m.dir, fmt.Sprintf(privateKeyFileNameFormat, userName))
+		return savePemToFile(filePath, privateFileMode, block)
 	}
-	return nil
+	return false
 }
 
-func savePemToFile(filePath string, pemBlock *pem.Block) bool {
-	if shared.ExistsFile(filePath) {
-		if !shared.RemoveFile(filePath) {
+func savePemToFile(filePath string, mode os.FileMode, pemBlocks ...*pem.Block) bool {
+	var buffer bytes.Buffer
+	for _, pemBlock := range pemBlocks {
+		if err := pem.Encode(&buffer, pemBlock); !tr.IsOK(err) {
 			return false
 		}
 	}
+	return saveFile(filePath, mode, buffer.Bytes())
+}
 
-	if file, err := os.Create(filePath); tr.IsOK(err) {
-		defer file.Close()
-		if err := pem.Encode(file, pemBlock); tr.IsOK(err) {
+// The file is replaced at once (the old one is kept if saving fails).
+func saveFile(filePath string, mode os.FileMode, data []byte) bool {
+	tmpFilePath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpFilePath, data, mode); tr.IsOK(err) {
+		if err := os.Rename(tmpFilePath, filePath); tr.IsOK(err) {
 			return true
 		}
+		shared.RemoveFile(tmpFilePath)
 	}
 	return false
 }
@@ -0,0 +1,491 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KeyTypes(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	for _, keyType := range KeyTypes {
+		assert.True(t, m.CreateKeysOfTypeForUser("ala", keyType, ""), keyType)
+
+		privateKey := m.PrivateKeyFromFileForUser("ala")
+		publicKey := m.PublicKeyFromFileForUser("ala")
+		if !assert.NotNil(t, privateKey, keyType) || !assert.NotNil(t, publicKey, keyType) {
+			continue
+		}
+		assert.Equal(t, keyType, privateKey.Type)
+		assert.Equal(t, keyType, publicKey.Type)
+		assert.Equal(t, privateKey.Public().Bytes(), publicKey.Bytes())
+		if keyType.IsRSA() {
+			assert.Equal(t, keyType.rsaBits(), publicKey.RSA.N.BitLen())
+		}
+	}
+	assert.False(t, m.CreateKeysOfTypeForUser("ala", "dsa-1024", ""))
+}
+
+// Keys saved by older programs (without the key type).
+func Test_LegacyKeys(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	assert.True(t, savePemToFile(filepath.Join(m.dir, "ala_priv.pem"), privateFileMode,
+		&pem.Block{Type: privateKeyType, Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}))
+	assert.True(t, savePemToFile(filepath.Join(m.dir, "ala_public.pem"), publicFileMode,
+		&pem.Block{Type: publicKeyType, Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)}))
+
+	if loaded := m.PrivateKeyFromFileForUser("ala"); assert.NotNil(t, loaded) {
+		assert.Equal(t, RSA2048, loaded.Type)
+	}
+	if loaded := m.PublicKeyFromFileForUser("ala"); assert.NotNil(t, loaded) {
+		assert.Equal(t, RSA2048, loaded.Type)
+	}
+
+	// The key type must match the key.
+	data, err := ioutil.ReadFile(filepath.Join(m.dir, "ala_public.pem"))
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	block.Headers = map[string]string{keyTypeHeader: string(RSA4096)}
+	assert.Nil(t, PublicKeyFromPem(pem.EncodeToMemory(block)))
+}
+
+func Test_Passphrase(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	assert.True(t, m.CreateKeysOfTypeForUser("ala", Ed25519, "kot"))
+	assert.True(t, m.IsPrivateKeyEncryptedFor("ala"))
+	publicKey := m.PublicKeyFromFileForUser("ala")
+
+	data, err := ioutil.ReadFile(filepath.Join(m.dir, "ala_priv.pem"))
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	assert.Equal(t, encryptedKeyType, block.Type)
+	// The headers are authenticated.
+	block.Headers[keyTypeHeader] = string(RSA2048)
+	assert.Nil(t, decryptPem(block, "kot"))
+
+	setUnlockedKey("ala", nil)
+	assert.Nil(t, m.PrivateKeyFromFileForUser("ala"))
+	assert.False(t, m.Unlock("ala", "pies"))
+	assert.True(t, m.Unlock("ala", "kot"))
+	if privateKey := m.PrivateKeyFromFileForUser("ala"); assert.NotNil(t, privateKey) {
+		assert.Equal(t, publicKey.Bytes(), privateKey.Public().Bytes())
+	}
+
+	assert.False(t, m.ChangePassphrase("ala", "pies", "mysz"))
+	assert.False(t, m.ChangePassphrase("ala", "kot", ""))
+	assert.True(t, m.ChangePassphrase("ala", "kot", "mysz"))
+	assert.False(t, m.Unlock("ala", "kot"))
+	assert.True(t, m.Unlock("ala", "mysz"))
+	// Only plain keys are migrated.
+	assert.False(t, m.ProtectPrivateKey("ala", "kot"))
+}
+
+func Test_ProtectPrivateKey(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	assert.True(t, m.CreateKeysOfTypeForUser("ala", RSA2048, ""))
+	assert.False(t, m.IsPrivateKeyEncryptedFor("ala"))
+	privateKey := m.PrivateKeyFromFileForUser("ala")
+	assert.NotNil(t, privateKey)
+
+	assert.False(t, m.ProtectPrivateKey("ala", ""))
+	assert.True(t, m.ProtectPrivateKey("ala", "kot"))
+	assert.True(t, m.IsPrivateKeyEncryptedFor("ala"))
+	setUnlockedKey("ala", nil)
+	assert.True(t, m.Unlock("ala", "kot"))
+	assert.Equal(t, privateKey.RSA, m.PrivateKeyFromFileForUser("ala").RSA)
+}
+
+func Test_Fingerprint(t *testing.T) {
+	ala, ola := GenerateKey(Ed25519).Public(), GenerateKey(RSA2048).Public()
+	assert.Equal(t, ala.Fingerprint(), ala.Fingerprint())
+	assert.NotEqual(t, ala.Fingerprint(), ola.Fingerprint())
+	assert.Len(t, ala.Fingerprint(), 16*4+15)
+
+	number := SafetyNumber("ala", ala, "ola", ola)
+	assert.Equal(t, number, SafetyNumber("ola", ola, "ala", ala))
+	assert.Regexp(t, `^\d{5}( \d{5}){11}$`, number)
+	assert.NotEqual(t, number, SafetyNumber("ala", ala, "ewa", ola))
+	assert.NotEqual(t, number, SafetyNumber("ala", ala, "ola", GenerateKey(Ed25519).Public()))
+
+	m := &Manager{dir: t.TempDir()}
+	assert.False(t, m.IsVerified("ola", ola))
+	assert.True(t, m.SetVerified("ola", ola, true))
+	assert.True(t, m.SetVerified("ala", ala, true))
+	assert.True(t, m.IsVerified("ola", ola))
+	// A new key of the partner must be verified again.
+	assert.False(t, m.IsVerified("ola", ala))
+	assert.True(t, m.SetVerified("ola", ola, false))
+	assert.False(t, m.IsVerified("ola", ola))
+	assert.True(t, m.IsVerified("ala", ala))
+}
+
+func Test_KnownPeers(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	ola, other := GenerateKey(Ed25519).Public(), GenerateKey(Ed25519).Public()
+
+	// A new key is remembered only when the user trusts it.
+	status, peer, err := m.CheckPeer("ola", ola)
+	assert.NoError(t, err)
+	assert.Equal(t, NewPeer, status)
+	assert.Equal(t, ola.Fingerprint(), peer.Fingerprint)
+	status, _, _ = m.CheckPeer("ola", ola)
+	assert.Equal(t, NewPeer, status)
+	assert.Empty(t, m.KnownPeers())
+
+	assert.NoError(t, m.TrustPeer("ola", ola))
+	status, peer, _ = m.CheckPeer("ola", ola)
+	assert.Equal(t, KnownPeer, status)
+	assert.Equal(t, ola.Fingerprint(), peer.Fingerprint)
+	firstSeen := peer.FirstSeen
+	assert.NoError(t, m.TrustPeer("ola", ola))
+	_, peer, _ = m.CheckPeer("ola", ola)
+	assert.Equal(t, firstSeen.Unix(), peer.FirstSeen.Unix())
+
+	// A changed key is reported until the user accepts it.
+	assert.True(t, m.SetVerified("ola", ola, true))
+	status, peer, _ = m.CheckPeer("ola", other)
+	assert.Equal(t, ChangedKey, status)
+	assert.Equal(t, ola.Fingerprint(), peer.Fingerprint)
+	assert.Error(t, m.TrustPeer("ola", other))
+	status, _, _ = m.CheckPeer("ola", other)
+	assert.Equal(t, ChangedKey, status)
+
+	assert.True(t, m.AcceptChangedKey("ola", other))
+	status, _, _ = m.CheckPeer("ola", other)
+	assert.Equal(t, KnownPeer, status)
+	assert.False(t, m.IsVerified("ola", other))
+	assert.Len(t, m.KnownPeers(), 1)
+
+	// The file can't be read: an error, not a changed key.
+	broken := &Manager{dir: t.TempDir()}
+	assert.NoError(t, os.Mkdir(filepath.Join(broken.dir, knownPeersFile), 0700))
+	_, _, err = broken.CheckPeer("ola", ola)
+	assert.Error(t, err)
+	assert.Error(t, broken.TrustPeer("ola", ola))
+}
+
+func Test_CheckPartner(t *testing.T) {
+	owner := &Manager{dir: t.TempDir()}
+	assert.True(t, owner.CreateKeysOfTypeForUser("ola", Ed25519, ""))
+	first := owner.PublicKeyFromFileForUser("ola")
+	revocations := RevocationsFromFile(owner.RevocationPathFor("ola"))
+	m := &Manager{dir: t.TempDir()}
+
+	// Without a key the connection is refused.
+	v := m.CheckPartner("ola", nil, nil, nil)
+	assert.True(t, v.IsRefused())
+	assert.Error(t, m.AcceptPartner("ola", v))
+
+	// The received key is saved and remembered only when the user agrees.
+	v = m.CheckPartner("ola", first, nil, nil)
+	assert.False(t, v.IsRefused())
+	assert.True(t, v.SaveKey)
+	assert.True(t, v.NewPeer)
+	assert.False(t, m.ExistPublicKeyFor("ola"))
+	assert.Empty(t, m.KnownPeers())
+	assert.NoError(t, m.AcceptPartner("ola", v))
+	v = m.CheckPartner("ola", first, nil, nil)
+	assert.False(t, v.SaveKey || v.NewPeer || v.IsRefused())
+	assert.Nil(t, v.ChangedKey)
+
+	// Another received key doesn't replace the saved one.
+	other := GenerateKey(Ed25519).Public()
+	v = m.CheckPartner("ola", other, nil, nil)
+	assert.True(t, v.DifferentKey)
+	assert.True(t, v.IsRefused())
+
+	// A saved key which differs from the remembered one must be accepted.
+	changed := &Manager{dir: t.TempDir()}
+	assert.True(t, changed.SavePublicKeyForUser("ola", other))
+	assert.NoError(t, changed.TrustPeer("ola", first))
+	v = changed.CheckPartner("ola", nil, nil, nil)
+	if assert.NotNil(t, v.ChangedKey) {
+		assert.Equal(t, first.Fingerprint(), v.ChangedKey.Fingerprint)
+	}
+	assert.NoError(t, changed.AcceptPartner("ola", v))
+	assert.Nil(t, changed.CheckPartner("ola", nil, nil, nil).ChangedKey)
+
+	// A key rotated by the owner replaces the saved one.
+	assert.True(t, owner.RotateKeysForUser("ola", Ed25519, ""))
+	last := owner.PublicKeyFromFileForUser("ola")
+	v = m.CheckPartner("ola", nil, owner.KeyTransitionsFor("ola"), nil)
+	if assert.NotNil(t, v.RotatedKey) {
+		assert.Equal(t, last.Fingerprint(), v.RotatedKey.Fingerprint())
+		assert.Equal(t, last.Fingerprint(), v.Key.Fingerprint())
+	}
+	assert.Nil(t, v.ChangedKey)
+
+	// The revoked key is refused, the received one may replace it
+	// (the user compares its fingerprint only).
+	revoked := &Manager{dir: t.TempDir()}
+	assert.True(t, revoked.SavePublicKeyForUser("ola", first))
+	assert.NoError(t, revoked.TrustPeer("ola", first))
+	v = revoked.CheckPartner("ola", nil, nil, revocations)
+	assert.Len(t, v.Revocations, 1)
+	assert.NotNil(t, v.Revoked)
+	assert.True(t, v.IsRefused())
+	v = revoked.CheckPartner("ola", last, nil, nil)
+	assert.True(t, v.SaveKey)
+	assert.Nil(t, v.ChangedKey)
+	assert.NoError(t, revoked.AcceptPartner("ola", v))
+	assert.Equal(t, last.Fingerprint(), revoked.PublicKeyFromFileForUser("ola").Fingerprint())
+	status, _, _ := revoked.CheckPeer("ola", last)
+	assert.Equal(t, KnownPeer, status)
+}
+
+func Test_SavePublicKey(t *testing.T) {
+	m := &Manager{dir: t.TempDir()}
+	for _, keyType := range KeyTypes {
+		key := GenerateKey(keyType).Public()
+		received := PublicKeyFromPem(key.Pem())
+		if assert.NotNil(t, received, keyType) {
+			assert.Equal(t, key.Fingerprint(), received.Fingerprint(), keyType)
+		}
+	}
+
+	ola, other := GenerateKey(Ed25519).Public(), GenerateKey(RSA2048).Public()
+	assert.True(t, m.SavePublicKeyForUser("ola", ola))
+	assert.True(t, m.SavePublicKeyForUser("ola", ola))
+	// A saved key isn't replaced.
+	assert.False(t, m.SavePublicKeyForUser("ola", other))
+	assert.Equal(t, ola.Fingerprint(), m.PublicKeyFromFileForUser("ola").Fingerprint())
+}
+
+func Test_ContactCard(t *testing.T) {
+	owner := &Manager{dir: t.TempDir()}
+	for _, keyType := range []KeyType{RSA2048, Ed25519} {
+		assert.True(t, owner.CreateKeysOfTypeForUser("ola", keyType, ""))
+		card := owner.ContactCardForUser("ola", " Ola Nowak ")
+		if !assert.NotNil(t, card, keyType) {
+			continue
+		}
+		assert.Equal(t, "Ola Nowak", card.DisplayName)
+
+		// Text around the card (e.g. an e-mail) is skipped.
+		text := append([]byte("Hi, here is my card:\n\n"), card.Armor()...)
+		parsed := ParseContactCard(append(text, "\nBye\n"...))
+		if assert.NotNil(t, parsed, keyType) {
+			assert.Equal(t, card.Name, parsed.Name)
+			assert.Equal(t, card.DisplayName, parsed.DisplayName)
+			assert.Equal(t, card.Fingerprint, parsed.Fingerprint)
+			assert.True(t, card.Created.Equal(parsed.Created))
+		}
+
+		// Any change breaks the signature.
+		for _, change := range [][2]string{{"Name: ola", "Name: ala"}, {"Display-Name: Ola", "Display-Name: Ala"}, {"Created: 2", "Created: 1"}} {
+			modified := bytes.Replace(card.Armor(), []byte(change[0]), []byte(change[1]), 1)
+			assert.Nil(t, ParseContactCard(modified), change)
+		}
+		other := GenerateKey(keyType).Public()
+		modified := append(bytes.SplitAfter(card.Armor(), []byte("-----END "+contactCardType+"-----\n"))[0], other.Pem()...)
+		assert.Nil(t, ParseContactCard(modified))
+
+		filePath := filepath.Join(t.TempDir(), "ola"+ContactCardExtension)
+		assert.True(t, card.Save(filePath))
+		peer := &Manager{dir: t.TempDir()}
+		assert.Equal(t, CardImported, peer.ImportContactCard(ContactCardFromFile(filePath)))
+		assert.Equal(t, card.Fingerprint, peer.PublicKeyFromFileForUser("ola").Fingerprint())
+		assert.Equal(t, CardKnown, peer.ImportContactCard(card))
+		assert.Equal(t, card.DisplayName, peer.ContactCardFor("ola").DisplayName)
+
+		// A new key of the same user doesn't replace the installed one.
+		assert.True(t, owner.RemoveKeysFor("ola"))
+		assert.True(t, owner.CreateKeysOfTypeForUser("ola", keyType, ""))
+		assert.Equal(t, CardKeyConflict, peer.ImportContactCard(owner.ContactCardForUser("ola", "")))
+		assert.Equal(t, card.Fingerprint, peer.PublicKeyFromFileForUser("ola").Fingerprint())
+		assert.True(t, owner.RemoveKeysFor("ola"))
+	}
+	assert.Equal(t, CardInvalid, owner.ImportContactCard(nil))
+}
+
+func Test_KeyRotation(t *testing.T) {
+	owner := &Manager{dir: t.TempDir()}
+	assert.True(t, owner.CreateKeysOfTypeForUser("ola", RSA2048, ""))
+	first := owner.PublicKeyFromFileForUser("ola")
+	assert.Nil(t, owner.KeyTransitionsFor("ola"))
+
+	peer := &Manager{dir: t.TempDir()}
+	assert.True(t, peer.SavePublicKeyForUser("ola", first))
+	assert.NoError(t, peer.TrustPeer("ola", first))
+	assert.True(t, peer.SetVerified("ola", first, true))
+
+	// Two rotations, the second one with a passphrase.
+	assert.True(t, owner.RotateKeysForUser("ola", Ed25519, ""))
+	assert.True(t, owner.RotateKeysForUser("ola", RSA2048, "kot"))
+	last := owner.PublicKeyFromFileForUser("ola")
+	assert.Equal(t, last.Fingerprint(), owner.PrivateKeyFromFileForUser("ola").Public().Fingerprint())
+	transitions := owner.KeyTransitionsFor("ola")
+	assert.Len(t, transitions, 2)
+
+	// The chain is followed in any order (as received).
+	received := ParseKeyTransitions(ArmorKeyTransitions([]*KeyTransition{transitions[1], transitions[0]}))
+	assert.Equal(t, last.Fingerprint(), FollowKeyTransitions(first, "ola", received).Fingerprint())
+	assert.Equal(t, first.Fingerprint(), FollowKeyTransitions(first, "ala", received).Fingerprint())
+	assert.False(t, transitions[1].IsSignedWith(first))
+
+	// Somebody else's key can't be endorsed.
+	other := GenerateKey(Ed25519)
+	forged := newKeyTransition("ola", other, GenerateKey(Ed25519).Public())
+	assert.Equal(t, first.Fingerprint(), FollowKeyTransitions(first, "ola", []*KeyTransition{forged}).Fingerprint())
+	modified := *transitions[0]
+	modified.NewKey = other.Public()
+	assert.Equal(t, first.Fingerprint(), FollowKeyTransitions(first, "ola", []*KeyTransition{&modified}).Fingerprint())
+
+	// The partner replaces the saved key, the verification is passed on.
+	if newKey := peer.ApplyKeyTransitions("ola", received); assert.NotNil(t, newKey) {
+		assert.Equal(t, last.Fingerprint(), newKey.Fingerprint())
+	}
+	assert.Equal(t, last.Fingerprint(), peer.PublicKeyFromFileForUser("ola").Fingerprint())
+	assert.True(t, peer.IsVerified("ola", last))
+	status, _, _ := peer.CheckPeer("ola", last)
+	assert.Equal(t, KnownPeer, status)
+	assert.Nil(t, peer.ApplyKeyTransitions("ola", received))
+
+	// New keys created from scratch aren't endorsed.
+	assert.True(t, owner.RemoveKeysFor("ola"))
+	assert.Nil(t, owner.KeyTransitionsFor("ola"))
+}
+
+func Test_Revocation(t *testing.T) {
+	owner := &Manager{dir: t.TempDir()}
+	assert.True(t, owner.CreateKeysOfTypeForUser("ola", Ed25519, "kot"))
+	first := owner.PublicKeyFromFileForUser("ola")
+	card := owner.ContactCardForUser("ola", "")
+	revocations := RevocationsFromFile(owner.RevocationPathFor("ola"))
+	if assert.Len(t, revocations, 1) {
+		assert.Equal(t, "ola", revocations[0].Name)
+		assert.Equal(t, first.Fingerprint(), revocations[0].Fingerprint)
+	}
+
+	// Every key gets its own certificate.
+	firstPath := owner.RevocationPathFor("ola")
+	assert.True(t, owner.RotateKeysForUser("ola", RSA2048, "kot"))
+	assert.NotEqual(t, firstPath, owner.RevocationPathFor("ola"))
+	assert.Len(t, RevocationsFromFile(firstPath), 1)
+	transitions := owner.KeyTransitionsFor("ola")
+
+	peer := &Manager{dir: t.TempDir()}
+	assert.True(t, peer.SavePublicKeyForUser("ola", first))
+	assert.NoError(t, peer.TrustPeer("ola", first))
+	assert.Nil(t, peer.RevocationOf(first))
+
+	// Certificates of somebody else's key or with another name are refused.
+	other := newRevocation("ola", GenerateKey(Ed25519))
+	other.PublicKey = first
+	other.Fingerprint = first.Fingerprint()
+	renamed := *revocations[0]
+	renamed.Name = "ala"
+	assert.Nil(t, ParseRevocations(ArmorRevocations([]*Revocation{other, &renamed})))
+	assert.Nil(t, peer.ImportRevocations([]*Revocation{other, &renamed}))
+
+	// Other text around the certificate is skipped, a known one isn't added again.
+	text := append([]byte("revoked:\n"), ArmorRevocations(revocations)...)
+	assert.Len(t, peer.ImportRevocations(ParseRevocations(text)), 1)
+	assert.Nil(t, peer.ImportRevocations(ParseRevocations(text)))
+	if r := peer.RevocationOf(first); assert.NotNil(t, r) {
+		assert.Equal(t, "ola", r.Name)
+	}
+
+	// The revoked key can't endorse a new one nor be imported again...
+	assert.Nil(t, peer.ApplyKeyTransitions("ola", transitions))
+	assert.Equal(t, CardRevoked, peer.ImportContactCard(card))
+
+	// ...but it can be replaced with a new one.
+	last := owner.PublicKeyFromFileForUser("ola")
+	assert.True(t, peer.SavePublicKeyForUser("ola", last))
+	status, _, _ := peer.CheckPeer("ola", last)
+	assert.Equal(t, KnownPeer, status)
+	assert.Nil(t, peer.RevocationOf(last))
+}
+
+func Test_Backup(t *testing.T) {
+	owner := &Manager{dir: t.TempDir()}
+	assert.True(t, owner.CreateKeysOfTypeForUser("ola", Ed25519, "kot"))
+	peerKey := GenerateKey(RSA2048).Public()
+	assert.True(t, owner.SavePublicKeyForUser("ala", peerKey))
+	assert.NoError(t, owner.TrustPeer("ala", peerKey))
+	assert.True(t, owner.SetVerified("ala", peerKey, true))
+	assert.Nil(t, owner.Backup(""))
+	data := owner.Backup("pies")
+	assert.NotNil(t, data)
+
+	// A new machine: everything is restored, the private key keeps its passphrase.
+	other := &Manager{dir: filepath.Join(t.TempDir(), "rsa_keys")}
+	assert.NoError(t, os.Mkdir(other.dir, 0700))
+	assert.Equal(t, BackupInvalid, other.RestoreBackup(data, "kot", false))
+	assert.Equal(t, BackupRestored, other.RestoreBackup(data, "pies", false))
+	assert.True(t, other.IsPrivateKeyEncryptedFor("ola"))
+	assert.True(t, other.Unlock("ola", "kot"))
+	assert.True(t, other.IsVerified("ala", peerKey))
+	status, _, _ := other.CheckPeer("ala", peerKey)
+	assert.Equal(t, KnownPeer, status)
+	assert.Len(t, RevocationsFromFile(other.RevocationPathFor("ola")), 1)
+	if info, err := os.Stat(filepath.Join(other.dir, "ola_priv.pem")); assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(privateFileMode), info.Mode().Perm())
+	}
+
+	// The same backup again changes nothing.
+	assert.Equal(t, BackupRestored, other.RestoreBackup(data, "pies", false))
+
+	// Modified headers or contents are detected, newer versions aren't restored.
+	block, _ := pem.Decode(data)
+	block.Headers[createdHeader] = "2019-12-01T10:00:00Z"
+	assert.Equal(t, BackupInvalid, other.RestoreBackup(pem.EncodeToMemory(block), "pies", false))
+	block, _ = pem.Decode(data)
+	block.Bytes[len(block.Bytes)-1] ^= 1
+	assert.Equal(t, BackupInvalid, other.RestoreBackup(pem.EncodeToMemory(block), "pies", false))
+	block, _ = pem.Decode(data)
+	block.Headers[versionHeader] = "2"
+	assert.Equal(t, BackupUnsupported, other.RestoreBackup(pem.EncodeToMemory(block), "pies", false))
+
+	// Another identity is never overwritten silently,
+	// with replace it's moved aside.
+	third := &Manager{dir: filepath.Join(t.TempDir(), "rsa_keys")}
+	assert.NoError(t, os.Mkdir(third.dir, 0700))
+	assert.True(t, third.CreateKeysOfTypeForUser("ela", Ed25519, ""))
+	assert.Equal(t, BackupConflict, third.RestoreBackup(data, "pies", false))
+	assert.False(t, third.ExistPrivateKeyFor("ola"))
+	assert.Equal(t, BackupRestored, third.RestoreBackup(data, "pies", true))
+	assert.True(t, third.ExistPrivateKeyFor("ola"))
+	assert.False(t, third.ExistPrivateKeyFor("ela"))
+	moved, _ := filepath.Glob(third.dir + ".*/ela_priv.pem")
+	assert.Len(t, moved, 1)
+}
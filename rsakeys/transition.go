@@ -0,0 +1,274 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rsakeys
+
+import (
+	"Carmel/shared"
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Key rotation: the old private key signs a statement (transition) which endorses
+// the new public key. The statements of the user are kept in <name>_transitions.pem
+// and sent to the partners, who follow the chain from the key they know
+// and replace it with the newest one:
+//
+//	-----BEGIN CARMEL KEY TRANSITION-----
+//	Name, Created, Old-Fingerprint, New-Fingerprint (headers)
+//	signature made with the old key
+//	-----END CARMEL KEY TRANSITION-----
+//	new public key blocks (as in the key file)
+
+const (
+	keyTransitionType     = "CARMEL KEY TRANSITION"
+	keyTransitionLabel    = "carmel key transition"
+	oldFingerprintHeader  = "Old-Fingerprint"
+	newFingerprintHeader  = "New-Fingerprint"
+	transitionsFileFormat = "%s_transitions.pem"
+)
+
+type KeyTransition struct {
+	Name           string
+	OldFingerprint string // as PublicKey.Fingerprint
+	NewKey         *PublicKey
+	Created        time.Time
+	Signature      []byte
+}
+
+func newKeyTransition(userName string, oldKey *PrivateKey, newKey *PublicKey) *KeyTransition {
+	t := &KeyTransition{
+		Name:           userName,
+		OldFingerprint: oldKey.Public().Fingerprint(),
+		NewKey:         newKey,
+		Created:        time.Now().UTC().Truncate(time.Second),
+	}
+	if t.Signature = oldKey.Sign(t.signedData()); t.Signature != nil {
+		return t
+	}
+	return nil
+}
+
+// The statement is valid if it was signed with the given (old) key.
+func (t *KeyTransition) IsSignedWith(oldKey *PublicKey) bool {
+	return oldKey != nil && t.OldFingerprint == oldKey.Fingerprint() && oldKey.Verify(t.signedData(), t.Signature)
+}
+
+func (t *KeyTransition) Armor() []byte {
+	block := &pem.Block{
+		Type: keyTransitionType,
+		Headers: map[string]string{
+			nameHeader:           t.Name,
+			createdHeader:        t.Created.Format(time.RFC3339),
+			oldFingerprintHeader: t.OldFingerprint,
+			newFingerprintHeader: t.NewKey.Fingerprint(),
+		},
+		Bytes: t.Signature,
+	}
+	var buffer bytes.Buffer
+	if err := pem.Encode(&buffer, block); err != nil {
+		return nil
+	}
+	if key := t.NewKey.Pem(); key != nil {
+		buffer.Write(key)
+		return buffer.Bytes()
+	}
+	return nil
+}
+
+func ArmorKeyTransitions(transitions []*KeyTransition) []byte {
+	var buffer bytes.Buffer
+	for _, t := range transitions {
+		buffer.Write(t.Armor())
+	}
+	return buffer.Bytes()
+}
+
+// Reads all statements from the text. Their signatures can be checked
+// only with the old keys (see IsSignedWith).
+func ParseKeyTransitions(data []byte) []*KeyTransition {
+	var transitions []*KeyTransition
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return transitions
+		}
+		data = rest
+		if block.Type != keyTransitionType {
+			continue
+		}
+		newKey, rest := publicKeyFromBlocks(data)
+		data = rest
+		created, err := time.Parse(time.RFC3339, block.Headers[createdHeader])
+		if err != nil || newKey == nil || newKey.Fingerprint() != block.Headers[newFingerprintHeader] {
+			continue
+		}
+		transitions = append(transitions, &KeyTransition{
+			Name:           block.Headers[nameHeader],
+			OldFingerprint: block.Headers[oldFingerprintHeader],
+			NewKey:         newKey,
+			Created:        created,
+			Signature:      block.Bytes,
+		})
+	}
+}
+
+// Follows the chain of statements of the user starting from the known key.
+// Returns the newest key endorsed by it (the known key if there is none).
+func FollowKeyTransitions(publicKey *PublicKey, userName string, transitions []*KeyTransition) *PublicKey {
+	for range transitions {
+		next := publicKey
+		for _, t := range transitions {
+			if t.Name == userName && t.IsSignedWith(publicKey) {
+				next = t.NewKey
+				break
+			}
+		}
+		if next == publicKey {
+			break
+		}
+		publicKey = next
+	}
+	return publicKey
+}
+
+// Replaces the old key of the user with a new one signed with the old key.
+// The partners learn about the new key from the statement (see KeyTransitionsFor).
+// The old private key must be available (unlocked).
+func (m *Manager) RotateKeysForUser(userName string, keyType KeyType, passphrase string) bool {
+	oldKey := m.PrivateKeyFromFileForUser(userName)
+	if oldKey == nil {
+		return false
+	}
+	newKey := GenerateKey(keyType)
+	if newKey == nil {
+		return false
+	}
+	transition := newKeyTransition(userName, oldKey, newKey.Public())
+	privatePem := privatePemFromKey(newKey)
+	publicPem := publicPemFromKey(newKey.Public())
+	if privatePem != nil && passphrase != "" {
+		privatePem = encryptPem(privatePem, passphrase)
+	}
+	if transition == nil || privatePem == nil || publicPem == nil {
+		return false
+	}
+
+	// The old files are restored if anything fails.
+	privateKeyFilePath := filepath.Join(m.dir, fmt.Sprintf(privateKeyFileNameFormat, userName))
+	publicKeyFilePath := filepath.Join(m.dir, fmt.Sprintf(publicKeyFileNameFormat, userName))
+	transitionsFilePath := filepath.Join(m.dir, fmt.Sprintf(transitionsFileFormat, userName))
+	revocationFilePath := filepath.Join(m.dir, revocationFileName(userName, newKey.Public()))
+	oldPrivate, err := ioutil.ReadFile(privateKeyFilePath)
+	if err != nil {
+		return false
+	}
+	oldPublic, err := ioutil.ReadFile(publicKeyFilePath)
+	if err != nil {
+		return false
+	}
+	oldTransitions, err := ioutil.ReadFile(transitionsFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+
+	if !m.saveRevocation(userName, newKey) {
+		return false
+	}
+	if saveFile(transitionsFilePath, publicFileMode, append(oldTransitions, transition.Armor()...)) {
+		if savePemToFile(privateKeyFilePath, privateFileMode, privatePem) && savePemToFile(publicKeyFilePath, publicFileMode, publicPem...) {
+			if passphrase != "" {
+				setUnlockedKey(userName, newKey)
+			} else {
+				setUnlockedKey(userName, nil)
+			}
+			return true
+		}
+		saveFile(privateKeyFilePath, privateFileMode, oldPrivate)
+		saveFile(publicKeyFilePath, publicFileMode, oldPublic)
+		saveFile(transitionsFilePath, publicFileMode, oldTransitions)
+	}
+	shared.RemoveFile(revocationFilePath)
+	return false
+}
+
+// Statements made by the user at every rotation of the keys.
+func (m *Manager) KeyTransitionsFor(userName string) []*KeyTransition {
+	if data, err := ioutil.ReadFile(filepath.Join(m.dir, fmt.Sprintf(transitionsFileFormat, userName))); err == nil {
+		return ParseKeyTransitions(data)
+	}
+	return nil
+}
+
+// Replaces the saved key of the partner with the newest one endorsed by it
+// (the partner's statements are received at login). The known peers are updated,
+// a verified key passes the verification on to its successor.
+// Statements signed with a revoked key are ignored (it could be stolen).
+// Returns the new key or nil if the saved key is still valid.
+func (m *Manager) ApplyKeyTransitions(userName string, transitions []*KeyTransition) *PublicKey {
+	current := m.PublicKeyFromFileForUser(userName)
+	if current == nil {
+		return nil
+	}
+	revocations := m.Revocations()
+	trusted := make([]*KeyTransition, 0, len(transitions))
+	for _, t := range transitions {
+		if findRevocation(revocations, t.OldFingerprint) == nil {
+			trusted = append(trusted, t)
+		}
+	}
+	newKey := FollowKeyTransitions(current, userName, trusted)
+	if newKey.Fingerprint() == current.Fingerprint() {
+		return nil
+	}
+	verified := m.IsVerified(userName, current)
+	filePath := filepath.Join(m.dir, fmt.Sprintf(publicKeyFileNameFormat, userName))
+	if blocks := publicPemFromKey(newKey); blocks != nil && savePemToFile(filePath, publicFileMode, blocks...) && m.AcceptChangedKey(userName, newKey) {
+		if verified {
+			m.SetVerified(userName, newKey, true)
+		}
+		return newKey
+	}
+	return nil
+}
+
+func (t *KeyTransition) signedData() []byte {
+	return signedFields(
+		[]byte(keyTransitionLabel),
+		[]byte(t.Name),
+		[]byte(t.Created.Format(time.RFC3339)),
+		[]byte(t.OldFingerprint),
+		[]byte(t.NewKey.Type),
+		t.NewKey.Bytes(),
+	)
+}
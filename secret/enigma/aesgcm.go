@@ -0,0 +1,92 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/tr"
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// AES-256 in GCM mode (authenticated encryption).
+// The cipher text is preceded by a random nonce.
+
+const aesKeySize = 32
+
+type aesGCM struct {
+	aead cipher.AEAD
+}
+
+// GCM authenticates with the key used for encryption (macKey isn't used).
+func newAESGCM(key, _ []byte) Suite {
+	if len(key) != aesKeySize {
+		return nil
+	}
+	if block, err := aes.NewCipher(key); tr.IsOK(err) {
+		if aead, err := cipher.NewGCM(block); tr.IsOK(err) {
+			return &aesGCM{aead: aead}
+		}
+	}
+	return nil
+}
+
+func (a *aesGCM) Id() SuiteId {
+	return AESGCM
+}
+
+func (a *aesGCM) Encrypt(plain, ad []byte) []byte {
+	if a.aead == nil {
+		return nil
+	}
+	if nonce := secret.RandomBytes(a.aead.NonceSize()); nonce != nil {
+		return a.aead.Seal(nonce, nonce, plain, ad)
+	}
+	return nil
+}
+
+func (a *aesGCM) Decrypt(data, ad []byte) []byte {
+	if a.aead == nil {
+		return nil
+	}
+	nonceSize := a.aead.NonceSize()
+	if len(data) < nonceSize+a.aead.Overhead() {
+		return nil
+	}
+	if plain, err := a.aead.Open(nil, data[:nonceSize], data[nonceSize:], ad); tr.IsOK(err) {
+		return plain
+	}
+	return nil
+}
+
+// The expanded AES key is kept by crypto/aes,
+// we can only make the suite unusable.
+func (a *aesGCM) Clean() {
+	a.aead = nil
+}
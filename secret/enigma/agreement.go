@@ -0,0 +1,119 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/tr"
+	"Carmel/shared/vtc"
+	"crypto/ecdh"
+	"crypto/rand"
+)
+
+// Ephemeral Diffie-Hellman key agreement (X25519).
+//
+// Both sides generate a fresh key pair for every session and sign
+// its public part with their identity keys (RSA or Ed25519). The symmetric
+// keys are derived (HKDF) from the shared secret, so nobody who steals
+// a private identity key later can decrypt recorded sessions.
+// The suite chosen by the server is signed together with its key.
+
+var (
+	serverAgreementLabel = []byte("carmel key agreement: server")
+	clientAgreementLabel = []byte("carmel key agreement: client")
+	sessionKeysInfo      = []byte("carmel session keys")
+)
+
+// Creates the ephemeral key pair and returns its public part.
+func (e *Enigma) EphemeralKey() []byte {
+	if privateKey, err := ecdh.X25519().GenerateKey(rand.Reader); tr.IsOK(err) {
+		e.ephemeral = privateKey
+		return privateKey.PublicKey().Bytes()
+	}
+	return nil
+}
+
+// Signature of the suite and the ephemeral keys known to the given side.
+// The server signs only its own key (it doesn't know the client's key yet),
+// the client signs both.
+func (e *Enigma) AgreementSignature(role vtc.RoleType, suite SuiteId, serverKey, clientKey []byte) []byte {
+	return e.Signature(agreementData(role, suite, serverKey, clientKey))
+}
+
+func (e *Enigma) IsValidAgreementSignature(role vtc.RoleType, sign []byte, suite SuiteId, serverKey, clientKey []byte) bool {
+	return e.IsValidSignature(sign, agreementData(role, suite, serverKey, clientKey))
+}
+
+func agreementData(role vtc.RoleType, suite SuiteId, serverKey, clientKey []byte) []byte {
+	label := serverAgreementLabel
+	if role == vtc.Client {
+		label = clientAgreementLabel
+	}
+	data := make([]byte, 0, len(label)+1+len(serverKey)+len(clientKey))
+	data = append(data, label...)
+	data = append(data, byte(suite))
+	data = append(data, serverKey...)
+	return append(data, clientKey...)
+}
+
+// Computes the shared secret and derives from it the secret
+// of the first key generation. The ephemeral key is forgotten.
+func (e *Enigma) AgreeKeys(role vtc.RoleType, suite SuiteId, serverKey, clientKey []byte) bool {
+	if !suite.IsValid() || e.ephemeral == nil {
+		return false
+	}
+	if shared := e.sharedSecret(role, serverKey, clientKey); shared != nil {
+		defer secret.ClearSlice(&shared)
+		salt := append(append([]byte{}, serverKey...), clientKey...)
+		if generationSecret := secret.HKDF(shared, salt, sessionKeysInfo, secretSize); generationSecret != nil {
+			return e.initKeys(role, suite, generationSecret)
+		}
+	}
+	return false
+}
+
+// X25519 agreement of my ephemeral key with the partner's one.
+// The ephemeral key is forgotten.
+func (e *Enigma) sharedSecret(role vtc.RoleType, serverKey, clientKey []byte) []byte {
+	if e.ephemeral == nil {
+		return nil
+	}
+	defer func() { e.ephemeral = nil }()
+
+	buddyKey := clientKey
+	if role == vtc.Client {
+		buddyKey = serverKey
+	}
+	if publicKey, err := ecdh.X25519().NewPublicKey(buddyKey); tr.IsOK(err) {
+		if shared, err := e.ephemeral.ECDH(publicKey); tr.IsOK(err) {
+			return shared
+		}
+	}
+	return nil
+}
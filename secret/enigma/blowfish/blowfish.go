@@ -208,6 +208,18 @@ func (bf *Blowfish) DecryptECB(cipherText []byte) []byte {
 	return buffer
 }
 
+// Clean - clears P-array and S-boxes (they are derived from the key).
+func (bf *Blowfish) Clean() {
+	for i := range bf.p {
+		bf.p[i] = 0
+	}
+	for i := range bf.s {
+		for j := range bf.s[i] {
+			bf.s[i][j] = 0
+		}
+	}
+}
+
 func (bf *Blowfish) f(x uint32) uint32 {
 	d := x & 0xff
 	x >>= 8
@@ -0,0 +1,146 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/rsakeys"
+	"Carmel/secret"
+	"Carmel/shared/vtc"
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Exchange of the public identity keys at the first contact (bootstrap).
+//
+// Both sides agree an ephemeral X25519 key, the identity keys are sent
+// encrypted with a key derived from it. Every side proves with a MAC
+// of the whole exchange that it took part in the key agreement with the PIN
+// (see pake.go): the MAC key is derived from the shared secret together with
+// the key agreed with the PIN. The PIN itself is protected by that agreement
+// only, nothing sent here depends on the PIN alone. An attacker who
+// pretends to be one of the sides can check one PIN per connection,
+// so the PIN is valid for one invitation only. The user still confirms
+// the fingerprint of the received key before it's saved.
+
+var (
+	bootstrapInfo        = []byte("carmel key exchange")
+	bootstrapPinInfo     = []byte("carmel key exchange: pin")
+	serverBootstrapLabel = []byte("carmel key exchange: server")
+	clientBootstrapLabel = []byte("carmel key exchange: client")
+)
+
+type bootstrap struct {
+	cipher     Suite  // encryption of the identity keys
+	macKey     []byte // depends on the key agreed with the PIN
+	transcript []byte // ephemeral keys of both sides
+}
+
+// Derives the keys of the exchange from the ephemeral keys and the key
+// agreed with the PIN (see AgreePakeKey). The ephemeral key is forgotten (see EphemeralKey).
+func (e *Enigma) AgreeBootstrapKeys(role vtc.RoleType, serverKey, clientKey []byte) bool {
+	pakeKey := e.pakeKey()
+	if pakeKey == nil {
+		return false
+	}
+	shared := e.sharedSecret(role, serverKey, clientKey)
+	if shared == nil {
+		return false
+	}
+	defer secret.ClearSlice(&shared)
+
+	transcript := append(append([]byte{}, serverKey...), clientKey...)
+	key := secret.HKDF(shared, transcript, bootstrapInfo, aesKeySize)
+	defer secret.ClearSlice(&key)
+	pinSecret := append(append([]byte{}, shared...), pakeKey...)
+	defer secret.ClearSlice(&pinSecret)
+	macKey := secret.HKDF(pinSecret, transcript, bootstrapPinInfo, sha256.Size)
+	if cipher := newAESGCM(key, nil); cipher != nil && macKey != nil {
+		e.bootstrap = &bootstrap{cipher: cipher, macKey: macKey, transcript: transcript}
+		return true
+	}
+	return false
+}
+
+// My public key (in the form of the key file) encrypted for the partner,
+// preceded by the proof that I know the PIN.
+func (e *Enigma) SealBootstrap(role vtc.RoleType, name string, publicKey []byte) []byte {
+	if e.bootstrap == nil {
+		return nil
+	}
+	proof := e.bootstrapProof(role, name, publicKey)
+	if cipher := e.bootstrap.cipher.Encrypt(publicKey, bootstrapAD(role, name)); cipher != nil {
+		return append(proof, cipher...)
+	}
+	return nil
+}
+
+// Decrypts the partner's public key and checks the proof.
+// Returns nil if the partner doesn't know the PIN.
+func (e *Enigma) OpenBootstrap(role vtc.RoleType, name string, data []byte) *rsakeys.PublicKey {
+	if e.bootstrap == nil || len(data) < sha256.Size {
+		return nil
+	}
+	proof, cipher := data[:sha256.Size], data[sha256.Size:]
+	if publicKey := e.bootstrap.cipher.Decrypt(cipher, bootstrapAD(role, name)); publicKey != nil {
+		if hmac.Equal(proof, e.bootstrapProof(role, name, publicKey)) {
+			return rsakeys.PublicKeyFromPem(publicKey)
+		}
+	}
+	return nil
+}
+
+// The partner's key received during the exchange is used from now on.
+func (e *Enigma) SetBuddyPublicKey(publicKey *rsakeys.PublicKey) {
+	e.buddyPublicKey = publicKey
+}
+
+// Keys of the exchange aren't needed after the login.
+func (e *Enigma) ClearBootstrap() {
+	if e.bootstrap != nil {
+		e.bootstrap.cipher.Clean()
+		secret.ClearSlice(&e.bootstrap.macKey)
+		e.bootstrap = nil
+	}
+}
+
+func (e *Enigma) bootstrapProof(role vtc.RoleType, name string, publicKey []byte) []byte {
+	mac := hmac.New(sha256.New, e.bootstrap.macKey)
+	mac.Write(bootstrapAD(role, name))
+	mac.Write(e.bootstrap.transcript)
+	mac.Write(publicKey)
+	return mac.Sum(nil)
+}
+
+func bootstrapAD(role vtc.RoleType, name string) []byte {
+	label := serverBootstrapLabel
+	if role == vtc.Client {
+		label = clientBootstrapLabel
+	}
+	return append(append([]byte{}, label...), name...)
+}
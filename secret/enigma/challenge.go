@@ -0,0 +1,101 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/vtc"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Mutual challenge-response authentication (after the key agreement).
+//
+// Both sides send fresh random challenges. Each side signs both challenges
+// together with the hash of the handshake transcript (the login and the key
+// agreement messages, see UpdateTranscript) with its identity key.
+// The signature proves the possession of the private key and is valid
+// only for this one handshake.
+
+const ChallengeSize = 32
+
+var (
+	serverChallengeLabel = []byte("carmel challenge: server")
+	clientChallengeLabel = []byte("carmel challenge: client")
+)
+
+// Fresh random challenge.
+func (e *Enigma) Challenge() []byte {
+	return secret.RandomBytes(ChallengeSize)
+}
+
+// Adds the message (exactly as sent or received) to the transcript hash:
+// transcript = SHA-256(transcript | length | message).
+func (e *Enigma) UpdateTranscript(data []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	hash := sha256.New()
+	hash.Write(e.transcript)
+	hash.Write(size[:])
+	hash.Write(data)
+	e.transcript = hash.Sum(nil)
+}
+
+func (e *Enigma) Transcript() []byte {
+	return e.transcript
+}
+
+func (e *Enigma) ChallengeSignature(role vtc.RoleType, serverChallenge, clientChallenge []byte) []byte {
+	if data := challengeData(role, e.transcript, serverChallenge, clientChallenge); data != nil {
+		return e.Signature(data)
+	}
+	return nil
+}
+
+func (e *Enigma) IsValidChallengeSignature(role vtc.RoleType, sign, serverChallenge, clientChallenge []byte) bool {
+	if data := challengeData(role, e.transcript, serverChallenge, clientChallenge); data != nil {
+		return e.IsValidSignature(sign, data)
+	}
+	return false
+}
+
+// Both challenges must be fresh (of the full size) and the transcript must exist.
+func challengeData(role vtc.RoleType, transcript, serverChallenge, clientChallenge []byte) []byte {
+	if len(transcript) != sha256.Size || len(serverChallenge) != ChallengeSize || len(clientChallenge) != ChallengeSize {
+		return nil
+	}
+	label := serverChallengeLabel
+	if role == vtc.Client {
+		label = clientChallengeLabel
+	}
+	data := make([]byte, 0, len(label)+len(transcript)+2*ChallengeSize)
+	data = append(data, label...)
+	data = append(data, transcript...)
+	data = append(data, serverChallenge...)
+	return append(data, clientChallenge...)
+}
@@ -31,46 +31,62 @@ package enigma
 import (
 	"Carmel/rsakeys"
 	"Carmel/secret"
-	"Carmel/secret/enigma/blowfish"
-	"Carmel/secret/enigma/gost"
-	"Carmel/secret/enigma/way3"
 	"Carmel/shared"
 	"Carmel/shared/tr"
 	"Carmel/shared/vtc"
 	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
+	"log"
 )
 
 type Enigma struct {
-	ServerId       []byte             // 128 bytes identifying the server
-	ClientId       []byte             // 128 bytes identifying the client
-	privateKey     *rsa.PrivateKey    // my private RSA key
-	buddyPublicKey *rsa.PublicKey     // client's RSA public key
-	bf             *blowfish.Blowfish // blowfish
-	gt             *gost.Gost         // gost
-	w3             *way3.Way3         // 3-way
-	Keys           vtc.Keys
+	Padding        Padding             // RSA padding used for encryption and signatures
+	LegacyRSA      bool                // PKCS#1 v1.5 is accepted (compatibility mode)
+	privateKey     *rsakeys.PrivateKey // my identity keys (RSA or Ed25519)
+	buddyPublicKey *rsakeys.PublicKey  // partner's identity keys (RSA or Ed25519)
+	ephemeral      *ecdh.PrivateKey    // used only during the key agreement (see agreement.go)
+	key            []byte              // secret of the first key generation (see ResumptionTicket)
+	suite          SuiteId             // agreed cipher suite
+	keys           [2]*Keys            // keys of both directions (see keys.go)
+	bootstrap      *bootstrap          // exchange of the public keys at the first contact (see bootstrap.go)
+	transcript     []byte              // hash of the handshake messages (see challenge.go)
+	pake           *pake               // key exchange authenticated with the PIN (see pake.go)
 }
 
-func New(buddyName string) *Enigma {
-	// Determining server and client identifiers
-	// The keys depend on the day and the month number
-	// (they are different every day of the year).
-	_, month, day, _, _, _ := shared.DateTimeComponents(shared.Now())
-	idx0 := 64 % (month + day)
-	idx0++
-	idx0 *= 2
-	idx1 := idx0 + 128
-	idx1 += 32
-
-	serverId := vtc.RandomBytes[idx0 : idx0+128]
-	clientId := vtc.RandomBytes[idx1 : idx1+128]
+// RSA padding schemes.
+// PKCS#1 v1.5 is used only in the compatibility mode with older programs,
+// both partners agree the padding in Hello (see Session.acceptHello).
+// The padding doesn't matter for Ed25519 identities.
+type Padding uint8
+
+const (
+	_        Padding = iota
+	PKCS1v15         // encryption and signatures
+	OAEPPSS          // OAEP encryption, PSS signatures
+)
+
+// The first byte of the hybrid encryption header
+// for the partner with an Ed25519 identity (RSA ones use the padding).
+const (
+	x25519Wrapping = 0x80
+	x25519KeySize  = 32
+)
+
+var (
+	hybridLabel = []byte("carmel hybrid encryption")
+	pssOptions  = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+)
 
+func New(buddyName string) *Enigma {
 	if rsaManager := rsakeys.New(); rsaManager != nil {
 		if privateKey := rsaManager.PrivateKeyFromFileForUser(shared.MyUserName); privateKey != nil {
-			e := &Enigma{ServerId: serverId, ClientId: clientId, privateKey: privateKey}
+			e := newEnigma(privateKey, nil)
 			if buddyName != "" {
 				if !e.SetBuddyRSAPublicKey(buddyName) {
 					return nil
@@ -82,6 +98,19 @@ func New(buddyName string) *Enigma {
 	return nil
 }
 
+// Identity keys given directly (not read from the keys directory).
+func NewWithKeys(privateKey *rsakeys.PrivateKey, buddyPublicKey *rsakeys.PublicKey) *Enigma {
+	return newEnigma(privateKey, buddyPublicKey)
+}
+
+func newEnigma(privateKey *rsakeys.PrivateKey, buddyPublicKey *rsakeys.PublicKey) *Enigma {
+	e := &Enigma{Padding: OAEPPSS, privateKey: privateKey, buddyPublicKey: buddyPublicKey}
+	for _, d := range directions {
+		e.keys[d-1] = &Keys{direction: d}
+	}
+	return e
+}
+
 // Ta funkcja w serwerze wywoływana jest dopiero po połączeniu.
 // Nazwę partnera rozmowy otrzyma przy pierwszej wymianie danych.
 // Klient wywołuje tę funkcję przy tworzeniu obiektu 'enigma'.
@@ -96,105 +125,298 @@ func (e *Enigma) SetBuddyRSAPublicKey(buddyName string) bool {
 	return false
 }
 
-func (e *Enigma) InitBlowfish(key []byte) bool {
-	if len(key) == blowfish.MaxKeyLength {
-		if bf := blowfish.New(key); bf != nil {
-			e.bf = bf
-			e.Keys.Blowfish = key
-			return true
-		}
+// My public identity keys (e.g. for the safety number).
+func (e *Enigma) PublicKey() *rsakeys.PublicKey {
+	if e.privateKey != nil {
+		return e.privateKey.Public()
 	}
-	return false
+	return nil
+}
+
+// The partner's public identity keys (nil if not known yet).
+func (e *Enigma) BuddyPublicKey() *rsakeys.PublicKey {
+	return e.buddyPublicKey
+}
+
+// Keys of one direction of the session.
+func (e *Enigma) Keys(d Direction) *Keys {
+	if d == ClientToServer || d == ServerToClient {
+		return e.keys[d-1]
+	}
+	return nil
 }
 
-func (e *Enigma) InitGost(key []byte) bool {
-	if gt := gost.New(key); gt != nil {
-		e.gt = gt
-		e.Keys.Gost = key
+// Keys of the first generation, derived from the secret
+// agreed by both sides at the session start (see AgreeKeys).
+func (e *Enigma) initKeys(role vtc.RoleType, suite SuiteId, generationSecret []byte) bool {
+	for _, k := range e.keys {
+		k.role = role
+	}
+	e.suite = suite
+	if generations, ok := e.derive(0, generationSecret); ok {
+		for i, k := range e.keys {
+			k.reset(generations[i])
+		}
+		e.key = generationSecret
 		return true
 	}
 	return false
 }
 
-func (e *Enigma) InitWay3(key []byte) bool {
-	if w3 := way3.New(key); w3 != nil {
-		e.w3 = w3
-		e.Keys.Way3 = key
+// The suite used for encryption (0 - keys are not agreed yet).
+func (e *Enigma) Suite() SuiteId {
+	return e.suite
+}
+
+// Identifier of the key generation used for encryption.
+func (e *Enigma) KeyGeneration() uint32 {
+	k := e.keys[0]
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if k.current != nil {
+		return k.current.id
+	}
+	return 0
+}
+
+// Server: secret of the next key generation (the suite doesn't change).
+// Its keys can be used for decryption at once, for encryption after SwitchKeys.
+func (e *Enigma) NextKeys() ([]byte, uint32, bool) {
+	id := e.KeyGeneration() + 1
+	if generationSecret := secret.RandomBytes(secretSize); generationSecret != nil && e.AddKeys(id, generationSecret) {
+		return generationSecret, id, true
+	}
+	return nil, 0, false
+}
+
+// Installs keys of the next generation (derived from its secret).
+// Only the generation following the current one is accepted.
+func (e *Enigma) AddKeys(id uint32, generationSecret []byte) bool {
+	if id != e.KeyGeneration()+1 {
+		return false
+	}
+	if generations, ok := e.derive(id, generationSecret); ok {
+		for i, k := range e.keys {
+			k.setNext(generations[i])
+		}
 		return true
 	}
 	return false
 }
 
-// Each data encryption is done with the partner's public RSA key
-// The partner decrypts the data with his private RSA key
+// Keys of one generation for both directions.
+func (e *Enigma) derive(id uint32, generationSecret []byte) ([2]*keyGeneration, bool) {
+	var generations [2]*keyGeneration
+	if len(generationSecret) != secretSize {
+		return generations, false
+	}
+	for i, k := range e.keys {
+		if generations[i] = deriveGeneration(id, e.suite, k.direction, generationSecret); generations[i] == nil {
+			return generations, false
+		}
+	}
+	return generations, true
+}
+
+// From now on messages are encrypted with the next generation of keys.
+// The current one is kept for decryption until ClearKeys.
+func (e *Enigma) SwitchKeys() bool {
+	for _, k := range e.keys {
+		if !k.switchKeys() {
+			return false
+		}
+	}
+	return true
+}
+
+// Hybrid encryption for the partner (data of any size).
+// The data is encrypted with a one-time AES-256 key (GCM):
+//
+//	header | nonce | cipher text + tag
+//
+// The header lets the partner recover this key with his private key:
+// for an RSA identity it's the padding (1) and the key encrypted with RSA,
+// for an Ed25519 one it's x25519Wrapping (1) and an ephemeral X25519 key
+// (the AES key is derived from its agreement with the partner's X25519 key).
 func (e *Enigma) EncryptRSA(plain []byte) []byte {
-	if e.buddyPublicKey != nil {
-		if cipher, err := rsa.EncryptPKCS1v15(rand.Reader, e.buddyPublicKey, plain); tr.IsOK(err) {
-			return cipher
+	if e.buddyPublicKey == nil {
+		return nil
+	}
+	if key, header := e.wrapKey(); key != nil {
+		defer secret.ClearSlice(&key)
+		if body := newAESGCM(key, nil); body != nil {
+			if cipher := body.Encrypt(plain, header); cipher != nil {
+				return append(header, cipher...)
+			}
 		}
 	}
 	return nil
 }
 
-// Deciphering the text with my private RSA key
-// The data that the partner has encrypted with my public RSA key.
+// Deciphering the data with my private key
+// The data that the partner has encrypted for me (see EncryptRSA).
+// PKCS#1 v1.5 is accepted only in the compatibility mode.
 func (e *Enigma) DecryptRsa(cipher []byte) []byte {
-	if e.privateKey != nil {
-		if plain, err := rsa.DecryptPKCS1v15(rand.Reader, e.privateKey, cipher); tr.IsOK(err) {
-			return plain
+	if e.privateKey == nil {
+		return nil
+	}
+	headerSize := 1 + x25519KeySize
+	if e.privateKey.Type.IsRSA() {
+		headerSize = 1 + e.privateKey.RSA.Size()
+	}
+	if len(cipher) <= headerSize {
+		return nil
+	}
+	header, data := cipher[:headerSize], cipher[headerSize:]
+	if key := e.unwrapKey(header); key != nil {
+		defer secret.ClearSlice(&key)
+		if body := newAESGCM(key, nil); body != nil {
+			return body.Decrypt(data, header)
+		}
+	}
+	return nil
+}
+
+// One-time key of the hybrid encryption and its header.
+func (e *Enigma) wrapKey() ([]byte, []byte) {
+	if e.buddyPublicKey.Type == rsakeys.Ed25519 {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if !tr.IsOK(err) {
+			return nil, nil
+		}
+		header := append([]byte{x25519Wrapping}, ephemeral.PublicKey().Bytes()...)
+		if key := x25519WrappingKey(ephemeral, e.buddyPublicKey.X25519, header); key != nil {
+			return key, header
+		}
+		return nil, nil
+	}
+
+	key := secret.RandomBytes(aesKeySize)
+	if key == nil {
+		return nil, nil
+	}
+	var wrapped []byte
+	var err error
+	switch e.Padding {
+	case OAEPPSS:
+		wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, e.buddyPublicKey.RSA, key, hybridLabel)
+	case PKCS1v15:
+		wrapped, err = rsa.EncryptPKCS1v15(rand.Reader, e.buddyPublicKey.RSA, key)
+	default:
+		secret.ClearSlice(&key)
+		return nil, nil
+	}
+	if tr.IsOK(err) {
+		return key, append([]byte{byte(e.Padding)}, wrapped...)
+	}
+	secret.ClearSlice(&key)
+	return nil, nil
+}
+
+func (e *Enigma) unwrapKey(header []byte) []byte {
+	if header[0] == x25519Wrapping {
+		if e.privateKey.Type != rsakeys.Ed25519 {
+			return nil
 		}
+		if ephemeral, err := ecdh.X25519().NewPublicKey(header[1:]); tr.IsOK(err) {
+			return x25519WrappingKey(e.privateKey.X25519, ephemeral, header)
+		}
+		return nil
+	}
+	if !e.privateKey.Type.IsRSA() {
+		return nil
+	}
+
+	var key []byte
+	var err error
+	switch Padding(header[0]) {
+	case OAEPPSS:
+		key, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privateKey.RSA, header[1:], hybridLabel)
+	case PKCS1v15:
+		if !e.LegacyRSA {
+			log.Println("PKCS#1 v1.5 padding is accepted only in the compatibility mode")
+			return nil
+		}
+		key, err = rsa.DecryptPKCS1v15(rand.Reader, e.privateKey.RSA, header[1:])
+	default:
+		return nil
+	}
+	if tr.IsOK(err) && len(key) == aesKeySize {
+		return key
+	}
+	return nil
+}
+
+// AES key from the agreement of the ephemeral key and the X25519 key of an identity.
+func x25519WrappingKey(privateKey *ecdh.PrivateKey, publicKey *ecdh.PublicKey, header []byte) []byte {
+	if shared, err := privateKey.ECDH(publicKey); tr.IsOK(err) {
+		defer secret.ClearSlice(&shared)
+		return secret.HKDF(shared, header, hybridLabel, aesKeySize)
 	}
 	return nil
 }
 
 // Calculates the signature for the given data
+// (Ed25519 or RSA, depending on my identity).
 func (e *Enigma) Signature(data []byte) []byte {
+	if e.privateKey.Type == rsakeys.Ed25519 {
+		return ed25519.Sign(e.privateKey.Ed25519, data)
+	}
+
 	hash := sha512.Sum512(data)
-	if sign, err := rsa.SignPKCS1v15(rand.Reader, e.privateKey, crypto.SHA512, hash[:]); tr.IsOK(err) {
+	var sign []byte
+	var err error
+	switch e.Padding {
+	case OAEPPSS:
+		sign, err = rsa.SignPSS(rand.Reader, e.privateKey.RSA, crypto.SHA512, hash[:], pssOptions)
+	case PKCS1v15:
+		sign, err = rsa.SignPKCS1v15(rand.Reader, e.privateKey.RSA, crypto.SHA512, hash[:])
+	default:
+		return nil
+	}
+	if tr.IsOK(err) {
 		return sign
 	}
 	return nil
 }
 
 // Checking the correctness of the signature for the given data
+// (made with the partner's identity and, for RSA, the padding agreed by both sides).
 func (e *Enigma) IsValidSignature(sign, data []byte) bool {
-	hash := sha512.Sum512(data)
-	if err := rsa.VerifyPKCS1v15(e.buddyPublicKey, crypto.SHA512, hash[:], sign); tr.IsOK(err) {
-		return true
+	if e.buddyPublicKey.Type == rsakeys.Ed25519 {
+		return ed25519.Verify(e.buddyPublicKey.Ed25519, data, sign)
 	}
-	return false
-}
 
-// We use a three-stage EDE encryption system (Encryption-Decryption-Encryption)
-// 1. Encryption - Blowfish CBC
-// 2. Decryption - Gost ECB
-// 3. Encryption - 3-Way CBC
-// Notice: we perform all encryptions using a randomly generated IV
-func (e *Enigma) Encrypt(plain []byte) []byte {
-	if e.bf != nil && e.gt != nil && e.w3 != nil {
-		if bfCipher := e.bf.EncryptCBC(plain, nil); bfCipher != nil {
-			if gtCipher := e.gt.DecryptECB(bfCipher); gtCipher != nil {
-				if cipher := e.w3.EncryptCBC(gtCipher, nil); cipher != nil {
-					return cipher
-				}
-			}
-		}
+	hash := sha512.Sum512(data)
+	var err error
+	switch e.Padding {
+	case OAEPPSS:
+		err = rsa.VerifyPSS(e.buddyPublicKey.RSA, crypto.SHA512, hash[:], sign, pssOptions)
+	case PKCS1v15:
+		err = rsa.VerifyPKCS1v15(e.buddyPublicKey.RSA, crypto.SHA512, hash[:], sign)
+	default:
+		return false
 	}
-	return nil
+	return tr.IsOK(err)
 }
 
-// See Encrypt
-func (e *Enigma) Decrypt(cipher []byte) []byte {
-	if e.bf != nil && e.gt != nil && e.w3 != nil {
-		if w3Plain := e.w3.DecryptCBC(cipher); w3Plain != nil {
-			if gtPlain := e.gt.EncryptECB(w3Plain); gtPlain != nil {
-				if plain := e.bf.DecryptCBC(gtPlain); plain != nil {
-					return plain
-				}
-			}
-		}
+// Bilet wznowienia sesji (po zerwaniu połączenia TCP).
+// Zależy od kluczy symetrycznych i kluczy RSA obu stron,
+// dlatego musi zostać wyliczony zanim klucze zostaną wyczyszczone.
+func (e *Enigma) ResumptionTicket(role vtc.RoleType) []byte {
+	if e.privateKey == nil || e.buddyPublicKey == nil || e.key == nil {
+		return nil
 	}
-	return nil
+	serverKey, clientKey := e.privateKey.Public(), e.buddyPublicKey
+	if role == vtc.Client {
+		serverKey, clientKey = clientKey, serverKey
+	}
+
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write([]byte("carmel resumption ticket"))
+	mac.Write(serverKey.Bytes())
+	mac.Write(clientKey.Bytes())
+	return mac.Sum(nil)
 }
 
 /********************************************************************
@@ -203,8 +425,11 @@ func (e *Enigma) Decrypt(cipher []byte) []byte {
 *                                                                   *
 ********************************************************************/
 
+// Wipes the secret of the first generation and the keys
+// of all previous generations.
 func (e *Enigma) ClearKeys() {
-	secret.ClearSlice(&e.Keys.Blowfish)
-	secret.ClearSlice(&e.Keys.Gost)
-	secret.ClearSlice(&e.Keys.Way3)
+	secret.ClearSlice(&e.key)
+	for _, k := range e.keys {
+		k.clearOld()
+	}
 }
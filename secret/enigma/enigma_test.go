@@ -0,0 +1,415 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/rsakeys"
+	"Carmel/shared/vtc"
+	"crypto/rand"
+	"testing"
+
+	"filippo.io/edwards25519"
+	"github.com/stretchr/testify/assert"
+)
+
+// Two sides of the session after the key agreement.
+func pair(t testing.TB, suite SuiteId) (*Enigma, *Enigma) {
+	return pairOf(t, suite, rsakeys.RSA2048, rsakeys.RSA2048)
+}
+
+// Two sides of the session with identities of the given types.
+func pairOf(t testing.TB, suite SuiteId, serverType, clientType rsakeys.KeyType) (*Enigma, *Enigma) {
+	serverKey := rsakeys.GenerateKey(serverType)
+	clientKey := rsakeys.GenerateKey(clientType)
+	if !assert.NotNil(t, serverKey) || !assert.NotNil(t, clientKey) {
+		t.FailNow()
+	}
+
+	server := newEnigma(serverKey, clientKey.Public())
+	client := newEnigma(clientKey, serverKey.Public())
+
+	serverPublic := server.EphemeralKey()
+	clientPublic := client.EphemeralKey()
+	if !assert.True(t, server.AgreeKeys(vtc.Server, suite, serverPublic, clientPublic)) ||
+		!assert.True(t, client.AgreeKeys(vtc.Client, suite, serverPublic, clientPublic)) {
+		t.FailNow()
+	}
+	assert.Equal(t, server.key, client.key)
+	assert.Equal(t, suite, client.Suite())
+	return server, client
+}
+
+// Encryption by the sender and decryption by the recipient in the given direction.
+func encrypt(sender *Enigma, d Direction, plain []byte) []byte {
+	return sender.Keys(d).Encrypt(plain)
+}
+
+func decrypt(recipient *Enigma, d Direction, cipher []byte) []byte {
+	return recipient.Keys(d).Decrypt(cipher)
+}
+
+func Test_KeyAgreement(t *testing.T) {
+	server, client := pair(t, Cascade)
+	serverPublic := server.EphemeralKey()
+	clientPublic := client.EphemeralKey()
+
+	sign := server.AgreementSignature(vtc.Server, AESGCM, serverPublic, nil)
+	assert.True(t, client.IsValidAgreementSignature(vtc.Server, sign, AESGCM, serverPublic, nil))
+	// The signature can't be used by the other side, for another suite or another key.
+	assert.False(t, server.IsValidAgreementSignature(vtc.Client, sign, AESGCM, serverPublic, nil))
+	assert.False(t, client.IsValidAgreementSignature(vtc.Server, sign, Cascade, serverPublic, nil))
+	assert.False(t, client.IsValidAgreementSignature(vtc.Server, sign, AESGCM, clientPublic, nil))
+
+	sign = client.AgreementSignature(vtc.Client, AESGCM, serverPublic, clientPublic)
+	assert.True(t, server.IsValidAgreementSignature(vtc.Client, sign, AESGCM, serverPublic, clientPublic))
+	assert.False(t, server.IsValidAgreementSignature(vtc.Client, sign, AESGCM, serverPublic, serverPublic))
+
+	// Every session has its own keys.
+	previous := append([]byte{}, server.key...)
+	assert.False(t, server.AgreeKeys(vtc.Server, 0, serverPublic, clientPublic))
+	assert.True(t, server.AgreeKeys(vtc.Server, Cascade, serverPublic, clientPublic))
+	assert.NotEqual(t, previous, server.key)
+	// The ephemeral key is used only once.
+	assert.False(t, server.AgreeKeys(vtc.Server, Cascade, serverPublic, clientPublic))
+}
+
+func Test_Suites(t *testing.T) {
+	plain := []byte("Ala ma kota")
+	for _, suite := range DefaultSuites {
+		server, client := pair(t, suite)
+		cipher := encrypt(server, ServerToClient, plain)
+		assert.Equal(t, plain, decrypt(client, ServerToClient, cipher))
+		// The message can't be sent back to its sender.
+		assert.Nil(t, decrypt(server, ServerToClient, cipher))
+		// Both directions have their own keys.
+		assert.Nil(t, decrypt(client, ClientToServer, cipher))
+		assert.Equal(t, plain, decrypt(server, ClientToServer, encrypt(client, ClientToServer, plain)))
+
+		// Every modification is detected.
+		for _, i := range []int{0, generationIdSize, len(cipher) - 1} {
+			modified := append([]byte{}, cipher...)
+			modified[i] ^= 1
+			assert.Nil(t, decrypt(client, ServerToClient, modified))
+		}
+
+		id, ok := SuiteByName(suite.String())
+		assert.True(t, ok)
+		assert.Equal(t, suite, id)
+	}
+	_, ok := SuiteByName("rot13")
+	assert.False(t, ok)
+
+	common := SuiteCapabilities([]SuiteId{AESGCM})
+	assert.Equal(t, AESGCM, ChooseSuite(DefaultSuites, common))
+	assert.Equal(t, AESGCM, ChooseSuite(DefaultSuites, SuiteCapabilities(DefaultSuites)))
+	assert.Equal(t, Cascade, ChooseSuite([]SuiteId{Cascade, AESGCM}, SuiteCapabilities(DefaultSuites)))
+	assert.Equal(t, Cascade, ChooseSuite(DefaultSuites, SuiteCapabilities([]SuiteId{Cascade})))
+	assert.Equal(t, SuiteId(0), ChooseSuite([]SuiteId{Cascade}, common))
+}
+
+func Test_SenderKeys(t *testing.T) {
+	plain := []byte("Ala ma kota")
+	ad := []byte("header")
+	for _, suite := range DefaultSuites {
+		server, client := pair(t, suite)
+		for _, d := range directions {
+			// Both sides derived the same keys...
+			sent := server.Keys(d).current.suite(vtc.Server).Encrypt(plain, ad)
+			assert.Equal(t, plain, client.Keys(d).current.suite(vtc.Server).Decrypt(sent, ad))
+			// ...but requests and answers of one direction are encrypted
+			// with independent keys (even with the same additional data).
+			assert.Nil(t, client.Keys(d).current.suite(vtc.Client).Decrypt(sent, ad))
+		}
+		// Requests and answers of one stream.
+		assert.Equal(t, plain, decrypt(client, ClientToServer, encrypt(server, ClientToServer, plain)))
+		assert.Equal(t, plain, decrypt(server, ClientToServer, encrypt(client, ClientToServer, plain)))
+	}
+}
+
+func Test_KeyGenerations(t *testing.T) {
+	for _, suite := range DefaultSuites {
+		testKeyGenerations(t, suite)
+	}
+}
+
+func testKeyGenerations(t *testing.T, suite SuiteId) {
+	server, client := pair(t, suite)
+	plain := []byte("Ala ma kota")
+
+	old := encrypt(server, ServerToClient, plain)
+	assert.Equal(t, plain, decrypt(client, ServerToClient, old))
+
+	keys, id, ok := server.NextKeys()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), id)
+	// The next generation can't be skipped.
+	assert.False(t, client.AddKeys(id+1, keys))
+	assert.True(t, client.AddKeys(id, keys))
+	assert.True(t, client.SwitchKeys())
+	assert.Equal(t, id, client.KeyGeneration())
+
+	// The client already uses the new keys, the server still the old ones.
+	assert.Equal(t, plain, decrypt(server, ClientToServer, encrypt(client, ClientToServer, plain)))
+	assert.Equal(t, plain, decrypt(client, ServerToClient, encrypt(server, ServerToClient, plain)))
+
+	assert.True(t, server.SwitchKeys())
+	assert.Equal(t, plain, decrypt(client, ServerToClient, encrypt(server, ServerToClient, plain)))
+
+	// Messages encrypted with the old keys are still readable until ClearKeys.
+	assert.Equal(t, plain, decrypt(client, ServerToClient, old))
+	client.ClearKeys()
+	assert.Nil(t, decrypt(client, ServerToClient, old))
+	assert.Equal(t, plain, decrypt(client, ServerToClient, encrypt(server, ServerToClient, plain)))
+}
+
+// Authentication of a message of the given size with the RSA signature
+// (used for every message before) and with the cipher suites.
+func benchmarkMessages(b *testing.B, size int) {
+	server, client := pair(b, Cascade)
+	plain := make([]byte, size)
+
+	b.Run("rsa-signature", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		for i := 0; i < b.N; i++ {
+			cipher := encrypt(server, ServerToClient, plain)
+			sign := server.Signature(cipher)
+			if !client.IsValidSignature(sign, cipher) || decrypt(client, ServerToClient, cipher) == nil {
+				b.FailNow()
+			}
+		}
+	})
+	for _, suite := range DefaultSuites {
+		server, client := pair(b, suite)
+		b.Run(suite.String(), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if decrypt(client, ServerToClient, encrypt(server, ServerToClient, plain)) == nil {
+					b.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChatLine(b *testing.B) {
+	benchmarkMessages(b, 64)
+}
+
+func BenchmarkBulkData(b *testing.B) {
+	benchmarkMessages(b, 64*1024)
+}
+
+// Identities of both sides: the same and different types.
+var identities = [][2]rsakeys.KeyType{
+	{rsakeys.RSA2048, rsakeys.RSA2048},
+	{rsakeys.Ed25519, rsakeys.Ed25519},
+	{rsakeys.Ed25519, rsakeys.RSA2048},
+	{rsakeys.RSA2048, rsakeys.Ed25519},
+}
+
+func Test_EncryptRSA(t *testing.T) {
+	for _, types := range identities {
+		server, client := pairOf(t, Cascade, types[0], types[1])
+
+		// Much more than fits in one RSA block.
+		for _, size := range []int{1, 245, 4096} {
+			plain := make([]byte, size)
+			rand.Read(plain)
+			cipher := client.EncryptRSA(plain)
+			assert.Equal(t, plain, server.DecryptRsa(cipher), types)
+			// Only the recipient can read the data.
+			assert.Nil(t, client.DecryptRsa(cipher), types)
+
+			for _, i := range []int{0, 1, len(cipher) - size - 1, len(cipher) - 1} {
+				modified := append([]byte{}, cipher...)
+				modified[i] ^= 1
+				assert.Nil(t, server.DecryptRsa(modified), types)
+			}
+		}
+	}
+}
+
+func Test_Challenge(t *testing.T) {
+	for _, types := range identities {
+		server, client := pairOf(t, AESGCM, types[0], types[1])
+		// Without the transcript nothing is signed.
+		serverChallenge, clientChallenge := server.Challenge(), client.Challenge()
+		assert.Nil(t, server.ChallengeSignature(vtc.Server, serverChallenge, clientChallenge))
+
+		for _, e := range []*Enigma{server, client} {
+			e.UpdateTranscript([]byte("login"))
+			e.UpdateTranscript([]byte("key agreement"))
+		}
+		assert.Equal(t, server.Transcript(), client.Transcript())
+
+		sign := client.ChallengeSignature(vtc.Client, serverChallenge, clientChallenge)
+		assert.True(t, server.IsValidChallengeSignature(vtc.Client, sign, serverChallenge, clientChallenge), types)
+		// The signature is valid only for the same side, challenges and transcript.
+		assert.False(t, client.IsValidChallengeSignature(vtc.Server, sign, serverChallenge, clientChallenge), types)
+		assert.False(t, server.IsValidChallengeSignature(vtc.Server, sign, serverChallenge, clientChallenge), types)
+		assert.False(t, server.IsValidChallengeSignature(vtc.Client, sign, server.Challenge(), clientChallenge), types)
+		assert.False(t, server.IsValidChallengeSignature(vtc.Client, sign, serverChallenge[:16], clientChallenge), types)
+
+		sign = server.ChallengeSignature(vtc.Server, serverChallenge, clientChallenge)
+		assert.True(t, client.IsValidChallengeSignature(vtc.Server, sign, serverChallenge, clientChallenge), types)
+		client.UpdateTranscript([]byte("another handshake"))
+		assert.False(t, client.IsValidChallengeSignature(vtc.Server, sign, serverChallenge, clientChallenge), types)
+	}
+}
+
+func Test_Identities(t *testing.T) {
+	data := []byte("Ala ma kota")
+	for _, types := range identities {
+		server, client := pairOf(t, AESGCM, types[0], types[1])
+		assert.True(t, client.IsValidSignature(server.Signature(data), data), types)
+		assert.True(t, server.IsValidSignature(client.Signature(data), data), types)
+		assert.False(t, server.IsValidSignature(server.Signature(data), data), types)
+		assert.Equal(t, server.ResumptionTicket(vtc.Server), client.ResumptionTicket(vtc.Client), types)
+	}
+}
+
+func Test_Padding(t *testing.T) {
+	server, client := pair(t, Cascade)
+	data := []byte("Ala ma kota")
+
+	for _, padding := range []Padding{OAEPPSS, PKCS1v15} {
+		server.Padding, client.Padding = padding, padding
+		assert.True(t, client.IsValidSignature(server.Signature(data), data))
+	}
+	// The signature is checked with the agreed padding only.
+	server.Padding = PKCS1v15
+	client.Padding = OAEPPSS
+	assert.False(t, client.IsValidSignature(server.Signature(data), data))
+
+	// PKCS#1 v1.5 is accepted only in the compatibility mode.
+	cipher := server.EncryptRSA(data)
+	assert.Nil(t, client.DecryptRsa(cipher))
+	client.LegacyRSA = true
+	assert.Equal(t, data, client.DecryptRsa(cipher))
+}
+
+// Exchange of the public keys without knowing the partner's key.
+func bootstrapPair(t *testing.T, serverPin, clientPin string) (*Enigma, *Enigma, *rsakeys.PrivateKey, *rsakeys.PrivateKey) {
+	serverKey := rsakeys.GenerateKey(rsakeys.Ed25519)
+	clientKey := rsakeys.GenerateKey(rsakeys.RSA2048)
+	server, client := newEnigma(serverKey, nil), newEnigma(clientKey, nil)
+	pakePair(t, server, client, serverPin, clientPin)
+
+	serverPublic, clientPublic := server.EphemeralKey(), client.EphemeralKey()
+	if !assert.True(t, server.AgreeBootstrapKeys(vtc.Server, serverPublic, clientPublic)) ||
+		!assert.True(t, client.AgreeBootstrapKeys(vtc.Client, serverPublic, clientPublic)) {
+		t.FailNow()
+	}
+	return server, client, serverKey, clientKey
+}
+
+// Key exchange authenticated with the PIN.
+func pakePair(t *testing.T, server, client *Enigma, serverPin, clientPin string) {
+	clientShare := client.PakeShare(vtc.Client, clientPin, "ala", "ola")
+	serverShare := server.PakeShare(vtc.Server, serverPin, "ala", "ola")
+	if !assert.True(t, server.AgreePakeKey(clientShare)) || !assert.True(t, client.AgreePakeKey(serverShare)) {
+		t.FailNow()
+	}
+}
+
+func Test_Pake(t *testing.T) {
+	// M and N are of prime order.
+	minusOne := edwards25519.NewScalar().Negate(scalarOne())
+	for _, point := range []*edwards25519.Point{pakeM, pakeN} {
+		sum := new(edwards25519.Point).ScalarMult(minusOne, point)
+		sum.Add(sum, point)
+		assert.Equal(t, 1, sum.Equal(edwards25519.NewIdentityPoint()))
+	}
+
+	server, client := newEnigma(nil, nil), newEnigma(nil, nil)
+	pakePair(t, server, client, "1234", "1234")
+	assert.Equal(t, server.pakeKey(), client.pakeKey())
+	assert.Len(t, server.pakeKey(), pakeKeySize)
+	assert.True(t, client.IsValidPakeConfirmation(server.PakeConfirmation()))
+	assert.True(t, server.IsValidPakeConfirmation(client.PakeConfirmation()))
+	// The confirmations of both sides differ.
+	assert.False(t, server.IsValidPakeConfirmation(server.PakeConfirmation()))
+	// The key is agreed once.
+	assert.False(t, server.AgreePakeKey(client.pake.share))
+	server.ClearPake()
+	assert.Nil(t, server.PakeConfirmation())
+
+	// Wrong PIN, other names.
+	pakePair(t, server, client, "1234", "1235")
+	assert.NotEqual(t, server.pakeKey(), client.pakeKey())
+	assert.False(t, client.IsValidPakeConfirmation(server.PakeConfirmation()))
+	assert.False(t, server.IsValidPakeConfirmation(client.PakeConfirmation()))
+	clientShare := client.PakeShare(vtc.Client, "1234", "ala", "ela")
+	serverShare := server.PakeShare(vtc.Server, "1234", "ala", "ola")
+	assert.True(t, server.AgreePakeKey(clientShare) && client.AgreePakeKey(serverShare))
+	assert.False(t, client.IsValidPakeConfirmation(server.PakeConfirmation()))
+
+	// Malformed share, identity point.
+	server.PakeShare(vtc.Server, "1234", "ala", "ola")
+	assert.False(t, server.AgreePakeKey([]byte{1, 2, 3}))
+	identity := new(edwards25519.Point).ScalarMult(server.pake.w, pakeM)
+	assert.False(t, server.AgreePakeKey(identity.Bytes()))
+}
+
+func scalarOne() *edwards25519.Scalar {
+	one := make([]byte, 32)
+	one[0] = 1
+	scalar, _ := edwards25519.NewScalar().SetCanonicalBytes(one)
+	return scalar
+}
+
+func Test_Bootstrap(t *testing.T) {
+	server, client, serverKey, clientKey := bootstrapPair(t, "abcd", "abcd")
+
+	sealed := server.SealBootstrap(vtc.Server, "ola", serverKey.Public().Pem())
+	received := client.OpenBootstrap(vtc.Server, "ola", sealed)
+	if assert.NotNil(t, received) {
+		assert.Equal(t, serverKey.Public().Fingerprint(), received.Fingerprint())
+	}
+	sealed = client.SealBootstrap(vtc.Client, "ala", clientKey.Public().Pem())
+	received = server.OpenBootstrap(vtc.Client, "ala", sealed)
+	if assert.NotNil(t, received) {
+		assert.Equal(t, clientKey.Public().Fingerprint(), received.Fingerprint())
+	}
+
+	// Other name, other role, modified data.
+	assert.Nil(t, server.OpenBootstrap(vtc.Client, "ola", sealed))
+	assert.Nil(t, server.OpenBootstrap(vtc.Server, "ala", sealed))
+	for _, i := range []int{0, len(sealed) - 1} {
+		modified := append([]byte{}, sealed...)
+		modified[i] ^= 1
+		assert.Nil(t, server.OpenBootstrap(vtc.Client, "ala", modified))
+	}
+}
+
+func Test_BootstrapPin(t *testing.T) {
+	server, client, serverKey, _ := bootstrapPair(t, "abcd", "abce")
+	sealed := server.SealBootstrap(vtc.Server, "ola", serverKey.Public().Pem())
+	assert.Nil(t, client.OpenBootstrap(vtc.Server, "ola", sealed))
+}
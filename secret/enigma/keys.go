@@ -0,0 +1,258 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/vtc"
+	"encoding/binary"
+	"log"
+	"sync"
+)
+
+// Key schedule.
+//
+// Every key generation starts with a secret (agreed by both sides,
+// see AgreeKeys, or sent by the server, see NextKeys). Independent keys
+// for both directions of the session, and separately for encryption
+// and authentication, are derived from it with HKDF. In every direction
+// requests and answers have different senders, so each sender gets its own
+// keys (and its own space of nonces):
+//
+//	client -> server: client's keys (requests), server's keys (answers)
+//	server -> client: server's keys (requests), client's keys (answers)
+//
+// Every stream of the session gets only its own direction's keys (see Enigma.Keys).
+// Messages are encrypted with the keys of my role and decrypted with
+// the partner's ones.
+//
+// Symmetric keys are replaced during the session (see session/rekey.go).
+// Every encrypted message starts with the identifier of the key generation,
+// messages encrypted with the previous generation can still be decrypted
+// until ClearKeys is called.
+
+type Direction uint8
+
+const (
+	_              Direction = iota
+	ClientToServer           // requests from the client, answers from the server
+	ServerToClient           // requests from the server, answers from the client
+)
+
+var directions = []Direction{ClientToServer, ServerToClient}
+
+const (
+	secretSize       = 32
+	generationIdSize = 4
+)
+
+// Keys of one direction of the session.
+type Keys struct {
+	direction Direction
+	role      vtc.RoleType // my role in the session
+
+	mutex   sync.RWMutex
+	current *keyGeneration   // used for encryption
+	next    *keyGeneration   // already known, not used for encryption yet
+	old     []*keyGeneration // used only for decryption
+}
+
+// Symmetric ciphers of one key generation.
+type keyGeneration struct {
+	id     uint32
+	client Suite // messages sent by the client
+	server Suite // messages sent by the server
+}
+
+func (d Direction) label() string {
+	if d == ClientToServer {
+		return "carmel client to server"
+	}
+	return "carmel server to client"
+}
+
+func senderLabel(sender vtc.RoleType) string {
+	if sender == vtc.Server {
+		return "s2c"
+	}
+	return "c2s"
+}
+
+// Keys of the given suite for messages of one sender in one direction.
+func deriveSuite(id SuiteId, d Direction, sender vtc.RoleType, generationSecret []byte) Suite {
+	info, ok := suites[id]
+	if !ok {
+		return nil
+	}
+	label := d.label() + " " + senderLabel(sender)
+	encKey := secret.HKDF(generationSecret, nil, []byte(label+" encryption"), info.encKeySize)
+	defer secret.ClearSlice(&encKey)
+	var macKey []byte
+	if info.macKeySize > 0 {
+		macKey = secret.HKDF(generationSecret, nil, []byte(label+" authentication"), info.macKeySize)
+		defer secret.ClearSlice(&macKey)
+	}
+	if encKey != nil {
+		return info.create(encKey, macKey)
+	}
+	return nil
+}
+
+// Keys of one generation for both senders in one direction.
+func deriveGeneration(id uint32, suite SuiteId, d Direction, generationSecret []byte) *keyGeneration {
+	client := deriveSuite(suite, d, vtc.Client, generationSecret)
+	server := deriveSuite(suite, d, vtc.Server, generationSecret)
+	if client == nil || server == nil {
+		if client != nil {
+			client.Clean()
+		}
+		if server != nil {
+			server.Clean()
+		}
+		return nil
+	}
+	return &keyGeneration{id: id, client: client, server: server}
+}
+
+// Suite of the given sender.
+func (g *keyGeneration) suite(sender vtc.RoleType) Suite {
+	if sender == vtc.Server {
+		return g.server
+	}
+	return g.client
+}
+
+func (g *keyGeneration) clean() {
+	g.client.Clean()
+	g.server.Clean()
+}
+
+// Replaces all generations with the given one.
+func (k *Keys) reset(g *keyGeneration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, old := range append([]*keyGeneration{k.current, k.next}, k.old...) {
+		if old != nil {
+			old.clean()
+		}
+	}
+	k.current, k.next, k.old = g, nil, nil
+}
+
+func (k *Keys) setNext(g *keyGeneration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.next != nil {
+		k.next.clean()
+	}
+	k.next = g
+}
+
+func (k *Keys) switchKeys() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.next == nil {
+		return false
+	}
+	if k.current != nil {
+		k.old = append(k.old, k.current)
+	}
+	k.current, k.next = k.next, nil
+	return true
+}
+
+func (k *Keys) clearOld() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, g := range k.old {
+		g.clean()
+	}
+	k.old = nil
+}
+
+func (k *Keys) generation(id uint32) *keyGeneration {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	for _, g := range append([]*keyGeneration{k.current, k.next}, k.old...) {
+		if g != nil && g.id == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// Encryption with the current suite (see suite.go).
+// The result is preceded by the identifier of the key generation.
+// Every message is authenticated by the suite (MAC or AEAD tag),
+// RSA signatures are used only during the key agreement.
+func (k *Keys) Encrypt(plain []byte) []byte {
+	k.mutex.RLock()
+	g := k.current
+	k.mutex.RUnlock()
+
+	if g != nil {
+		header := make([]byte, generationIdSize)
+		binary.LittleEndian.PutUint32(header, g.id)
+		if cipher := g.suite(k.role).Encrypt(plain, additionalData(header, k.role)); cipher != nil {
+			return append(header, cipher...)
+		}
+	}
+	return nil
+}
+
+// See Encrypt
+func (k *Keys) Decrypt(cipher []byte) []byte {
+	if len(cipher) <= generationIdSize {
+		return nil
+	}
+	header := cipher[:generationIdSize]
+	g := k.generation(binary.LittleEndian.Uint32(header))
+	if g == nil {
+		log.Printf("unknown key generation: %d\n", binary.LittleEndian.Uint32(header))
+		return nil
+	}
+	sender := buddyRole(k.role)
+	return g.suite(sender).Decrypt(cipher[generationIdSize:], additionalData(header, sender))
+}
+
+// The header and the sender's role are authenticated together
+// with the message (requests and answers of one direction
+// can't be swapped or sent back to their sender).
+func additionalData(header []byte, sender vtc.RoleType) []byte {
+	return append(append([]byte{}, header...), byte(sender))
+}
+
+func buddyRole(role vtc.RoleType) vtc.RoleType {
+	if role == vtc.Server {
+		return vtc.Client
+	}
+	return vtc.Server
+}
@@ -0,0 +1,212 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/shared/vtc"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+
+	"filippo.io/edwards25519"
+)
+
+// Password-authenticated key exchange with the PIN from the invitation
+// (SPAKE2, RFC 9382: edwards25519, SHA-256, HKDF, HMAC):
+//
+//	client: pA = x*G + w*M        server: pB = y*G + w*N
+//	K = h*x*(pB - w*N) = h*y*(pA - w*M)
+//
+// w is derived from the PIN and the names of both sides. The shares are sent
+// in the clear and both sides prove with a MAC (confirmation) that they have
+// the same key. A wrong PIN gives another key, nothing more: an attacker
+// can check only one PIN per connection, recorded messages don't allow
+// trying PINs offline. The key protects the exchange of the public keys
+// at the first contact (see bootstrap.go).
+
+const (
+	pakeKeySize          = 16 // Ke and confirmation keys (SHA-256 split in halves)
+	pakeRandomScalarSize = 64
+)
+
+var (
+	// Points of RFC 9382 (nobody knows their discrete logarithms).
+	pakeM = pakePoint("d048032c6ea0b6d697ddc2e86bda85a33adac920f1bf18e1b0c6d166a5cecdaf")
+	pakeN = pakePoint("d3bfb518f44f3430f29d0c92af503865a1ed3281dc69b35dd868ba85f886c4ab")
+
+	pakeLabel            = []byte("carmel pin")
+	pakeConfirmationInfo = []byte("ConfirmationKeys")
+)
+
+type pake struct {
+	role          vtc.RoleType
+	clientName    string
+	serverName    string
+	scalar        *edwards25519.Scalar // x or y
+	w             *edwards25519.Scalar // derived from the PIN
+	share         []byte               // pA or pB
+	key           []byte               // Ke
+	confirmations [2][]byte            // cA, cB
+}
+
+// Starts the exchange and returns my share (pA of the client, pB of the server).
+func (e *Enigma) PakeShare(role vtc.RoleType, pin, clientName, serverName string) []byte {
+	random := secret.RandomBytes(pakeRandomScalarSize)
+	if random == nil {
+		return nil
+	}
+	defer secret.ClearSlice(&random)
+	scalar, err := edwards25519.NewScalar().SetUniformBytes(random)
+	if err != nil {
+		return nil
+	}
+	hash := sha512.Sum512(pakeFields(pakeLabel, []byte(clientName), []byte(serverName), []byte(pin)))
+	w, err := edwards25519.NewScalar().SetUniformBytes(hash[:])
+	if err != nil {
+		return nil
+	}
+
+	mask := pakeM
+	if role == vtc.Server {
+		mask = pakeN
+	}
+	share := new(edwards25519.Point).ScalarBaseMult(scalar)
+	share.Add(share, new(edwards25519.Point).ScalarMult(w, mask))
+	e.pake = &pake{role: role, clientName: clientName, serverName: serverName, scalar: scalar, w: w, share: share.Bytes()}
+	return e.pake.share
+}
+
+// Computes the key from the partner's share.
+// Fails for a malformed share (the PIN isn't checked yet, see confirmations).
+func (e *Enigma) AgreePakeKey(buddyShare []byte) bool {
+	p := e.pake
+	if p == nil || p.key != nil {
+		return false
+	}
+	buddyPoint, err := new(edwards25519.Point).SetBytes(buddyShare)
+	if err != nil {
+		return false
+	}
+	mask := pakeN
+	shareA, shareB := p.share, buddyShare
+	if p.role == vtc.Server {
+		mask = pakeM
+		shareA, shareB = buddyShare, p.share
+	}
+	k := new(edwards25519.Point).Subtract(buddyPoint, new(edwards25519.Point).ScalarMult(p.w, mask))
+	k.ScalarMult(p.scalar, k)
+	k.MultByCofactor(k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return false
+	}
+
+	transcript := pakeFields([]byte(p.clientName), []byte(p.serverName), shareA, shareB, k.Bytes(), p.w.Bytes())
+	defer secret.ClearSlice(&transcript)
+	sum := sha256.Sum256(transcript)
+	hash := sum[:]
+	defer secret.ClearSlice(&hash)
+	p.key = append([]byte{}, hash[:pakeKeySize]...)
+	confirmationKeys := secret.HKDF(hash[pakeKeySize:], nil, pakeConfirmationInfo, 2*pakeKeySize)
+	if confirmationKeys == nil {
+		return false
+	}
+	defer secret.ClearSlice(&confirmationKeys)
+	for i := range p.confirmations {
+		mac := hmac.New(sha256.New, confirmationKeys[i*pakeKeySize:(i+1)*pakeKeySize])
+		mac.Write(transcript)
+		p.confirmations[i] = mac.Sum(nil)
+	}
+	return true
+}
+
+// My confirmation (MAC) sent to the partner.
+func (e *Enigma) PakeConfirmation() []byte {
+	if e.pake == nil || e.pake.key == nil {
+		return nil
+	}
+	return e.pake.confirmations[pakeIndex(e.pake.role)]
+}
+
+// The partner used the same PIN.
+func (e *Enigma) IsValidPakeConfirmation(mac []byte) bool {
+	if e.pake == nil || e.pake.key == nil {
+		return false
+	}
+	buddyRole := vtc.Server
+	if e.pake.role == vtc.Server {
+		buddyRole = vtc.Client
+	}
+	return hmac.Equal(mac, e.pake.confirmations[pakeIndex(buddyRole)])
+}
+
+// The key of the exchange isn't needed after the login.
+func (e *Enigma) ClearPake() {
+	if p := e.pake; p != nil {
+		secret.ClearSlice(&p.key)
+		p.scalar.Set(edwards25519.NewScalar())
+		p.w.Set(edwards25519.NewScalar())
+		e.pake = nil
+	}
+}
+
+func (e *Enigma) pakeKey() []byte {
+	if e.pake != nil {
+		return e.pake.key
+	}
+	return nil
+}
+
+func pakeIndex(role vtc.RoleType) int {
+	if role == vtc.Server {
+		return 1
+	}
+	return 0
+}
+
+// Every field is preceded by its length (8 bytes, little endian).
+func pakeFields(fields ...[]byte) []byte {
+	var data []byte
+	for _, field := range fields {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(field)))
+		data = append(append(data, size[:]...), field...)
+	}
+	return data
+}
+
+func pakePoint(text string) *edwards25519.Point {
+	if data, err := hex.DecodeString(text); err == nil {
+		if point, err := new(edwards25519.Point).SetBytes(data); err == nil {
+			return point
+		}
+	}
+	panic("invalid point: " + text)
+}
@@ -0,0 +1,212 @@
+/*
+ * BSD 2-Clause License
+ *
+ *	Copyright (c) 2019, Piotr Pszczółkowski
+ *	All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ * list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ * this list of conditions and the following disclaimer in the documentation
+ * and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package enigma
+
+import (
+	"Carmel/secret"
+	"Carmel/secret/enigma/blowfish"
+	"Carmel/secret/enigma/gost"
+	"Carmel/secret/enigma/way3"
+	"Carmel/shared/vtc"
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+)
+
+// Suite encrypts and authenticates messages with the symmetric keys
+// of one key generation. Both partners select the suite during
+// the key agreement (see Session.AgreeKeysAsServer).
+// The additional data (ad) is authenticated, but not encrypted.
+// Decrypt returns nil if the cipher text or the additional data were modified.
+type Suite interface {
+	Id() SuiteId
+	Encrypt(plain, ad []byte) []byte
+	Decrypt(cipher, ad []byte) []byte
+	Clean() // wipes the keys
+}
+
+type SuiteId uint8
+
+const (
+	_       SuiteId = iota
+	Cascade         // Blowfish CBC -> Gost ECB (decryption) -> 3-Way CBC, HMAC-SHA256
+	AESGCM          // AES-256-GCM
+)
+
+// All supported suites in the default order of preference.
+// Cascade is the legacy suite, it is chosen only if the partner does not
+// accept AES-256-GCM or if it is put first explicitly.
+var DefaultSuites = []SuiteId{AESGCM, Cascade}
+
+type suiteInfo struct {
+	name       string
+	encKeySize int              // bytes of the encryption key
+	macKeySize int              // bytes of the authentication key (0 - AEAD)
+	capability vtc.Capabilities // announced in Hello
+	create     func(encKey, macKey []byte) Suite
+}
+
+var suites = map[SuiteId]suiteInfo{
+	Cascade: {"cascade", cascadeKeySize, macKeySize, vtc.CascadeSuite, newCascade},
+	AESGCM:  {"aes-256-gcm", aesKeySize, 0, vtc.AESGCMSuite, newAESGCM},
+}
+
+func (id SuiteId) String() string {
+	if info, ok := suites[id]; ok {
+		return info.name
+	}
+	return "?"
+}
+
+func (id SuiteId) IsValid() bool {
+	_, ok := suites[id]
+	return ok
+}
+
+func SuiteByName(name string) (SuiteId, bool) {
+	for id, info := range suites {
+		if info.name == strings.ToLower(strings.TrimSpace(name)) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Capabilities announcing the given suites.
+func SuiteCapabilities(ids []SuiteId) vtc.Capabilities {
+	var c vtc.Capabilities
+	for _, id := range ids {
+		c |= suites[id].capability
+	}
+	return c
+}
+
+// The first of my suites (in the order of preference)
+// which is supported by both partners (0 - there is no such suite).
+func ChooseSuite(mine []SuiteId, common vtc.Capabilities) SuiteId {
+	for _, id := range mine {
+		if info, ok := suites[id]; ok && common.Has(info.capability) {
+			return id
+		}
+	}
+	return 0
+}
+
+/********************************************************************
+*                                                                   *
+*                         C A S C A D E                             *
+*                                                                   *
+********************************************************************/
+
+// The cipher text is authenticated with HMAC-SHA256 (encrypt-then-MAC).
+
+const (
+	macKeySize     = 32
+	macSize        = sha256.Size
+	cascadeKeySize = blowfish.MaxKeyLength + gost.KeySize + way3.KeySize
+)
+
+type cascade struct {
+	bf     *blowfish.Blowfish // blowfish
+	gt     *gost.Gost         // gost
+	w3     *way3.Way3         // 3-way
+	macKey []byte             // HMAC-SHA256
+}
+
+func newCascade(key, macKey []byte) Suite {
+	if len(key) != cascadeKeySize || len(macKey) != macKeySize {
+		return nil
+	}
+	bfKey := key[:blowfish.MaxKeyLength]
+	gtKey := key[blowfish.MaxKeyLength : blowfish.MaxKeyLength+gost.KeySize]
+	w3Key := key[blowfish.MaxKeyLength+gost.KeySize:]
+
+	if bf := blowfish.New(bfKey); bf != nil {
+		if gt := gost.New(gtKey); gt != nil {
+			if w3 := way3.New(w3Key); w3 != nil {
+				return &cascade{bf: bf, gt: gt, w3: w3, macKey: append([]byte{}, macKey...)}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cascade) Id() SuiteId {
+	return Cascade
+}
+
+// We use a three-stage EDE encryption system (Encryption-Decryption-Encryption)
+// 1. Encryption - Blowfish CBC
+// 2. Decryption - Gost ECB
+// 3. Encryption - 3-Way CBC
+// Notice: we perform all encryptions using a randomly generated IV
+// The cipher text is followed by its MAC.
+func (c *cascade) Encrypt(plain, ad []byte) []byte {
+	if bfCipher := c.bf.EncryptCBC(plain, nil); bfCipher != nil {
+		if gtCipher := c.gt.DecryptECB(bfCipher); gtCipher != nil {
+			if cipher := c.w3.EncryptCBC(gtCipher, nil); cipher != nil {
+				return append(cipher, c.mac(cipher, ad)...)
+			}
+		}
+	}
+	return nil
+}
+
+// See Encrypt
+func (c *cascade) Decrypt(data, ad []byte) []byte {
+	if len(data) <= macSize {
+		return nil
+	}
+	cipher, tag := data[:len(data)-macSize], data[len(data)-macSize:]
+	if !hmac.Equal(tag, c.mac(cipher, ad)) {
+		return nil
+	}
+	if w3Plain := c.w3.DecryptCBC(cipher); w3Plain != nil {
+		if gtPlain := c.gt.EncryptECB(w3Plain); gtPlain != nil {
+			if plain := c.bf.DecryptCBC(gtPlain); plain != nil {
+				return plain
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cascade) mac(cipher, ad []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(ad)
+	mac.Write(cipher)
+	return mac.Sum(nil)
+}
+
+func (c *cascade) Clean() {
+	c.bf.Clean()
+	c.gt.Clean()
+	c.w3.Clean()
+	secret.ClearSlice(&c.macKey)
+}
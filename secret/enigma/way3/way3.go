@@ -187,6 +187,12 @@ func (tw *Way3) DecryptCBC(cipherText []byte) []byte {
 	return buffer
 }
 
+// Clean - clears the keys.
+func (tw *Way3) Clean() {
+	tw.k[0], tw.k[1], tw.k[2] = 0, 0, 0
+	tw.ki[0], tw.ki[1], tw.ki[2] = 0, 0, 0
+}
+
 func (tw *Way3) keyGenerator(k0, k1, k2 uint32) {
 	// key
 	tw.k[0], tw.k[1], tw.k[2] = k0, k1, k2
@@ -30,7 +30,9 @@ package secret
 
 import (
 	"Carmel/shared/tr"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
@@ -74,6 +76,33 @@ func RandomBytes(size int) []byte {
 	return nil
 }
 
+// HKDF (RFC 5869) with SHA-256.
+// Derives 'size' bytes of key material from the given secret.
+func HKDF(secret, salt, info []byte, size int) []byte {
+	if size <= 0 || size > 255*sha256.Size {
+		return nil
+	}
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	defer ClearSlice(&prk)
+
+	buffer := make([]byte, 0, size+sha256.Size)
+	var block []byte
+	for i := byte(1); len(buffer) < size; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		buffer = append(buffer, block...)
+	}
+	return buffer[:size]
+}
+
 func SliceToHex(data []byte) string {
 	ndigits := hex.EncodedLen(len(data))
 	buffer := make([]byte, ndigits, ndigits)
@@ -29,6 +29,7 @@
 package secret
 
 import (
+	"encoding/hex"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -66,3 +67,33 @@ func Test_Padding(t *testing.T) {
 		assert.True(t, AreSlicesEqual(result, test.want))
 	}
 }
+
+// RFC 5869, test cases 1 and 3.
+func Test_HKDF(t *testing.T) {
+	unhex := func(s string) []byte {
+		data, _ := hex.DecodeString(s)
+		return data
+	}
+	var tests = []struct {
+		ikm, salt, info []byte
+		want            string
+	}{
+		{
+			unhex("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"),
+			unhex("000102030405060708090a0b0c"),
+			unhex("f0f1f2f3f4f5f6f7f8f9"),
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			unhex("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"),
+			nil,
+			nil,
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, SliceToHex(HKDF(test.ikm, test.salt, test.info, 42)))
+	}
+	assert.Nil(t, HKDF([]byte("key"), nil, nil, 0))
+}